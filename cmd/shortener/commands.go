@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/repository"
+)
+
+const usage = `usage: shortener [flags] [command]
+
+commands:
+  migrate up      apply all pending migrations
+  migrate down    roll back the last migration
+  migrate status  list migrations and their state
+  apikey create NAME SCOPES
+                  create a key with comma separated scopes:
+                  create, read-stats, delete, admin
+  apikey list     list keys
+  apikey revoke ID
+                  revoke a key
+  export [FILE]   write all links to FILE or stdout
+  import [FILE]   read links from FILE or stdin, existing short urls are
+                  updated, links with bad urls or short urls or urls
+                  blocked by the policy are skipped, -dry-run only
+                  reports what would change
+
+export and import use JSON lines, CSV is chosen with -format csv
+or a .csv FILE`
+
+// runCommand runs a subcommand instead of the server and returns the exit code.
+func runCommand(lg logger.MyLogger, repoConf repository.StorageConfig, args []string) int {
+	var err error
+
+	switch args[0] {
+	case "migrate":
+		err = runMigrate(lg, repoConf, args[1:])
+	case "apikey":
+		err = runAPIKey(repoConf, args[1:])
+	case "export":
+		err = runExport(repoConf, args[1:])
+	case "import":
+		err = runImport(repoConf, args[1:])
+	default:
+		err = fmt.Errorf("UNKNOWN COMMAND %q", args[0])
+	}
+
+	if err != nil {
+		lg.Errorln(err.Error())
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	return 0
+}
+
+func runMigrate(lg logger.MyLogger, repoConf repository.StorageConfig, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("MIGRATE NEEDS up, down OR status")
+	}
+
+	m, err := repository.NewMigrator(repoConf)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		return m.Down(ctx)
+	case "status":
+		statuses, err := m.Status(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tMIGRATION\tSTATE\tAPPLIED AT")
+
+		for _, v := range statuses {
+			appliedAt := ""
+
+			if !v.AppliedAt.IsZero() {
+				appliedAt = v.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", v.Source.Version, v.Source.Path, v.State, appliedAt)
+		}
+
+		return w.Flush()
+	}
+
+	return fmt.Errorf("UNKNOWN MIGRATE COMMAND %q", args[0])
+}
+
+// commandStorage opens the storage for a command. A short run must not
+// purge links behind the back of the server and needs no cache.
+func commandStorage(repoConf repository.StorageConfig) (*repository.StorageService, error) {
+	repoConf.ReaperInterval = 0
+	repoConf.CacheSize = 0
+
+	return repository.NewStorageService(repoConf)
+}
+
+func runAPIKey(repoConf repository.StorageConfig, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("APIKEY NEEDS create, list OR revoke")
+	}
+
+	repo, err := commandStorage(repoConf)
+
+	if err != nil {
+		return err
+	}
+
+	defer repo.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		if len(args) != 3 {
+			return fmt.Errorf("APIKEY CREATE NEEDS NAME AND SCOPES")
+		}
+
+		scopes, err := repository.ParseScopes(args[2])
+
+		if err != nil {
+			return err
+		}
+
+		key, apiKey, err := repo.CreateAPIKey(ctx, args[1], scopes)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("id:  %s\nkey: %s\n", apiKey.ID, key)
+		fmt.Fprintln(os.Stderr, "the key is shown only once, keep it safe")
+
+		return nil
+	case "list":
+		apiKeys, err := repo.ListAPIKeys(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tUSER\tCREATED AT\tREVOKED AT")
+
+		for _, v := range apiKeys {
+			revokedAt := ""
+
+			if v.IsRevoked() {
+				revokedAt = v.RevokedAt.Format(time.RFC3339)
+			}
+
+			scopes := make([]string, len(v.Scopes))
+
+			for k, scope := range v.Scopes {
+				scopes[k] = string(scope)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", v.ID, v.Name, strings.Join(scopes, ","),
+				v.UserID, v.CreatedAt.Format(time.RFC3339), revokedAt)
+		}
+
+		return w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("APIKEY REVOKE NEEDS ID")
+		}
+
+		return repo.RevokeAPIKey(ctx, args[1])
+	}
+
+	return fmt.Errorf("UNKNOWN APIKEY COMMAND %q", args[0])
+}
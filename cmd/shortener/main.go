@@ -1,54 +1,279 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/DmitryM7/short-url.git/internal/conf"
 	"github.com/DmitryM7/short-url.git/internal/controller"
 	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/metrics"
+	"github.com/DmitryM7/short-url.git/internal/policy"
+	"github.com/DmitryM7/short-url.git/internal/ratelimit"
 	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/DmitryM7/short-url.git/internal/urlnorm"
 )
 
 func main() {
-	lg := logger.NewLogger()
+	conf.ParseFlags()
+	flag.Parse()
+
+	// flags may also follow the subcommand and mix with its arguments:
+	// shortener import -dry-run links.csv -d ... ("-" alone is stdin)
+	args := flag.Args()
+
+	for k := 0; k < len(args); k++ {
+		if len(args[k]) > 1 && strings.HasPrefix(args[k], "-") {
+			if err := flag.CommandLine.Parse(args[k:]); err != nil {
+				os.Exit(2)
+			}
+			args = append(args[:k:k], flag.Args()...)
+			k--
+		}
+	}
+
+	if err := conf.ParseEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	lg, err := logger.New(logger.Config{Level: conf.LogLevel, Format: conf.LogFormat})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	defer lg.Sync() //nolint:errcheck // nothing to do if stderr is gone
 
 	lg.Infoln("RUN...")
 
-	conf.ParseFlags()
-	flag.Parse()
-	conf.ParseEnv()
+	repoConf := storageConfig(lg)
 
-	repoConf := repository.StorageConfig{Logger: lg}
+	// imports are checked against the policy too, so it is loaded
+	// before subcommands run
+	if conf.PolicyFile != "" {
+		pol, err := policy.Load(lg, conf.PolicyFile, conf.PolicyReload)
 
-	if conf.DSN != "" {
-		repoConf.StorageType = repository.DBType
-		repoConf.DatabaseDSN = conf.DSN
-	} else {
-		repoConf.StorageType = repository.FileType
-		repoConf.FilePath = conf.FilePath
+		if err != nil {
+			lg.Fatalln("CANT LOAD POLICY:" + err.Error())
+		}
+
+		defer pol.Close()
+		repoConf.Policy = pol
 	}
 
-	repo, err := repository.NewStorageService(repoConf)
+	if len(args) > 0 {
+		os.Exit(runCommand(lg, repoConf, args))
+	}
+
+	mtr := metrics.New()
+
+	storage, err := repository.NewStorage(repoConf)
 
 	if err != nil {
 		lg.Fatalln("CANT INIT REPO" + fmt.Sprintf("%#v", err))
 	}
 
-	r := controller.NewRouter(lg, repo)
+	storage = metrics.InstrumentStorage(storage, mtr)
+	mtr.WatchLinks(storage)
 
-	lg.Infoln("Starting server", "bndAdd", conf.BndAdd)
+	repo, err := repository.NewStorageServiceFor(storage, repoConf)
 
-	server := &http.Server{
+	if err != nil {
+		storage.Close()
+		lg.Fatalln("CANT INIT REPO" + fmt.Sprintf("%#v", err))
+	}
+
+	limiter, limits, err := rateLimits()
+
+	if err != nil {
+		closeRepo(lg, repo)
+		lg.Fatalln("CANT INIT RATE LIMITS:" + err.Error())
+	}
+
+	if closer, ok := limiter.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	keyRequired, err := requiredScopes()
+
+	if err != nil {
+		closeRepo(lg, repo)
+		lg.Fatalln("CANT READ REQUIRED SCOPES:" + err.Error())
+	}
+
+	r, err := controller.NewRouter(lg, repo,
+		controller.WithMetrics(mtr),
+		controller.WithRateLimits(limiter, limits),
+		controller.WithAPIKeys(keyRequired...))
+
+	if err != nil {
+		closeRepo(lg, repo)
+		lg.Fatalln("CANT CREATE SERVER:" + err.Error())
+	}
+
+	servers := []*http.Server{{
 		Addr:         conf.BndAdd,
 		Handler:      r,
 		WriteTimeout: 5 * time.Second,
 		ReadTimeout:  30 * time.Second,
+	}}
+
+	if conf.MetricsPublic {
+		r.Handle("/metrics", mtr.Handler())
 	}
 
-	if errServ := server.ListenAndServe(); errServ != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+
+	lg.Infow("Starting server", "addr", servers[0].Addr)
+
+	go func() {
+		serverErr <- servers[0].ListenAndServe()
+	}()
+
+	// metrics are not worth stopping the shortener, so a failure
+	// of their listener is only logged
+	if conf.MetricsAddr != "" {
+		metricsServer := &http.Server{
+			Addr:         conf.MetricsAddr,
+			Handler:      mtr.Handler(),
+			WriteTimeout: 5 * time.Second,
+			ReadTimeout:  5 * time.Second,
+		}
+		servers = append(servers, metricsServer)
+
+		lg.Infow("Starting metrics server", "addr", metricsServer.Addr)
+
+		go func() {
+			if errServ := metricsServer.ListenAndServe(); !errors.Is(errServ, http.ErrServerClosed) {
+				lg.Errorw(errServ.Error(), "event", "start metrics server", "addr", metricsServer.Addr)
+			}
+		}()
+	}
+
+	select {
+	case errServ := <-serverErr:
+		closeRepo(lg, repo)
 		lg.Fatalw(errServ.Error(), "event", "start server")
+	case <-ctx.Done():
+	}
+
+	lg.Infoln("SHUTTING DOWN", "timeout", conf.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if errShut := server.Shutdown(shutdownCtx); errShut != nil && !errors.Is(errShut, http.ErrServerClosed) {
+			lg.Errorw(errShut.Error(), "event", "shutdown server", "addr", server.Addr)
+		}
+	}
+
+	closeRepo(lg, repo)
+
+	lg.Infoln("STOPPED")
+}
+
+func storageConfig(lg logger.MyLogger) repository.StorageConfig {
+	repoConf := repository.StorageConfig{
+		Logger:             lg,
+		ShortCodeGenerator: conf.ShortCodeGen,
+		ShortCodeSalt:      conf.SecretKey,
+		ReaperInterval:     conf.ReaperInterval,
+		ReadTimeout:        conf.StorageReadTO,
+		WriteTimeout:       conf.StorageWriteTO,
+		CacheSize:          conf.CacheSize,
+		CacheTTL:           conf.CacheTTL,
+		CacheMissTTL:       conf.CacheMissTTL,
+		URLOptions: urlnorm.Options{
+			SortQuery:     conf.URLSortQuery,
+			StripTracking: conf.URLStripTrack,
+		},
+	}
+
+	if conf.DSN != "" {
+		repoConf.StorageType = repository.DBType
+		repoConf.DatabaseDSN = conf.DSN
+	} else if conf.RedisAddr != "" {
+		repoConf.StorageType = repository.RedisType
+		repoConf.RedisAddr = conf.RedisAddr
+	} else if conf.SQLitePath != "" {
+		repoConf.StorageType = repository.SQLiteType
+		repoConf.SQLitePath = conf.SQLitePath
+	} else {
+		repoConf.StorageType = repository.FileType
+		repoConf.FilePath = conf.FilePath
+	}
+
+	return repoConf
+}
+
+// rateLimits reads limits from conf, buckets are kept in redis
+// when replicas must share them.
+func rateLimits() (ratelimit.Store, controller.RateLimits, error) {
+	limits := controller.RateLimits{ByUser: conf.RateByUser}
+
+	for _, v := range []struct {
+		flag  string
+		value string
+		dst   *ratelimit.Limit
+	}{
+		{flag: "rate-create", value: conf.RateCreate, dst: &limits.Create},
+		{flag: "rate-batch", value: conf.RateBatch, dst: &limits.BatchItem},
+		{flag: "rate-redirect", value: conf.RateRedirect, dst: &limits.Redirect},
+	} {
+		limit, err := ratelimit.ParseLimit(v.value)
+
+		if err != nil {
+			return nil, limits, fmt.Errorf("%s: %w", v.flag, err)
+		}
+
+		*v.dst = limit
+	}
+
+	if conf.RateRedisAddr == "" {
+		return ratelimit.NewMemoryStore(), limits, nil
+	}
+
+	store, err := ratelimit.NewRedisStore(conf.RateRedisAddr)
+
+	if err != nil {
+		return nil, limits, err
+	}
+
+	return store, limits, nil
+}
+
+// requiredScopes reads scopes which anonymous clients can't use.
+func requiredScopes() ([]repository.Scope, error) {
+	if conf.RequireAPIKey == "" {
+		return nil, nil
+	}
+
+	scopes, err := repository.ParseScopes(conf.RequireAPIKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("require-api-key: %w", err)
+	}
+
+	return scopes, nil
+}
+
+func closeRepo(lg logger.MyLogger, repo *repository.StorageService) {
+	if err := repo.Close(); err != nil {
+		lg.Errorw(err.Error(), "event", "close repo")
 	}
 }
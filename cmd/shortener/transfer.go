@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/conf"
+	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/DmitryM7/short-url.git/internal/transfer"
+)
+
+const (
+	importBatchSize = 500
+	progressEvery   = time.Second
+)
+
+// progress prints counters to stderr not more often than progressEvery.
+type progress struct {
+	verb   string
+	total  int
+	counts map[repository.BatchStatus]int
+	last   time.Time
+}
+
+func newProgress(verb string) *progress {
+	return &progress{verb: verb, counts: map[repository.BatchStatus]int{}, last: time.Now()}
+}
+
+// add counts results, links which were refused are printed with the reason.
+func (p *progress) add(results ...repository.BatchResult) {
+	for _, v := range results {
+		p.counts[v.Status]++
+
+		if v.Status == repository.BatchInvalid {
+			fmt.Fprintf(os.Stderr, "skipped %s %s: %s\n", v.ShortURL, v.URL, v.Err)
+		}
+	}
+
+	p.total += len(results)
+}
+
+func (p *progress) report(final bool) {
+	if !final && time.Since(p.last) < progressEvery {
+		return
+	}
+
+	p.last = time.Now()
+
+	line := fmt.Sprintf("%s %d links", p.verb, p.total)
+
+	if len(p.counts) > 0 {
+		line += fmt.Sprintf(": %d created, %d updated, %d unchanged, %d skipped as url of another short url, %d invalid",
+			p.counts[repository.BatchCreated], p.counts[repository.BatchUpdated],
+			p.counts[repository.BatchUnchanged], p.counts[repository.BatchExisting],
+			p.counts[repository.BatchInvalid])
+	}
+
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// commandContext is cancelled by Ctrl-C, so a long export stops cleanly.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// runExport writes to a temp file next to FILE which replaces it only
+// when the export succeeds, so a failed one leaves the last export as
+// it was.
+func runExport(repoConf repository.StorageConfig, args []string) (err error) {
+	path := ""
+
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	format, err := transfer.FormatFor(conf.TransferFormat, path)
+
+	if err != nil {
+		return err
+	}
+
+	repo, err := commandStorage(repoConf)
+
+	if err != nil {
+		return err
+	}
+
+	defer repo.Close()
+
+	out := io.Writer(os.Stdout)
+
+	if path != "" && path != "-" {
+		file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+
+		if err != nil {
+			return err
+		}
+
+		// CreateTemp makes the file private, an export is as readable
+		// as os.Create would make it
+		if err := file.Chmod(0644); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+
+		defer func() {
+			errClose := file.Close()
+
+			if err == nil {
+				err = errClose
+			}
+
+			if err == nil {
+				err = os.Rename(file.Name(), path)
+			}
+
+			if err != nil {
+				os.Remove(file.Name())
+			}
+		}()
+
+		out = file
+	}
+
+	w, err := transfer.NewWriter(out, format)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	prg := newProgress("exported")
+
+	err = repo.Export(ctx, func(lnkRec repository.LinkRecord) error {
+		prg.total++
+		prg.report(false)
+
+		return w.Write(lnkRec)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	prg.report(true)
+
+	return w.Flush()
+}
+
+func runImport(repoConf repository.StorageConfig, args []string) error {
+	path := ""
+
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	format, err := transfer.FormatFor(conf.TransferFormat, path)
+
+	if err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+
+	if path != "" && path != "-" {
+		file, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		in = file
+	}
+
+	r, err := transfer.NewReader(in, format)
+
+	if err != nil {
+		return err
+	}
+
+	repo, err := commandStorage(repoConf)
+
+	if err != nil {
+		return err
+	}
+
+	defer repo.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	save := repo.Import
+	prg := newProgress("imported")
+
+	if conf.DryRun {
+		save = repo.NewPlanner().Plan
+		prg.verb = "dry run, would import"
+	}
+
+	batch := make([]repository.LinkRecord, 0, importBatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		results, err := save(ctx, batch)
+
+		if err != nil {
+			return err
+		}
+
+		prg.add(results...)
+		prg.report(false)
+		batch = batch[:0]
+
+		return nil
+	}
+
+	for {
+		lnkRec, err := r.Read()
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, lnkRec)
+
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	prg.report(true)
+
+	return nil
+}
@@ -1,15 +1,46 @@
 package conf
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
-	BndAdd   string
-	RetAdd   string
-	FilePath string
-	DSN      string
+	BndAdd          string
+	RetAdd          string
+	FilePath        string
+	DSN             string
+	RedisAddr       string
+	SQLitePath      string
+	SecretKey       string
+	ShortCodeGen    string
+	ReaperInterval  time.Duration
+	ShutdownTimeout time.Duration
+	StorageReadTO   time.Duration
+	StorageWriteTO  time.Duration
+	URLSortQuery    bool
+	URLStripTrack   bool
+	PolicyFile      string
+	PolicyReload    time.Duration
+	LogLevel        string
+	LogFormat       string
+	MetricsAddr     string
+	MetricsPublic   bool
+	RateCreate      string
+	RateBatch       string
+	RateRedirect    string
+	RateByUser      bool
+	RateRedisAddr   string
+	RequireAPIKey   string
+	CacheSize       int
+	CacheTTL        time.Duration
+	CacheMissTTL    time.Duration
+	TransferFormat  string
+	DryRun          bool
 )
 
 func ParseFlags() {
@@ -17,9 +48,38 @@ func ParseFlags() {
 	flag.StringVar(&RetAdd, "b", "http://localhost:8080", "host that add to short link")
 	flag.StringVar(&FilePath, "f", "./repo.json", "the path to the file where the matching table of short and full links will be stored")
 	flag.StringVar(&DSN, "d", "", "database dsn")
+	flag.StringVar(&RedisAddr, "r", "", "redis address as host:port or redis:// url")
+	flag.StringVar(&SQLitePath, "sqlite", "", "the path to the sqlite database file")
+	flag.StringVar(&SecretKey, "k", "", "secret key to sign auth cookie (random on every start if empty)")
+	flag.StringVar(&ShortCodeGen, "g", "crc32", "short code generator: crc32, random or counter")
+	flag.DurationVar(&ReaperInterval, "reaper-interval", time.Minute, "how often expired links are purged (0 disables purging)")
+	flag.DurationVar(&ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for active requests on shutdown")
+	flag.DurationVar(&StorageReadTO, "storage-read-timeout", 3*time.Second, "timeout of a single storage read (0 means no timeout)")
+	flag.DurationVar(&StorageWriteTO, "storage-write-timeout", 10*time.Second, "timeout of a single storage write (0 means no timeout)")
+	flag.BoolVar(&URLSortQuery, "url-sort-query", false, "sort query parameters of urls before shortening")
+	flag.BoolVar(&URLStripTrack, "url-strip-tracking", false, "remove utm_* and click id parameters from urls before shortening")
+	flag.IntVar(&CacheSize, "cache-size", 0, "how many links are cached in memory for redirects, 0 disables the cache; it is per process and changes made by other replicas reach it only after cache-ttl")
+	flag.DurationVar(&CacheTTL, "cache-ttl", 30*time.Second, "how long a cached link is trusted")
+	flag.DurationVar(&CacheMissTTL, "cache-miss-ttl", 5*time.Second, "how long a missing link is remembered (0 disables caching of misses)")
+	flag.StringVar(&PolicyFile, "policy-file", "", "the path to the file with domain allow and deny rules")
+	flag.StringVar(&MetricsAddr, "metrics-addr", "", "address to serve /metrics on, apart from the public router (empty does not start the listener)")
+	flag.BoolVar(&MetricsPublic, "metrics-public", false, "serve /metrics on the main address too")
+	flag.StringVar(&RateCreate, "rate-create", "", `creates per client, like "60/m" (no limit if empty)`)
+	flag.StringVar(&RateBatch, "rate-batch", "", `batch items per client, like "1000/h" (no limit if empty)`)
+	flag.StringVar(&RateRedirect, "rate-redirect", "", `redirects per client, like "600/m" (no limit if empty)`)
+	flag.BoolVar(&RateByUser, "rate-by-user", false, "count rate limits per user of an API key instead of ip")
+	flag.StringVar(&RateRedisAddr, "rate-redis", "", "redis address to share rate limits between replicas (in-process if empty)")
+	flag.StringVar(&RequireAPIKey, "require-api-key", "", `scopes only API keys may use, like "create,delete" (none if empty)`)
+	flag.StringVar(&TransferFormat, "format", "", "export and import format: jsonl or csv (by file extension if empty)")
+	flag.BoolVar(&DryRun, "dry-run", false, "import only reports what it would change")
+	flag.StringVar(&LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&LogFormat, "log-format", "json", "log format: json or console")
+	flag.DurationVar(&PolicyReload, "policy-reload", 5*time.Second, "how often the policy file is checked for changes (0 disables reloading)")
 }
 
-func ParseEnv() {
+// ParseEnv overrides flags with environment variables. A variable which
+// can't be parsed is an error, it is not silently ignored.
+func ParseEnv() error {
 	if env := os.Getenv("SERVER_ADDRESS"); env != "" {
 		BndAdd = env
 	}
@@ -35,4 +95,126 @@ func ParseEnv() {
 	if env := os.Getenv("DATABASE_DSN"); env != "" {
 		DSN = env
 	}
+
+	if env := os.Getenv("REDIS_ADDR"); env != "" {
+		RedisAddr = env
+	}
+
+	if env := os.Getenv("SQLITE_PATH"); env != "" {
+		SQLitePath = env
+	}
+
+	if env := os.Getenv("SECRET_KEY"); env != "" {
+		SecretKey = env
+	}
+
+	if env := os.Getenv("SHORT_CODE_GENERATOR"); env != "" {
+		ShortCodeGen = env
+	}
+
+	if env := os.Getenv("POLICY_FILE"); env != "" {
+		PolicyFile = env
+	}
+
+	// an empty METRICS_ADDR turns off the listener a flag asked for
+	if env, ok := os.LookupEnv("METRICS_ADDR"); ok {
+		MetricsAddr = env
+	}
+
+	if env := os.Getenv("RATE_CREATE"); env != "" {
+		RateCreate = env
+	}
+
+	if env := os.Getenv("RATE_BATCH"); env != "" {
+		RateBatch = env
+	}
+
+	if env := os.Getenv("RATE_REDIRECT"); env != "" {
+		RateRedirect = env
+	}
+
+	if env := os.Getenv("RATE_REDIS_ADDR"); env != "" {
+		RateRedisAddr = env
+	}
+
+	if env := os.Getenv("REQUIRE_API_KEY"); env != "" {
+		RequireAPIKey = env
+	}
+
+	if env := os.Getenv("LOG_LEVEL"); env != "" {
+		LogLevel = env
+	}
+
+	if env := os.Getenv("LOG_FORMAT"); env != "" {
+		LogFormat = env
+	}
+
+	return errors.Join(
+		durationEnv("REAPER_INTERVAL", &ReaperInterval),
+		durationEnv("SHUTDOWN_TIMEOUT", &ShutdownTimeout),
+		durationEnv("STORAGE_READ_TIMEOUT", &StorageReadTO),
+		durationEnv("STORAGE_WRITE_TIMEOUT", &StorageWriteTO),
+		durationEnv("POLICY_RELOAD_INTERVAL", &PolicyReload),
+		durationEnv("CACHE_TTL", &CacheTTL),
+		durationEnv("CACHE_MISS_TTL", &CacheMissTTL),
+		intEnv("CACHE_SIZE", &CacheSize),
+		boolEnv("RATE_BY_USER", &RateByUser),
+		boolEnv("URL_SORT_QUERY", &URLSortQuery),
+		boolEnv("URL_STRIP_TRACKING", &URLStripTrack),
+		boolEnv("METRICS_PUBLIC", &MetricsPublic),
+	)
+}
+
+func durationEnv(name string, dst *time.Duration) error {
+	env := os.Getenv(name)
+
+	if env == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(env)
+
+	if err != nil {
+		return fmt.Errorf("BAD %s: %w", name, err)
+	}
+
+	*dst = d
+
+	return nil
+}
+
+func boolEnv(name string, dst *bool) error {
+	env := os.Getenv(name)
+
+	if env == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(env)
+
+	if err != nil {
+		return fmt.Errorf("BAD %s: %w", name, err)
+	}
+
+	*dst = b
+
+	return nil
+}
+
+func intEnv(name string, dst *int) error {
+	env := os.Getenv(name)
+
+	if env == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(env)
+
+	if err != nil {
+		return fmt.Errorf("BAD %s: %w", name, err)
+	}
+
+	*dst = n
+
+	return nil
 }
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/DmitryM7/short-url.git/internal/repository"
+)
+
+// Codes of APIError, clients should branch on them and not on messages.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeEmptyBody        = "empty_body"
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidURL       = "invalid_url"
+	CodeInvalidAlias     = "invalid_alias"
+	CodeInvalidExpires   = "invalid_expiration"
+	CodeAliasTaken       = "alias_taken"
+	CodeBlocked          = "blocked"
+	CodeNotFound         = "not_found"
+	CodeGone             = "gone"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeStorage          = "storage_error"
+	CodeTooManyLinks     = "too_many_links"
+	CodeBusy             = "busy"
+	CodeInternal         = "internal_error"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// APIError is the body of every error answer of /api/* routes,
+// other routes get Message as plain text.
+type APIError struct {
+	Status    int            `json:"-"`
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	RequestID string         `json:"request_id,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func badRequest(code, message string) *APIError {
+	return newAPIError(http.StatusBadRequest, code, message)
+}
+
+func internalError(message string) *APIError {
+	return newAPIError(http.StatusInternalServerError, CodeInternal, message)
+}
+
+// WithDetails adds a detail to the error and returns it for chaining.
+func (e *APIError) WithDetails(key string, value any) *APIError {
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+
+	e.Details[key] = value
+
+	return e
+}
+
+// repoError maps errors of the repository to answers. A storage fault
+// is 500 and its text is only logged, the client learns nothing about
+// the storage from it.
+func repoError(err error) *APIError {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return newAPIError(http.StatusNotFound, CodeNotFound, "LINK NOT FOUND")
+	case errors.Is(err, repository.ErrDeleted):
+		return newAPIError(http.StatusGone, CodeGone, repository.ErrDeleted.Error())
+	case errors.Is(err, repository.ErrExpired):
+		return newAPIError(http.StatusGone, CodeGone, repository.ErrExpired.Error())
+	case errors.Is(err, repository.ErrInvalidAlias):
+		return badRequest(CodeInvalidAlias, err.Error())
+	case errors.Is(err, repository.ErrAliasTaken):
+		return newAPIError(http.StatusConflict, CodeAliasTaken, err.Error())
+	case errors.Is(err, repository.ErrTooManyLinks):
+		return newAPIError(http.StatusRequestEntityTooLarge, CodeTooManyLinks, err.Error()).
+			WithDetails("limit", repository.MaxDeleteURLs)
+	case errors.Is(err, repository.ErrQueueFull):
+		return newAPIError(http.StatusServiceUnavailable, CodeBusy, err.Error())
+	case errors.Is(err, repository.ErrBlocked):
+		return newAPIError(http.StatusForbidden, CodeBlocked, repository.ErrBlocked.Error()).
+			WithDetails("reason", err.Error())
+	}
+
+	return newAPIError(http.StatusInternalServerError, CodeStorage, "STORAGE ERROR")
+}
+
+// actionError answers with apiErr, cause is logged along with it.
+func (s *MyServer) actionError(w http.ResponseWriter, r *http.Request, apiErr *APIError, cause error) {
+	logArgs := []any{"status", apiErr.Status, "code", apiErr.Code, "uri", r.RequestURI}
+
+	if cause != nil {
+		logArgs = append(logArgs, "cause", cause.Error())
+	}
+
+	if apiErr.Status >= http.StatusInternalServerError {
+		s.log(r).Errorw(apiErr.Message, logArgs...)
+	} else {
+		s.log(r).Infow(apiErr.Message, logArgs...)
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(apiErr.Status)
+
+		if _, err := w.Write([]byte(apiErr.Message)); err != nil {
+			s.log(r).Error("CAN'T WRITE ANSWER")
+		}
+
+		return
+	}
+
+	apiErr.RequestID = getRequestID(r)
+
+	res, err := json.Marshal(apiErr)
+
+	if err != nil {
+		s.log(r).Errorln("CAN'T MARSHAL ERROR:" + err.Error())
+		w.WriteHeader(apiErr.Status)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(apiErr.Status)
+
+	if _, err := w.Write(res); err != nil {
+		s.log(r).Error("CAN'T WRITE ANSWER")
+	}
+}
+
+// requireJSON answers 415 to a request with a body
+// which is declared as anything but JSON.
+func (s *MyServer) requireJSON(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			mediaType, _, err := mime.ParseMediaType(ct)
+
+			if err != nil || mediaType != "application/json" {
+				s.actionError(w, r, newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMedia,
+					"CONTENT TYPE MUST BE application/json").WithDetails("content_type", ct), err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/DmitryM7/short-url.git/internal/repository"
+)
+
+const (
+	CodeUnauthorized      = "unauthorized"
+	CodeInsufficientScope = "insufficient_scope"
+
+	apiKeyHeader = "X-API-Key"
+)
+
+// WithAPIKeys makes scopes usable only with an API key,
+// anonymous clients keep the rest.
+func WithAPIKeys(required ...repository.Scope) Option {
+	return func(s *MyServer) {
+		s.keyRequired = required
+	}
+}
+
+// apiKeyAuth reads a key from "Authorization: Bearer" or X-API-Key.
+// A client with a valid key acts as the user of the key, a request
+// without a key goes on with its cookie.
+func (s *MyServer) apiKeyAuth(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		key := readAPIKey(r)
+
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiKey, err := s.Repo.Authenticate(r.Context(), key)
+
+		if errors.Is(err, repository.ErrAPIKeyInvalid) {
+			s.unauthorized(w, r, err.Error())
+			return
+		}
+
+		if err != nil {
+			s.actionError(w, r, repoError(err), err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyKey, apiKey)
+		ctx = context.WithValue(ctx, userIDKey, apiKey.UserID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(f)
+}
+
+// requireScope lets through keys with scope and anonymous clients
+// unless the scope needs a key. Admin always needs one.
+func (s *MyServer) requireScope(scope repository.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			apiKey, ok := getAPIKey(r)
+
+			switch {
+			case !ok && s.keyIsRequired(scope):
+				s.unauthorized(w, r, "API KEY IS REQUIRED")
+			case ok && !apiKey.Allows(scope):
+				s.actionError(w, r, newAPIError(http.StatusForbidden, CodeInsufficientScope,
+					"API KEY HAS NO SCOPE "+string(scope)).WithDetails("scope", scope), nil)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+func (s *MyServer) keyIsRequired(scope repository.Scope) bool {
+	if scope == repository.ScopeAdmin {
+		return true
+	}
+
+	for _, v := range s.keyRequired {
+		if v == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *MyServer) unauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="shortener"`)
+	s.actionError(w, r, newAPIError(http.StatusUnauthorized, CodeUnauthorized, message), nil)
+}
+
+func readAPIKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return strings.TrimSpace(key)
+	}
+
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+func getAPIKey(r *http.Request) (repository.APIKey, bool) {
+	apiKey, ok := r.Context().Value(apiKeyKey).(repository.APIKey)
+	return apiKey, ok
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// blockedPage is shown instead of a redirect when the domain policy
+// started blocking the url after it was shortened.
+var blockedPage = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Link is blocked</title>
+</head>
+<body>
+<h1>This link is blocked</h1>
+<p>The short link leads to a domain that is blocked by the service policy:</p>
+<p><code>{{.URL}}</code></p>
+<p>We do not redirect to it, because the site may be unsafe.</p>
+</body>
+</html>
+`))
+
+func (s *MyServer) actionBlocked(w http.ResponseWriter, r *http.Request, url string, reason error) {
+	s.log(r).Infoln("REDIRECT BLOCKED", "url", url, "reason", reason.Error())
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	if err := blockedPage.Execute(w, struct{ URL string }{url}); err != nil {
+		s.log(r).Errorln("CANT RENDER BLOCKED PAGE:" + err.Error())
+	}
+}
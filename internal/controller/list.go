@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/conf"
+	"github.com/DmitryM7/short-url.git/internal/repository"
+)
+
+const (
+	CodeInvalidCursor = "invalid_cursor"
+	CodeInvalidLimit  = "invalid_limit"
+
+	defListLimit = 50
+	maxListLimit = 1000
+)
+
+type (
+	ResponseListUnit struct {
+		ShortURL    string     `json:"short_url"`
+		OriginalURL string     `json:"original_url"`
+		UserID      int        `json:"user_id"`
+		ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	}
+
+	// ResponseList is a page of links, NextCursor is empty on the last one.
+	ResponseList struct {
+		URLs       []ResponseListUnit `json:"urls"`
+		NextCursor string             `json:"next_cursor,omitempty"`
+	}
+)
+
+// actionListURLs pages through all links:
+// GET /api/urls?cursor=&limit=&q=&match=prefix|contains.
+// The cursor is the short url of the last link of the previous page.
+func (s *MyServer) actionListURLs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := repository.ListQuery{Limit: defListLimit, Search: query.Get("q")}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+
+		if err != nil || limit < 1 || limit > maxListLimit {
+			s.actionError(w, r, badRequest(CodeInvalidLimit, "LIMIT MUST BE FROM 1 TO "+strconv.Itoa(maxListLimit)), nil)
+			return
+		}
+
+		q.Limit = limit
+	}
+
+	switch query.Get("match") {
+	case "", "contains":
+	case "prefix":
+		q.Prefix = true
+	default:
+		s.actionError(w, r, badRequest(CodeBadRequest, "MATCH MUST BE prefix OR contains"), nil)
+		return
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		after, err := base64.RawURLEncoding.DecodeString(v)
+
+		if err != nil || len(after) == 0 {
+			s.actionError(w, r, badRequest(CodeInvalidCursor, "CURSOR IS BROKEN"), err)
+			return
+		}
+
+		q.After = string(after)
+	}
+
+	// one more link tells whether there is a next page
+	q.Limit++
+
+	lnkRecs, err := s.Repo.List(r.Context(), q)
+
+	if err != nil {
+		s.actionError(w, r, repoError(err), err)
+		return
+	}
+
+	output := ResponseList{URLs: []ResponseListUnit{}}
+
+	if len(lnkRecs) == q.Limit {
+		lnkRecs = lnkRecs[:q.Limit-1]
+		output.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(lnkRecs[len(lnkRecs)-1].ShortURL))
+	}
+
+	for _, v := range lnkRecs {
+		unit := ResponseListUnit{
+			ShortURL:    conf.RetAdd + "/" + v.ShortURL,
+			OriginalURL: v.URL,
+			UserID:      v.UserID,
+		}
+
+		if !v.ExpiresAt.IsZero() {
+			expiresAt := v.ExpiresAt.UTC()
+			unit.ExpiresAt = &expiresAt
+		}
+
+		output.URLs = append(output.URLs, unit)
+	}
+
+	res, err := json.Marshal(output)
+
+	if err != nil {
+		s.actionError(w, r, internalError("CAN'T MARSHAL JSON RESULT"), err)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	_, errRes := w.Write(res)
+
+	if errRes != nil {
+		s.log(r).Errorln("CAN'T WRITE RESULT BODY.")
+	}
+}
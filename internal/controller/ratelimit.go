@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/ratelimit"
+)
+
+const CodeRateLimited = "rate_limited"
+
+// RateLimits are budgets of one client, a zero Limit means no limit.
+type RateLimits struct {
+	Create    ratelimit.Limit
+	BatchItem ratelimit.Limit
+	Redirect  ratelimit.Limit
+	// ByUser counts the user of an API key as one client wherever
+	// they come from, others are counted by ip. A cookie doesn't make
+	// a client, anyone gets a fresh one for free.
+	ByUser bool
+}
+
+// WithRateLimits makes the server keep clients within limits,
+// buckets live in store.
+func WithRateLimits(store ratelimit.Store, limits RateLimits) Option {
+	return func(s *MyServer) {
+		s.limiter = store
+		s.limits = limits
+	}
+}
+
+// rateLimit takes one token of the bucket name for every request.
+func (s *MyServer) rateLimit(name string, limit ratelimit.Limit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			if s.allow(w, r, name, limit, 1) {
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(f)
+	}
+}
+
+// allow takes n tokens from the bucket of the client, sets X-RateLimit-*
+// headers and answers 429 if there are not enough tokens. It reports
+// whether the request may go on. A broken store lets requests through,
+// the service is more useful without limits than without links.
+func (s *MyServer) allow(w http.ResponseWriter, r *http.Request, name string, limit ratelimit.Limit, n int) bool {
+	if s.limiter == nil || !limit.Enabled() {
+		return true
+	}
+
+	if n > limit.Burst {
+		s.actionError(w, r, newAPIError(http.StatusRequestEntityTooLarge, CodeRateLimited,
+			"REQUEST IS LARGER THAN RATE LIMIT").
+			WithDetails("limit", limit.Burst).WithDetails("requested", n), nil)
+		return false
+	}
+
+	res, err := s.limiter.Take(r.Context(), name+":"+s.clientKey(r), limit, n)
+
+	if err != nil {
+		s.log(r).Errorln("CAN'T CHECK RATE LIMIT:" + err.Error())
+		return true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", ceilSeconds(res.Reset))
+
+	if res.Allowed {
+		return true
+	}
+
+	w.Header().Set("Retry-After", ceilSeconds(res.RetryAfter))
+	s.actionError(w, r, newAPIError(http.StatusTooManyRequests, CodeRateLimited, "TOO MANY REQUESTS").
+		WithDetails("bucket", name), nil)
+
+	return false
+}
+
+// clientKey names the bucket owner.
+func (s *MyServer) clientKey(r *http.Request) string {
+	if apiKey, ok := getAPIKey(r); ok && s.limits.ByUser {
+		return "user:" + strconv.Itoa(apiKey.UserID)
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return "ip:" + ip
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
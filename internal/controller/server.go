@@ -1,28 +1,40 @@
 package controller
 
 import (
-	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/DmitryM7/short-url.git/internal/conf"
 	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/metrics"
 	"github.com/DmitryM7/short-url.git/internal/models"
+	"github.com/DmitryM7/short-url.git/internal/ratelimit"
 	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/DmitryM7/short-url.git/internal/urlnorm"
 	"github.com/go-chi/chi"
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type (
 	Request struct {
-		URL string `json:"url"`
+		URL        string     `json:"url"`
+		Alias      string     `json:"alias,omitempty"`
+		TTLSeconds int64      `json:"ttl_seconds,omitempty"`
+		ExpiresAt  *time.Time `json:"expires_at,omitempty"`
 	}
 
 	Response struct {
@@ -30,30 +42,68 @@ type (
 	}
 
 	RequestShortenBatchUnit struct {
-		CorrelationID string `json:"correlation_id"`
-		OriginalURL   string `json:"original_url"`
+		CorrelationID string     `json:"correlation_id"`
+		OriginalURL   string     `json:"original_url"`
+		Alias         string     `json:"alias,omitempty"`
+		TTLSeconds    int64      `json:"ttl_seconds,omitempty"`
+		ExpiresAt     *time.Time `json:"expires_at,omitempty"`
 	}
 
 	ResponseShortenBatchUnit struct {
-		CorrelationID string `json:"correlation_id"`
-		ShortURL      string `json:"short_url"`
+		CorrelationID string                 `json:"correlation_id"`
+		ShortURL      string                 `json:"short_url,omitempty"`
+		Status        repository.BatchStatus `json:"status"`
+		Error         string                 `json:"error,omitempty"`
 	}
 
-	MyServer struct {
-		Logger logger.MyLogger
-		Repo   repository.StorageService
+	// ResponseStats.UniqueVisitors is an estimate on some storages,
+	// see repository.LinkStats.
+	ResponseStats struct {
+		ShortURL       string         `json:"short_url"`
+		TotalClicks    int            `json:"total_clicks"`
+		UniqueVisitors int            `json:"unique_visitors"`
+		ByDay          map[string]int `json:"by_day"`
+		ByHour         map[string]int `json:"by_hour"`
+	}
+
+	ResponseUserURLUnit struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
 	}
+
+	MyServer struct {
+		Logger  logger.MyLogger
+		Repo    *repository.StorageService
+		authKey []byte
+		ipSalt  []byte
+		urlOpts urlnorm.Options
+		metrics *metrics.Metrics
+		limiter ratelimit.Store
+		limits  RateLimits
+		// keyRequired are scopes anonymous clients can't use.
+		keyRequired []repository.Scope
+	}
+
+	// Option sets up optional parts of the server.
+	Option func(*MyServer)
+
+	ctxKey int
 )
 
-func (s *MyServer) actionError(w http.ResponseWriter, e string) {
-	s.Logger.Infoln(e)
-	w.WriteHeader(http.StatusBadRequest)
-	_, err := w.Write([]byte(e))
+const (
+	userIDKey ctxKey = iota
+	requestIDKey
+	apiKeyKey
+)
 
-	if err != nil {
-		s.Logger.Error("CAN'T WRITE ANSWER")
-	}
-}
+const (
+	authCookieName = "auth"
+	authKeyLength  = 32
+	maxRequestID   = 128
+	// maxDeleteBody fits repository.MaxDeleteURLs short urls of
+	// the longest alias
+	maxDeleteBody = 128 << 10
+)
 
 func (s *MyServer) actionCreateURL(w http.ResponseWriter, r *http.Request) {
 	var answerStatus = http.StatusCreated
@@ -61,72 +111,134 @@ func (s *MyServer) actionCreateURL(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	if err != nil {
-		s.actionError(w, "Error read query request body")
+		s.actionError(w, r, badRequest(CodeBadRequest, "CAN'T READ BODY FROM REQUEST"), err)
+		return
+	}
+
+	if len(body) == 0 {
+		s.actionError(w, r, badRequest(CodeEmptyBody, "EMPTY BODY"), nil)
 		return
 	}
 
-	url := string(body)
+	url, err := urlnorm.Normalize(string(body), s.urlOpts)
 
-	if url == "" {
-		s.actionError(w, "Body was send, but empty")
+	if err != nil {
+		s.actionError(w, r, badRequest(CodeInvalidURL, err.Error()).WithDetails("url", string(body)), nil)
 		return
 	}
 
-	newURL, err := s.Repo.Create(url)
+	newURL, err := s.Repo.Create(r.Context(), repository.LinkRecord{URL: url, UserID: getUserID(r)})
 
-	var perr *pgconn.PgError
+	var conflict *repository.ErrConflict
 
-	if errors.As(err, &perr) && perr.Code == pgerrcode.UniqueViolation {
-		/***********************************************************************
-		 * Бесмысленная история для стратегии №2 задания итерации 13           *
-		 * (мы можем сделать вставку т. и т. к., мы уже знаем сокращенный URL) *
-		 * но чтобы выполнить букву задания                                    *
-		 * делаем повторное получение shorturl из БД.                          *
-		 ***********************************************************************/
-		newURL, err = s.Repo.GetByURL(url)
-		if err != nil {
-			s.actionError(w, "CAN'T RECEIVE SHORTURL FROM DB")
-			return
-		}
+	if errors.As(err, &conflict) {
+		newURL, err = conflict.ShortURL, nil
 		answerStatus = http.StatusConflict
 	}
 
+	if err != nil {
+		s.actionError(w, r, repoError(err), err)
+		return
+	}
+
 	w.Header().Set("Content-type", "text/plain")
 	w.WriteHeader(answerStatus)
 	_, errWrite := w.Write([]byte(conf.RetAdd + "/" + newURL))
 
 	if errWrite != nil {
-		s.Logger.Errorln("CANT WRITE DATA TO RESPONSE")
-	}
-
-	if err != nil {
-		s.Logger.Errorln("CANT SAVE REPO:" + fmt.Sprintf("%s", err))
+		s.log(r).Errorln("CANT WRITE DATA TO RESPONSE")
 	}
 }
 
 func (s *MyServer) actionRedirect(w http.ResponseWriter, r *http.Request) {
-	s.Logger.Debugln("Start Redirect")
+	s.log(r).Debugln("Start Redirect")
 
 	id := strings.TrimPrefix(r.URL.Path, "/")
 
 	if id == "" {
-		s.actionError(w, "No required param 'ID' or ID is empty")
+		s.actionError(w, r, badRequest(CodeBadRequest, "NO REQUIRED PARAM 'ID' OR ID IS EMPTY"), nil)
 		return
 	}
 
-	newURL, err := s.Repo.Get(id)
+	newURL, err := s.Repo.Get(r.Context(), id)
 
 	if err != nil {
-		s.actionError(w, "CAN'T GET SHORT LINK FROM REPO")
+		s.actionError(w, r, repoError(err), err)
+		return
+	}
+
+	if err := s.Repo.CheckURL(newURL); err != nil {
+		s.actionBlocked(w, r, newURL, err)
 		return
 	}
 
+	s.Repo.RecordClick(repository.Click{
+		ShortURL:  id,
+		Time:      time.Now(),
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		IPHash:    s.hashIP(r.RemoteAddr),
+	})
+
 	http.Redirect(w, r, newURL, http.StatusTemporaryRedirect)
 }
 
+// hashIP keeps visitors distinguishable for unique counting
+// without storing their addresses. The salt is kept by the storage,
+// unlike the random auth key, so hashes don't change on restart.
+func (s *MyServer) hashIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	mac := hmac.New(sha256.New, s.ipSalt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *MyServer) actionStats(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	if id == "" {
+		s.actionError(w, r, badRequest(CodeBadRequest, "NO REQUIRED PARAM 'ID' OR ID IS EMPTY"), nil)
+		return
+	}
+
+	stats, err := s.Repo.GetStats(r.Context(), id)
+
+	if err != nil {
+		s.actionError(w, r, repoError(err), err)
+		return
+	}
+
+	res, err := json.Marshal(ResponseStats{
+		ShortURL:       conf.RetAdd + "/" + id,
+		TotalClicks:    stats.TotalClicks,
+		UniqueVisitors: stats.UniqueVisitors,
+		ByDay:          stats.ByDay,
+		ByHour:         stats.ByHour,
+	})
+
+	if err != nil {
+		s.actionError(w, r, internalError("CAN'T MARSHAL JSON RESULT"), err)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	_, errRes := w.Write(res)
+
+	if errRes != nil {
+		s.log(r).Errorln("CAN'T WRITE RESULT BODY.")
+	}
+}
+
 func (s *MyServer) actionPing(w http.ResponseWriter, r *http.Request) {
-	if !s.Repo.Ping() {
-		s.Logger.Infoln("NO DATABASE PING")
+	if !s.Repo.Ping(r.Context()) {
+		s.log(r).Infoln("NO DATABASE PING")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -138,16 +250,16 @@ func (s *MyServer) actionTest(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/")
 
 	if id == "" {
-		s.actionError(w, "No required param 'ID' or ID is empty")
+		s.actionError(w, r, badRequest(CodeBadRequest, "NO REQUIRED PARAM 'ID' OR ID IS EMPTY"), nil)
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
-	s.Logger.Debugln(string(body))
+	s.log(r).Debugln(string(body))
 
 	if err != nil {
-		s.actionError(w, "CAN'T READ BODY")
+		s.actionError(w, r, badRequest(CodeBadRequest, "CAN'T READ BODY FROM REQUEST"), err)
 		return
 	}
 
@@ -156,24 +268,23 @@ func (s *MyServer) actionTest(w http.ResponseWriter, r *http.Request) {
 	_, errWrite := w.Write(body)
 
 	if errWrite != nil {
-		s.actionError(w, "CAN'T WRITE BODY")
-		return
+		s.log(r).Errorln("CAN'T WRITE BODY")
 	}
 }
 func (s *MyServer) actionShorten(w http.ResponseWriter, r *http.Request) {
 	var answerStatus = http.StatusCreated
-	s.Logger.Debugln("Start Shorten")
+	s.log(r).Debugln("Start Shorten")
 
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 
 	if err != nil {
-		s.actionError(w, "CAN'T READ BODY FROM REQUEST")
+		s.actionError(w, r, badRequest(CodeBadRequest, "CAN'T READ BODY FROM REQUEST"), err)
 		return
 	}
 
 	if string(body) == "" {
-		s.actionError(w, "EMPTY BODY")
+		s.actionError(w, r, badRequest(CodeEmptyBody, "EMPTY BODY"), nil)
 		return
 	}
 
@@ -183,135 +294,298 @@ func (s *MyServer) actionShorten(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &request)
 
 	if err != nil {
-		s.actionError(w, "CAN'T UNMARSHAL JSON BODY.")
+		s.actionError(w, r, badRequest(CodeInvalidJSON, "CAN'T UNMARSHAL JSON BODY"), err)
 		return
 	}
 
-	newURL, err := s.Repo.Create(request.URL)
+	url, err := urlnorm.Normalize(request.URL, s.urlOpts)
 
-	var perr *pgconn.PgError
+	if err != nil {
+		s.actionError(w, r, badRequest(CodeInvalidURL, err.Error()).WithDetails("url", request.URL), nil)
+		return
+	}
 
-	if errors.As(err, &perr) && perr.Code == pgerrcode.UniqueViolation {
-		/***********************************************************************
-		 * Бесмысленная история для стратегии №2 задания итерации 13           *
-		 * (мы можем сделать вставку т. и т. к., мы уже знаем сокращенный URL) *
-		 * но чтобы выполнить букву задания                                    *
-		 * делаем повторное получение shorturl из БД.                          *
-		 ***********************************************************************/
-		newURL, err = s.Repo.GetByURL(request.URL)
-		if err != nil {
-			s.actionError(w, "CAN'T RECEIVE SHORTURL FROM DB")
-			return
-		}
+	expires, err := expiresAt(request.TTLSeconds, request.ExpiresAt)
+
+	if err != nil {
+		s.actionError(w, r, badRequest(CodeInvalidExpires, err.Error()), nil)
+		return
+	}
+
+	newURL, err := s.Repo.Create(r.Context(), repository.LinkRecord{
+		URL:       url,
+		ShortURL:  request.Alias,
+		UserID:    getUserID(r),
+		ExpiresAt: expires,
+	})
+
+	var conflict *repository.ErrConflict
+
+	if errors.As(err, &conflict) {
+		newURL, err = conflict.ShortURL, nil
 		answerStatus = http.StatusConflict
 	}
 
 	if err != nil {
-		s.Logger.Errorln("CANT SAVE REPO TO FILE")
+		apiErr := repoError(err)
+
+		if request.Alias != "" && apiErr.Code == CodeAliasTaken {
+			apiErr.WithDetails("alias", request.Alias)
+		}
+
+		s.actionError(w, r, apiErr, err)
+		return
 	}
 
 	response.Result = conf.RetAdd + "/" + newURL
 
-	w.Header().Set("Content-type", "application/json")
-	w.WriteHeader(answerStatus)
-
 	res, err := json.Marshal(response)
 	if err != nil {
-		s.actionError(w, "CAN'T UNMARSHAL JSON RESULT.")
+		s.actionError(w, r, internalError("CAN'T MARSHAL JSON RESULT"), err)
 		return
 	}
 
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(answerStatus)
+
 	_, errRes := w.Write(res)
 
 	if errRes != nil {
-		s.actionError(w, "CAN'T WRITE RESULT BODY.")
-		return
+		s.log(r).Errorln("CAN'T WRITE RESULT BODY.")
 	}
 }
 
+// expiresAt turns the lifetime asked by client into the moment
+// the link stops working. Zero time means the link never expires.
+func expiresAt(ttlSeconds int64, at *time.Time) (time.Time, error) {
+	switch {
+	case ttlSeconds != 0 && at != nil:
+		return time.Time{}, fmt.Errorf("USE EITHER TTL_SECONDS OR EXPIRES_AT")
+	case ttlSeconds < 0:
+		return time.Time{}, fmt.Errorf("TTL_SECONDS MUST BE POSITIVE")
+	case ttlSeconds > 0:
+		return time.Now().Add(time.Duration(ttlSeconds) * time.Second), nil
+	case at != nil && !at.After(time.Now()):
+		return time.Time{}, fmt.Errorf("EXPIRES_AT MUST BE IN THE FUTURE")
+	case at != nil:
+		return *at, nil
+	}
+	return time.Time{}, nil
+}
+
 func (s *MyServer) actionBatch(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 
 	if err != nil {
-		s.actionError(w, "CAN'T READ BODY FROM REQUEST")
+		s.actionError(w, r, badRequest(CodeBadRequest, "CAN'T READ BODY FROM REQUEST"), err)
 		return
 	}
 
 	defer r.Body.Close()
 
 	if string(body) == "" {
-		s.actionError(w, "EMPTY BODY")
+		s.actionError(w, r, badRequest(CodeEmptyBody, "EMPTY BODY"), nil)
 		return
 	}
 
-	s.Logger.Debugln(string(body))
+	s.log(r).Debugln(string(body))
 
 	input := []RequestShortenBatchUnit{}
-	output := []ResponseShortenBatchUnit{}
 
 	err = json.Unmarshal(body, &input)
 
 	if err != nil {
-		s.actionError(w, "CAN'T UNMARSHAL JSON BODY.")
+		s.actionError(w, r, badRequest(CodeInvalidJSON, "CAN'T UNMARSHAL JSON BODY"), err)
+		return
+	}
+
+	if !s.allow(w, r, "batch", s.limits.BatchItem, len(input)) {
 		return
 	}
 
+	// a link with bad url or expiration is not sent to the repo,
+	// sentAt maps results of the repo back to the input
+	output := make([]ResponseShortenBatchUnit, len(input))
 	lnkRecs := []repository.LinkRecord{}
+	sentAt := []int{}
+	userID := getUserID(r)
 
-	for _, v := range input {
-		lnkRecs = append(lnkRecs, repository.LinkRecord{URL: v.OriginalURL, CorrelationID: v.CorrelationID})
+	for k, v := range input {
+		url, err := urlnorm.Normalize(v.OriginalURL, s.urlOpts)
+
+		if err == nil {
+			v.OriginalURL = url
+		}
+
+		expires, errExp := expiresAt(v.TTLSeconds, v.ExpiresAt)
+
+		if err == nil {
+			err = errExp
+		}
+
+		if err != nil {
+			output[k] = ResponseShortenBatchUnit{
+				CorrelationID: v.CorrelationID,
+				Status:        repository.BatchInvalid,
+				Error:         err.Error(),
+			}
+			continue
+		}
+
+		lnkRecs = append(lnkRecs, repository.LinkRecord{
+			URL:           v.OriginalURL,
+			ShortURL:      v.Alias,
+			CorrelationID: v.CorrelationID,
+			UserID:        userID,
+			ExpiresAt:     expires,
+		})
+		sentAt = append(sentAt, k)
 	}
 
-	lnkResRecs, err := s.Repo.BatchCreate(lnkRecs)
+	results, err := s.Repo.BatchCreate(r.Context(), lnkRecs)
 
 	if err != nil {
-		s.actionError(w, "CANT SAVE DATA IN REPO")
+		s.actionError(w, r, repoError(err), err)
 		return
 	}
 
-	for _, v := range lnkResRecs {
-		output = append(output, ResponseShortenBatchUnit{
+	for k, v := range results {
+		unit := ResponseShortenBatchUnit{
 			CorrelationID: v.CorrelationID,
-			ShortURL:      conf.RetAdd + "/" + v.ShortURL,
-		})
+			Status:        v.Status,
+		}
+
+		if v.Err != nil {
+			unit.Error = v.Err.Error()
+		} else {
+			unit.ShortURL = conf.RetAdd + "/" + v.ShortURL
+		}
+
+		output[sentAt[k]] = unit
+	}
+
+	res, err := json.Marshal(output)
+	if err != nil {
+		s.actionError(w, r, internalError("CAN'T MARSHAL JSON RESULT"), err)
+		return
 	}
 
 	w.Header().Set("Content-type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
+	_, errRes := w.Write(res)
+
+	if errRes != nil {
+		s.log(r).Errorln("CAN'T WRITE RESULT BODY.")
+	}
+}
+
+func (s *MyServer) actionUserURLs(w http.ResponseWriter, r *http.Request) {
+	lnkRecs, err := s.Repo.GetByUser(r.Context(), getUserID(r))
+
+	if err != nil {
+		s.actionError(w, r, repoError(err), err)
+		return
+	}
+
+	if len(lnkRecs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	output := []ResponseUserURLUnit{}
+
+	for _, v := range lnkRecs {
+		output = append(output, ResponseUserURLUnit{
+			ShortURL:    conf.RetAdd + "/" + v.ShortURL,
+			OriginalURL: v.URL,
+		})
+	}
+
 	res, err := json.Marshal(output)
 	if err != nil {
-		s.actionError(w, "CAN'T UNMARSHAL JSON RESULT.")
+		s.actionError(w, r, internalError("CAN'T MARSHAL JSON RESULT"), err)
 		return
 	}
 
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
 	_, errRes := w.Write(res)
 
 	if errRes != nil {
-		s.actionError(w, "CAN'T WRITE RESULT BODY.")
+		s.log(r).Errorln("CAN'T WRITE RESULT BODY.")
+	}
+}
+
+func (s *MyServer) actionDeleteURLs(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDeleteBody))
+	defer r.Body.Close()
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		s.actionError(w, r, newAPIError(http.StatusRequestEntityTooLarge, CodeTooManyLinks, "REQUEST BODY IS TOO LARGE").
+			WithDetails("limit", maxDeleteBody), err)
 		return
 	}
+
+	if err != nil {
+		s.actionError(w, r, badRequest(CodeBadRequest, "CAN'T READ BODY FROM REQUEST"), err)
+		return
+	}
+
+	shortURLs := []string{}
+
+	err = json.Unmarshal(body, &shortURLs)
+
+	if err != nil {
+		s.actionError(w, r, badRequest(CodeInvalidJSON, "CAN'T UNMARSHAL JSON BODY"), err)
+		return
+	}
+
+	err = s.Repo.DeleteURLs(r.Context(), getUserID(r), shortURLs)
+
+	if errors.Is(err, repository.ErrQueueFull) {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	if err != nil {
+		s.actionError(w, r, repoError(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func (s *MyServer) actionStart(next http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		s.Logger.Debugln(fmt.Sprintf("Req: %s %s\n", r.Host, r.URL.Path))
-
 		begTime := time.Now()
-		uri := r.RequestURI
-		method := r.Method
+
+		requestID := validRequestID(r.Header.Get(requestIDHeader))
+
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+
+		r.Header.Set(requestIDHeader, requestID)
+		w.Header().Set(requestIDHeader, requestID)
+
+		reqLog := s.Logger.With("request_id", requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		r = r.WithContext(logger.WithContext(ctx, reqLog))
 
 		responseData := &models.ResponseData{
 			Status: 0,
 			Size:   0,
-			Logger: s.Logger,
+			Logger: reqLog,
 		}
 
 		lw := models.CustomResponseWriter{
 			ResponseWriter: w,
 			ResponseData:   responseData,
 			NeedGZip:       false,
-			Logger:         s.Logger,
+			Logger:         reqLog,
 		}
 
 		acceptEncodings := r.Header.Values("Accept-Encoding")
@@ -319,74 +593,282 @@ func (s *MyServer) actionStart(next http.Handler) http.Handler {
 		for _, encodingLine := range acceptEncodings {
 			acceptEncoding := strings.Split(encodingLine, ",")
 			for _, encoding := range acceptEncoding {
-				if encoding == "gzip" {
+				if strings.TrimSpace(encoding) == "gzip" {
 					lw.NeedGZip = true
 					break
 				}
 			}
 		}
 
-		s.Logger.Debugln(r.Header.Get("Content-Encoding"))
-
 		if r.Header.Get("Content-Encoding") == "gzip" {
-			buf, err := io.ReadAll(r.Body) // handle the error
+			gz, err := gzip.NewReader(r.Body)
 
 			if err != nil {
-				s.actionError(w, "CAN'T CREATE NEW BUFFER")
+				s.actionError(&lw, r, badRequest(CodeBadRequest, "BODY IS NOT GZIP"), err)
+				s.finishRequest(r, responseData, begTime)
 				return
 			}
-			readedBody := io.NopCloser(bytes.NewBuffer(buf))
 
-			gz, err := gzip.NewReader(readedBody)
+			r.Body = gz
+		}
+
+		next.ServeHTTP(&lw, r)
+
+		s.finishRequest(r, responseData, begTime)
+	}
+	return http.HandlerFunc(f)
+}
+
+// finishRequest writes one access log line per request and updates
+// metrics. Route is the pattern chi matched, so all redirects are
+// counted under "/{id}".
+func (s *MyServer) finishRequest(r *http.Request, responseData *models.ResponseData, begTime time.Time) {
+	duration := time.Since(begTime)
+	status := responseData.Status
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	route := ""
+
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		route = rctx.RoutePattern()
+	}
+
+	s.log(r).Infow("ACCESS",
+		"method", r.Method,
+		"route", route,
+		"path", r.URL.Path,
+		"status", status,
+		"bytes", responseData.Size,
+		"duration", duration,
+		"remote_addr", r.RemoteAddr,
+		"user_agent", r.UserAgent(),
+	)
+
+	if s.metrics != nil {
+		s.metrics.ObserveRequest(route, r.Method, status, duration)
+		s.metrics.ObserveGzip(responseData.GzipIn, responseData.GzipOut)
+	}
+}
+
+// validRequestID accepts an id from client only if it is short
+// and printable, so it can't break log lines.
+func validRequestID(id string) string {
+	if id == "" || len(id) > maxRequestID {
+		return ""
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return ""
+		}
+	}
+
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func getRequestID(r *http.Request) string {
+	requestID, ok := r.Context().Value(requestIDKey).(string)
+
+	if !ok {
+		return ""
+	}
+
+	return requestID
+}
+
+// log returns the logger of the request, it adds request_id to lines.
+func (s *MyServer) log(r *http.Request) logger.MyLogger {
+	return logger.FromContext(r.Context(), s.Logger)
+}
+
+// actionAuth gives a client without a valid auth cookie a new user id.
+// A request with an API key gets no cookie, apiKeyAuth sets the user
+// of the key.
+func (s *MyServer) actionAuth(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if readAPIKey(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID, err := s.readAuthCookie(r)
+
+		if err != nil {
+			userID, err = newUserID()
 
 			if err != nil {
-				s.actionError(w, "CAN'T CREATE GZ READER")
+				s.actionError(w, r, internalError("CAN'T GENERATE USER ID"), err)
 				return
 			}
 
-			r.Body = gz
+			http.SetCookie(w, &http.Cookie{
+				Name:     authCookieName,
+				Value:    s.signUserID(userID),
+				Path:     "/",
+				HttpOnly: true,
+			})
 		}
-		next.ServeHTTP(&lw, r)
-
-		duration := time.Since(begTime)
 
-		s.Logger.Infoln(
-			"uri", uri,
-			"method", method,
-			"duration", duration,
-			"size", responseData.Size,
-			"status", responseData.Status,
-		)
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 	return http.HandlerFunc(f)
 }
 
-func NewServer(log logger.MyLogger, repo repository.StorageService) (*MyServer, error) {
-	return &MyServer{
-		Logger: log,
-		Repo:   repo,
-	}, nil
+func (s *MyServer) signUserID(userID int) string {
+	id := strconv.Itoa(userID)
+	mac := hmac.New(sha256.New, s.authKey)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
 }
 
-func NewRouter(log logger.MyLogger, repo repository.StorageService) *chi.Mux {
+func (s *MyServer) readAuthCookie(r *http.Request) (int, error) {
+	cookie, err := r.Cookie(authCookieName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	id, _, found := strings.Cut(cookie.Value, ".")
+
+	if !found {
+		return 0, fmt.Errorf("BAD AUTH COOKIE FORMAT")
+	}
+
+	userID, err := strconv.Atoi(id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !hmac.Equal([]byte(cookie.Value), []byte(s.signUserID(userID))) {
+		return 0, fmt.Errorf("BAD AUTH COOKIE SIGN")
+	}
+
+	return userID, nil
+}
+
+func newUserID() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()) + 1, nil
+}
+
+func getUserID(r *http.Request) int {
+	userID, ok := r.Context().Value(userIDKey).(int)
+
+	if !ok {
+		return 0
+	}
+
+	return userID
+}
+
+// WithMetrics makes the server report requests to m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(s *MyServer) {
+		s.metrics = m
+	}
+}
+
+func NewServer(log logger.MyLogger, repo *repository.StorageService, opts ...Option) (*MyServer, error) {
+	authKey := []byte(conf.SecretKey)
+
+	if len(authKey) == 0 {
+		log.Infoln("NO SECRET KEY. USE RANDOM ONE")
+
+		authKey = make([]byte, authKeyLength)
+
+		if _, err := rand.Read(authKey); err != nil {
+			return nil, err
+		}
+	}
+
+	ipSalt, err := repo.VisitorSalt(context.Background())
+
+	if err != nil {
+		log.Errorln("CAN'T GET VISITOR SALT. UNIQUE VISITORS ARE COUNTED PER PROCESS", "error", err.Error())
+		ipSalt = authKey
+	}
+
+	s := &MyServer{
+		Logger:  log,
+		Repo:    repo,
+		authKey: authKey,
+		ipSalt:  ipSalt,
+		urlOpts: urlnorm.Options{
+			SortQuery:     conf.URLSortQuery,
+			StripTracking: conf.URLStripTrack,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+func NewRouter(log logger.MyLogger, repo *repository.StorageService, opts ...Option) (*chi.Mux, error) {
 	R := chi.NewRouter()
-	server, err := NewServer(log, repo)
+	server, err := NewServer(log, repo, opts...)
 
 	if err != nil {
-		log.Errorln("CAN'T CREATE SERVER")
+		return nil, err
 	}
 
 	R.Use(server.actionStart)
+	R.Use(server.actionAuth)
+
+	R.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		server.actionError(w, r, newAPIError(http.StatusNotFound, CodeNotFound, "NO SUCH ROUTE"), nil)
+	})
+	R.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		server.actionError(w, r, newAPIError(http.StatusMethodNotAllowed, CodeBadRequest, "METHOD NOT ALLOWED"), nil)
+	})
+
+	limitCreate := server.rateLimit("create", server.limits.Create)
+	limitRedirect := server.rateLimit("redirect", server.limits.Redirect)
+	canCreate := server.requireScope(repository.ScopeCreate)
+	canReadStats := server.requireScope(repository.ScopeReadStats)
+	canDelete := server.requireScope(repository.ScopeDelete)
+	isAdmin := server.requireScope(repository.ScopeAdmin)
 
 	R.Route("/", func(r chi.Router) {
-		r.Post("/", server.actionCreateURL)
-		r.Post("/api/shorten", server.actionShorten)
-		r.Post("/api/shorten/batch", server.actionBatch)
-		r.Get("/{id}", server.actionRedirect)
+		r.With(server.apiKeyAuth, canCreate, limitCreate).Post("/", server.actionCreateURL)
+		r.Route("/api", func(r chi.Router) {
+			r.Use(server.apiKeyAuth)
+			r.With(canCreate, server.requireJSON, limitCreate).Post("/shorten", server.actionShorten)
+			r.With(canCreate, server.requireJSON).Post("/shorten/batch", server.actionBatch)
+			// listing a user's links goes with creating them, stats
+			// readers see only counters of links they know
+			r.With(canCreate).Get("/user/urls", server.actionUserURLs)
+			r.With(canDelete, server.requireJSON).Delete("/user/urls", server.actionDeleteURLs)
+			r.With(canReadStats).Get("/stats/{id}", server.actionStats)
+			r.With(isAdmin).Get("/urls", server.actionListURLs)
+		})
+		r.With(limitRedirect).Get("/{id}", server.actionRedirect)
 		r.Get("/ping", server.actionPing)
 		r.Get("/tst", server.actionTest)
 		r.Post("/tst", server.actionTest)
 	})
 
-	return R
+	return R, nil
 }
@@ -1,25 +1,39 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"flag"
 
 	"github.com/DmitryM7/short-url.git/internal/conf"
 	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/metrics"
+	"github.com/DmitryM7/short-url.git/internal/ratelimit"
 	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/DmitryM7/short-url.git/internal/repository/repotest"
+	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var Logger logger.MyLogger
-var Repo repository.StorageService
+var Repo *repository.StorageService
 
 func init() { //nolint: gochecknoinits //see chapter "Setting Up Test Data" in https://www.bytesizego.com/blog/init-function-golang#:~:text=Reasons%20to%20Avoid%20Using%20the%20init%20Function%20in%20Go&text=Since%20it%20runs%20automatically%2C%20any,state%20changes%20without%20explicit%20calls
 	conf.ParseFlags()
@@ -28,18 +42,39 @@ func init() { //nolint: gochecknoinits //see chapter "Setting Up Test Data" in h
 }
 
 func TestMain(m *testing.M) {
-	var err error
+	var (
+		err    error
+		tmpDir string
+	)
 	flag.Parse()
-	conf.ParseEnv()
 
-	repoConf := repository.StorageConfig{Logger: Logger}
+	if err = conf.ParseEnv(); err != nil {
+		Logger.Fatalln("CAN'T PARSE ENV:" + err.Error())
+	}
+
+	repoConf := repository.StorageConfig{
+		Logger:             Logger,
+		ShortCodeGenerator: conf.ShortCodeGen,
+		ShortCodeSalt:      conf.SecretKey,
+		ReaperInterval:     conf.ReaperInterval,
+		ReadTimeout:        conf.StorageReadTO,
+		WriteTimeout:       conf.StorageWriteTO,
+	}
 
 	if conf.DSN != "" {
 		repoConf.StorageType = repository.DBType
 		repoConf.DatabaseDSN = conf.DSN
 	} else {
+		// every run starts with an empty file, links left by the
+		// previous run would turn expected 201 into 409
+		tmpDir, err = os.MkdirTemp("", "shortener-test")
+
+		if err != nil {
+			Logger.Fatalln("CAN'T CREATE TEMP DIR")
+		}
+
 		repoConf.StorageType = repository.FileType
-		repoConf.FilePath = conf.FilePath
+		repoConf.FilePath = filepath.Join(tmpDir, "repo.json")
 	}
 
 	Repo, err = repository.NewStorageService(repoConf)
@@ -48,7 +83,23 @@ func TestMain(m *testing.M) {
 		Logger.Fatalln("CAN'T CREATE REPO")
 	}
 
-	os.Exit(m.Run())
+	code := m.Run()
+	Repo.Close()
+
+	if tmpDir != "" {
+		os.RemoveAll(tmpDir)
+	}
+
+	os.Exit(code)
+}
+
+func newTestRouter(t *testing.T, lg logger.MyLogger, repo *repository.StorageService, opts ...Option) *chi.Mux {
+	t.Helper()
+
+	router, err := NewRouter(lg, repo, opts...)
+	require.NoError(t, err)
+
+	return router
 }
 
 func TestActionCreateURL(t *testing.T) {
@@ -99,7 +150,7 @@ func TestActionCreateURL(t *testing.T) {
 			},
 			want: want{
 				statusCode: http.StatusCreated,
-				body:       "http://localhost:8080/b8da4f2d",
+				body:       "http://localhost:8080/68010022",
 			},
 		},
 	}
@@ -134,9 +185,11 @@ func TestActionCreateURL(t *testing.T) {
 }
 
 func TestActionRedirect(t *testing.T) {
-	_, err := Repo.Create("www.ya.ru")
+	_, err := Repo.Create(context.Background(), repository.LinkRecord{URL: "www.ya.ru"})
 
-	if err != nil {
+	var conflict *repository.ErrConflict
+
+	if err != nil && !errors.As(err, &conflict) {
 		Logger.Fatalln("CAN'T CREATE RECORD")
 	}
 
@@ -272,3 +325,883 @@ func TestActionShorten(t *testing.T) {
 		})
 	}
 }
+
+func TestActionUserURLs(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res := w.Result()
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "new user must have no urls")
+
+	cookies := res.Cookies()
+	require.NotEmpty(t, cookies, "auth cookie must be issued")
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://user.example.com"))
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	resCreate := w.Result()
+	defer resCreate.Body.Close()
+
+	require.Contains(t, []int{http.StatusCreated, http.StatusConflict}, resCreate.StatusCode)
+	assert.Empty(t, resCreate.Cookies(), "valid auth cookie must not be reissued")
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	resList := w.Result()
+	defer resList.Body.Close()
+
+	require.Equal(t, http.StatusOK, resList.StatusCode)
+
+	b, err := io.ReadAll(resList.Body)
+	require.NoError(t, err)
+
+	output := []ResponseUserURLUnit{}
+	require.NoError(t, json.Unmarshal(b, &output))
+	require.Len(t, output, 1)
+	assert.Equal(t, "https://user.example.com", output[0].OriginalURL)
+
+	forged := *cookies[0]
+	forged.Value = "1." + strings.Repeat("0", 64)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	r.AddCookie(&forged)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	resForged := w.Result()
+	defer resForged.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resForged.StatusCode, "forged cookie must not give access to urls")
+	assert.NotEmpty(t, resForged.Cookies(), "forged cookie must be replaced")
+}
+
+func TestActionDeleteURLs(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+
+	shorten := func(cookie *http.Cookie, url string) (*http.Cookie, string) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		if cookie == nil {
+			require.NotEmpty(t, res.Cookies())
+			cookie = res.Cookies()[0]
+		}
+
+		return cookie, strings.TrimPrefix(string(b), conf.RetAdd+"/")
+	}
+
+	del := func(cookie *http.Cookie, ids ...string) {
+		body, err := json.Marshal(ids)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(string(body)))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	}
+
+	redirectStatus := func(id string) int {
+		r := httptest.NewRequest(http.MethodGet, "/"+id, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	owner, ownID := shorten(nil, "https://delete.example.com/own")
+	stranger, _ := shorten(nil, "https://delete.example.com/stranger")
+	_, strangerID := shorten(stranger, "https://delete.example.com/kept")
+
+	del(owner, ownID, strangerID)
+
+	assert.Eventually(t, func() bool {
+		return redirectStatus(ownID) == http.StatusGone
+	}, 5*time.Second, 100*time.Millisecond, "owner link must be deleted")
+
+	assert.Equal(t, http.StatusTemporaryRedirect, redirectStatus(strangerID), "only owner can delete link")
+
+	_, againID := shorten(owner, "https://delete.example.com/own")
+	assert.NotEqual(t, ownID, againID, "a deleted url is shortened anew")
+	assert.Equal(t, http.StatusTemporaryRedirect, redirectStatus(againID))
+	assert.Equal(t, http.StatusGone, redirectStatus(ownID))
+
+	body, err := json.Marshal(make([]string, repository.MaxDeleteURLs+1))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(string(body)))
+	r.AddCookie(owner)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res := w.Result()
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "deletes are capped per request")
+}
+
+func TestActionShortenAlias(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+		result     string
+	}{
+		{
+			name:       "GOOD",
+			body:       `{"url": "https://alias.example.com/spring", "alias": "spring-sale"}`,
+			statusCode: http.StatusCreated,
+			result:     "http://localhost:8080/spring-sale",
+		},
+		{
+			name:       "TAKEN",
+			body:       `{"url": "https://alias.example.com/autumn", "alias": "spring-sale"}`,
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "RESERVED",
+			body:       `{"url": "https://alias.example.com/ping", "alias": "ping"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "BAD_CHARS",
+			body:       `{"url": "https://alias.example.com/chars", "alias": "spring sale"}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	server, err := NewServer(Logger, Repo)
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.actionShorten(w, r)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+
+			if tt.result != "" {
+				response := Response{}
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+				assert.Equal(t, tt.result, response.Result)
+			}
+		})
+	}
+}
+
+func TestActionShortenNormalizesURL(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+
+	shorten := func(url string) (int, []byte) {
+		body, err := json.Marshal(Request{URL: url})
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(string(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		return res.StatusCode, b
+	}
+
+	status, first := shorten("HTTP://Normalize.Example.com/")
+	require.Equal(t, http.StatusCreated, status)
+
+	status, second := shorten("http://normalize.example.com")
+	require.Equal(t, http.StatusConflict, status, "the same url in another form")
+	assert.JSONEq(t, string(first), string(second))
+
+	for _, url := range []string{"javascript:alert(1)", "ftp://normalize.example.com", "http://"} {
+		status, b := shorten(url)
+		assert.Equal(t, http.StatusBadRequest, status, url)
+
+		response := APIError{}
+		require.NoError(t, json.Unmarshal(b, &response), url)
+		assert.Equal(t, CodeInvalidURL, response.Code, url)
+		assert.NotEmpty(t, response.Message, url)
+	}
+}
+
+func TestActionBatchStatuses(t *testing.T) {
+	server, err := NewServer(Logger, Repo)
+	require.NoError(t, err)
+
+	body := `[
+		{"correlation_id": "1", "original_url": "https://batch.example.com/new"},
+		{"correlation_id": "2", "original_url": "https://batch.example.com/new"},
+		{"correlation_id": "3", "original_url": "https://batch.example.com/alias", "alias": "api"},
+		{"correlation_id": "4", "original_url": "https://batch.example.com/ttl", "ttl_seconds": -1},
+		{"correlation_id": "5", "original_url": "javascript:alert(1)"}
+	]`
+
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.actionBatch(w, r)
+	res := w.Result()
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	output := []ResponseShortenBatchUnit{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&output))
+	require.Len(t, output, 5)
+
+	assert.Equal(t, "1", output[0].CorrelationID)
+	assert.Contains(t, []repository.BatchStatus{repository.BatchCreated, repository.BatchExisting}, output[0].Status)
+	assert.NotEmpty(t, output[0].ShortURL)
+
+	assert.Equal(t, repository.BatchExisting, output[1].Status)
+	assert.Equal(t, output[0].ShortURL, output[1].ShortURL)
+
+	for _, v := range output[2:] {
+		assert.Equal(t, repository.BatchInvalid, v.Status, v.CorrelationID)
+		assert.Empty(t, v.ShortURL)
+		assert.NotEmpty(t, v.Error)
+	}
+}
+
+func TestActionShortenExpiration(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+
+	shorten := func(body string) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	res := shorten(`{"url": "https://expire.example.com/past", "expires_at": "2000-01-01T00:00:00Z"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "expires_at in the past")
+
+	res = shorten(`{"url": "https://expire.example.com/both", "ttl_seconds": 10, "expires_at": "2100-01-01T00:00:00Z"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "ttl_seconds and expires_at together")
+
+	res = shorten(`{"url": "https://expire.example.com/ttl", "alias": "expire-ttl", "ttl_seconds": 1}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	redirectStatus := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/expire-ttl", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusTemporaryRedirect, redirectStatus())
+	assert.Eventually(t, func() bool {
+		return redirectStatus() == http.StatusGone
+	}, 5*time.Second, 100*time.Millisecond, "expired link must answer 410")
+}
+
+func TestActionStats(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+
+	id := fmt.Sprintf("stats-%d", time.Now().UnixNano())
+	body := fmt.Sprintf(`{"url": "https://stats.example.com/%s", "alias": "%s"}`, id, id)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res := w.Result()
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	for _, remoteAddr := range []string{"10.0.0.1:1000", "10.0.0.1:2000", "10.0.0.2:1000"} {
+		r = httptest.NewRequest(http.MethodGet, "/"+id, nil)
+		r.RemoteAddr = remoteAddr
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res = w.Result()
+		res.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+	}
+
+	stats := ResponseStats{}
+
+	assert.Eventually(t, func() bool {
+		r := httptest.NewRequest(http.MethodGet, "/api/stats/"+id, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK || json.NewDecoder(res.Body).Decode(&stats) != nil {
+			return false
+		}
+
+		return stats.TotalClicks == 3
+	}, 5*time.Second, 100*time.Millisecond, "clicks must be flushed")
+
+	assert.Equal(t, 2, stats.UniqueVisitors)
+	assert.Len(t, stats.ByDay, 1)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/stats/no-such-link", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res = w.Result()
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestHashIPSurvivesRestart(t *testing.T) {
+	first, err := NewServer(Logger, Repo)
+	require.NoError(t, err)
+
+	// without a secret key every server has its own random auth key
+	second, err := NewServer(Logger, Repo)
+	require.NoError(t, err)
+
+	assert.Equal(t, first.hashIP("10.0.0.1:1000"), second.hashIP("10.0.0.1:2000"))
+	assert.NotEqual(t, first.hashIP("10.0.0.1:1000"), second.hashIP("10.0.0.2:1000"))
+}
+
+func TestCancelledRequestCancelsQuery(t *testing.T) {
+	repo, storage := repotest.NewBlockingService(t, repository.StorageConfig{Logger: Logger})
+
+	server, err := NewServer(Logger, repo)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/b8da4f2d", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+
+	go func() {
+		server.actionRedirect(w, r)
+		close(done)
+	}()
+
+	cancel()
+
+	assert.ErrorIs(t, storage.Cancelled(t), context.Canceled, "storage must see the client has gone")
+
+	<-done
+}
+
+// switchPolicy blocks every url of the host while blocked is set.
+type switchPolicy struct {
+	host    string
+	blocked bool
+}
+
+func (p *switchPolicy) Check(url string) error {
+	if p.blocked && strings.Contains(url, p.host) {
+		return errors.New("DOMAIN IS IN DENY LIST")
+	}
+
+	return nil
+}
+
+func TestDomainPolicy(t *testing.T) {
+	pol := &switchPolicy{host: "later-blocked.example.com"}
+
+	repo, err := repository.NewStorageService(repository.StorageConfig{
+		StorageType:        repository.MemType,
+		Logger:             Logger,
+		ShortCodeGenerator: conf.ShortCodeGen,
+		Policy:             pol,
+	})
+	require.NoError(t, err)
+	defer repo.Close()
+
+	router := newTestRouter(t, Logger, repo)
+
+	shorten := func(url string) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url": "`+url+`"}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	res := shorten("https://later-blocked.example.com/login")
+	defer res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	response := Response{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	id := strings.TrimPrefix(response.Result, conf.RetAdd+"/")
+
+	pol.blocked = true
+
+	r := httptest.NewRequest(http.MethodGet, "/"+id, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	page := w.Result()
+	defer page.Body.Close()
+
+	assert.Equal(t, http.StatusOK, page.StatusCode)
+	assert.Empty(t, page.Header.Get("Location"))
+	assert.Contains(t, page.Header.Get("Content-Type"), "text/html")
+
+	html, err := io.ReadAll(page.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "https://later-blocked.example.com/login")
+
+	blocked := shorten("https://later-blocked.example.com/other")
+	defer blocked.Body.Close()
+	assert.Equal(t, http.StatusForbidden, blocked.StatusCode)
+
+	results, err := repo.BatchCreate(context.Background(), []repository.LinkRecord{
+		{URL: "https://later-blocked.example.com/batch"},
+		{URL: "https://fine.example.com/batch"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, repository.BatchInvalid, results[0].Status)
+	assert.ErrorIs(t, results[0].Err, repository.ErrBlocked)
+	assert.Equal(t, repository.BatchCreated, results[1].Status)
+}
+
+// faultyStorage fails every query as a broken database would.
+type faultyStorage struct {
+	*repository.InMemoryStorage
+}
+
+func (f *faultyStorage) Get(context.Context, string) (repository.LinkRecord, error) {
+	return repository.LinkRecord{}, errors.New("connection refused")
+}
+
+func (f *faultyStorage) GetStats(context.Context, string) (repository.LinkStats, error) {
+	return repository.LinkStats{}, errors.New("connection refused")
+}
+
+func TestAPIErrors(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+
+	do := func(router http.Handler, method, url, contentType, body string) (*http.Response, APIError) {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set(requestIDHeader, "req-42")
+
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		apiErr := APIError{}
+
+		if strings.HasPrefix(res.Header.Get("Content-type"), "application/json") {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&apiErr))
+		}
+
+		return res, apiErr
+	}
+
+	res, apiErr := do(router, http.MethodGet, "/api/stats/no-such-link", "", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, CodeNotFound, apiErr.Code)
+	assert.Equal(t, "req-42", apiErr.RequestID)
+
+	res, apiErr = do(router, http.MethodPost, "/api/shorten", "text/plain", `{"url": "https://ct.example.com"}`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+	assert.Equal(t, CodeUnsupportedMedia, apiErr.Code)
+	assert.Equal(t, "text/plain", apiErr.Details["content_type"])
+
+	res, apiErr = do(router, http.MethodPost, "/api/shorten", "application/json; charset=utf-8", `{"url": `)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, CodeInvalidJSON, apiErr.Code)
+
+	res, _ = do(router, http.MethodGet, "/no-such-code", "", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "unknown short code")
+	assert.Contains(t, res.Header.Get("Content-type"), "text/plain")
+
+	mem, err := repository.NewInMemoryStorage(Logger)
+	require.NoError(t, err)
+
+	repo, err := repository.NewStorageServiceFor(&faultyStorage{InMemoryStorage: mem}, repository.StorageConfig{Logger: Logger})
+	require.NoError(t, err)
+	defer repo.Close()
+
+	faulty := newTestRouter(t, Logger, repo)
+
+	res, apiErr = do(faulty, http.MethodGet, "/api/stats/abc", "", "")
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.Equal(t, CodeStorage, apiErr.Code)
+	assert.NotContains(t, apiErr.Message, "connection refused", "storage details are not shown to clients")
+
+	res, _ = do(faulty, http.MethodGet, "/abc", "", "")
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+}
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	lg := logger.MyLogger{SugaredLogger: zap.New(core).Sugar()}
+	router := newTestRouter(t, lg, Repo)
+
+	get := func(url, requestID string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r.Header.Set("User-Agent", "test-agent")
+
+		if requestID != "" {
+			r.Header.Set(requestIDHeader, requestID)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		res.Body.Close()
+		return res
+	}
+
+	res := get("/api/stats/no-such-link", "client-id-1")
+	assert.Equal(t, "client-id-1", res.Header.Get(requestIDHeader), "id from client is kept")
+
+	res = get("/api/stats/no-such-link", "bad id\nwith newline")
+	assert.Regexp(t, "^[0-9a-f]{32}$", res.Header.Get(requestIDHeader), "bad id is replaced")
+
+	res = get("/api/stats/no-such-link", "")
+	assert.Regexp(t, "^[0-9a-f]{32}$", res.Header.Get(requestIDHeader))
+
+	access := logs.FilterMessage("ACCESS").AllUntimed()
+	require.Len(t, access, 3, "one access line per request")
+
+	fields := access[0].ContextMap()
+	assert.Equal(t, "client-id-1", fields["request_id"])
+	assert.Equal(t, http.MethodGet, fields["method"])
+	assert.Equal(t, "/api/stats/{id}", fields["route"])
+	assert.EqualValues(t, http.StatusNotFound, fields["status"])
+	assert.Equal(t, "test-agent", fields["user_agent"])
+	assert.Contains(t, fields, "bytes")
+	assert.Contains(t, fields, "duration")
+	assert.Contains(t, fields, "remote_addr")
+
+	notFound := logs.FilterMessage("LINK NOT FOUND").AllUntimed()
+	require.NotEmpty(t, notFound)
+	assert.Equal(t, "client-id-1", notFound[0].ContextMap()["request_id"], "handlers log with request id")
+}
+
+func TestMetrics(t *testing.T) {
+	mtr := metrics.New()
+	router := newTestRouter(t, Logger, Repo, WithMetrics(mtr))
+	router.Handle("/metrics", mtr.Handler())
+
+	do := func(method, url, body string) *http.Response {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		res.Body.Close()
+		return res
+	}
+
+	res := do(http.MethodPost, "/api/shorten", `{"url": "https://metrics.example.com/`+strings.Repeat("long/", 50)+`"}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-encoding"))
+
+	do(http.MethodGet, "/api/stats/no-such-link", "")
+	do(http.MethodGet, "/api/stats/other-link", "")
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	res = w.Result()
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `shortener_http_requests_total{method="POST",route="/api/shorten",status="201"} 1`)
+	assert.Contains(t, string(body), `shortener_http_requests_total{method="GET",route="/api/stats/{id}",status="404"} 2`)
+	assert.Contains(t, string(body), `shortener_gzip_compression_ratio_count 3`, "every JSON answer is gzipped")
+}
+
+func TestRateLimits(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo, WithRateLimits(ratelimit.NewMemoryStore(), RateLimits{
+		Create:    ratelimit.Limit{Burst: 2, Per: time.Minute},
+		BatchItem: ratelimit.Limit{Burst: 3, Per: time.Minute},
+	}))
+
+	post := func(url, body, remoteAddr string) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		res.Body.Close()
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		res := post("/api/shorten", fmt.Sprintf(`{"url": "https://limit.example.com/%d"}`, i), "10.1.0.1:1000")
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Equal(t, "2", res.Header.Get("X-RateLimit-Limit"))
+		assert.Equal(t, strconv.Itoa(1-i), res.Header.Get("X-RateLimit-Remaining"))
+	}
+
+	res := post("/", "https://limit.example.com/plain", "10.1.0.1:2000")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "POST / shares the create budget")
+	assert.Equal(t, "30", res.Header.Get("Retry-After"))
+	assert.Equal(t, "0", res.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "60", res.Header.Get("X-RateLimit-Reset"))
+
+	res = post("/api/shorten", `{"url": "https://limit.example.com/other-ip"}`, "10.1.0.2:1000")
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "other ip has own budget")
+
+	batch := func(n int) string {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = fmt.Sprintf(`{"correlation_id": "%d", "original_url": "https://limit.example.com/batch/%d"}`, i, i)
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	}
+
+	res = post("/api/shorten/batch", batch(4), "10.1.0.1:1000")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "batch can never fit")
+
+	res = post("/api/shorten/batch", batch(2), "10.1.0.1:1000")
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "batches have own budget")
+
+	res = post("/api/shorten/batch", batch(2), "10.1.0.1:1000")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "every item costs a token")
+}
+
+func TestRateLimitsByUser(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo, WithRateLimits(ratelimit.NewMemoryStore(), RateLimits{
+		Create: ratelimit.Limit{Burst: 1, Per: time.Minute},
+		ByUser: true,
+	}))
+
+	key, _, err := Repo.CreateAPIKey(context.Background(), "limited", []repository.Scope{repository.ScopeCreate})
+	require.NoError(t, err)
+
+	n := 0
+
+	post := func(remoteAddr, key string, cookies ...*http.Cookie) *http.Response {
+		n++
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(fmt.Sprintf("https://byuser.example.com/%d", n)))
+		r.RemoteAddr = remoteAddr
+
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+
+		for _, v := range cookies {
+			r.AddCookie(v)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		res.Body.Close()
+		return res
+	}
+
+	res := post("10.2.0.1:1000", key)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = post("10.2.0.2:1000", key)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "user of a key is limited from any ip")
+
+	res = post("10.2.0.1:2000", "")
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "user budget is separate from ip budget")
+	cookies := res.Cookies()
+	require.NotEmpty(t, cookies)
+
+	res = post("10.2.0.1:3000", "", cookies...)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "signed cookie is limited by ip")
+
+	res = post("10.2.0.1:4000", "")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "fresh cookie doesn't reset the budget")
+}
+
+func TestAPIKeys(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo, WithAPIKeys(repository.ScopeCreate))
+	ctx := context.Background()
+
+	creator, _, err := Repo.CreateAPIKey(ctx, "creator", []repository.Scope{repository.ScopeCreate})
+	require.NoError(t, err)
+
+	reader, _, err := Repo.CreateAPIKey(ctx, "reader", []repository.Scope{repository.ScopeReadStats})
+	require.NoError(t, err)
+
+	revoked, revokedKey, err := Repo.CreateAPIKey(ctx, "revoked", []repository.Scope{repository.ScopeAdmin})
+	require.NoError(t, err)
+	require.NoError(t, Repo.RevokeAPIKey(ctx, revokedKey.ID))
+
+	shorten := func(header, value string) (*http.Response, APIError) {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url": "https://apikey.example.com"}`))
+		r.Header.Set("Content-Type", "application/json")
+
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		apiErr := APIError{}
+
+		if res.StatusCode >= http.StatusBadRequest {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&apiErr))
+		}
+
+		return res, apiErr
+	}
+
+	res, apiErr := shorten("", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "anonymous creation is blocked")
+	assert.Equal(t, CodeUnauthorized, apiErr.Code)
+	assert.NotEmpty(t, res.Header.Get("WWW-Authenticate"))
+
+	res, apiErr = shorten("Authorization", "Bearer "+revoked)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, CodeUnauthorized, apiErr.Code)
+
+	res, apiErr = shorten(apiKeyHeader, reader)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, CodeInsufficientScope, apiErr.Code)
+
+	res, _ = shorten("Authorization", "Bearer "+creator)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Empty(t, res.Cookies(), "API clients get no session cookie")
+
+	res, _ = shorten(apiKeyHeader, creator)
+	assert.Equal(t, http.StatusConflict, res.StatusCode, "the same url again")
+
+	stats := func(key string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/stats/no-such-link", nil)
+
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, stats(""), "anonymous clients may still read stats")
+	assert.Equal(t, http.StatusNotFound, stats(reader))
+	assert.Equal(t, http.StatusForbidden, stats(creator))
+
+	userURLs := func(key string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		r.Header.Set(apiKeyHeader, key)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, userURLs(reader), "stats readers can't list links")
+	assert.Equal(t, http.StatusOK, userURLs(creator))
+}
+
+func TestListURLs(t *testing.T) {
+	router := newTestRouter(t, Logger, Repo)
+	ctx := context.Background()
+
+	admin, _, err := Repo.CreateAPIKey(ctx, "admin", []repository.Scope{repository.ScopeAdmin})
+	require.NoError(t, err)
+
+	creator, _, err := Repo.CreateAPIKey(ctx, "creator", []repository.Scope{repository.ScopeCreate})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := Repo.Create(ctx, repository.LinkRecord{
+			ShortURL: fmt.Sprintf("list-%d", i),
+			URL:      fmt.Sprintf("https://list.example.com/%d", i),
+		})
+		require.NoError(t, err)
+	}
+
+	list := func(key, query string) (*http.Response, ResponseList) {
+		r := httptest.NewRequest(http.MethodGet, "/api/urls?"+query, nil)
+
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		res := w.Result()
+		defer res.Body.Close()
+
+		page := ResponseList{}
+
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+		}
+
+		return res, page
+	}
+
+	res, _ := list("", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "anonymous clients can't list links of everybody")
+
+	res, _ = list(creator, "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	got := []string{}
+	cursor := ""
+
+	for pages := 0; pages < 10; pages++ {
+		res, page := list(admin, "limit=2&match=prefix&q="+url.QueryEscape("https://list.example.com/")+"&cursor="+cursor)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		for _, v := range page.URLs {
+			got = append(got, v.OriginalURL)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+
+		cursor = page.NextCursor
+	}
+
+	assert.Equal(t, []string{
+		"https://list.example.com/0",
+		"https://list.example.com/1",
+		"https://list.example.com/2",
+		"https://list.example.com/3",
+		"https://list.example.com/4",
+	}, got)
+
+	res, _ = list(admin, "cursor=***")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, _ = list(admin, "limit=0")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
@@ -1,26 +1,95 @@
 package logger
 
 import (
+	"context"
+	"fmt"
+
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
 )
 
 type MyLogger struct {
 	*zap.SugaredLogger
 }
 
-func NewLogger() MyLogger {
-	var (
-		logger    *zap.Logger
-		errLogger error
-	)
+// Config sets up the logger, zero value gives JSON at info level.
+type Config struct {
+	// Level is one of debug, info, warn, error.
+	Level string
+	// Format is json for log pipelines or console for humans.
+	Format string
+}
+
+type ctxKey struct{}
 
-	logger, errLogger = zap.NewDevelopment()
+// NewLogger returns JSON production logger at info level.
+func NewLogger() MyLogger {
+	lg, err := New(Config{})
 
-	if errLogger != nil {
+	if err != nil {
 		panic("CAN'T INIT ZAP LOGGER")
 	}
 
-	defer logger.Sync() //nolint:errcheck // unnessesary error checking
+	return lg
+}
+
+func New(cfg Config) (MyLogger, error) {
+	level := zapcore.InfoLevel
+
+	if cfg.Level != "" {
+		var err error
+
+		if level, err = zapcore.ParseLevel(cfg.Level); err != nil {
+			return MyLogger{}, fmt.Errorf("BAD LOG LEVEL %q", cfg.Level)
+		}
+	}
+
+	var zapCfg zap.Config
+
+	switch cfg.Format {
+	case "", FormatJSON:
+		zapCfg = zap.NewProductionConfig()
+		zapCfg.EncoderConfig.TimeKey = "time"
+		zapCfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		// every access line must reach the log
+		zapCfg.Sampling = nil
+	case FormatConsole:
+		zapCfg = zap.NewDevelopmentConfig()
+	default:
+		return MyLogger{}, fmt.Errorf("BAD LOG FORMAT %q", cfg.Format)
+	}
+
+	zapCfg.Level = zap.NewAtomicLevelAt(level)
+
+	logger, err := zapCfg.Build()
+
+	if err != nil {
+		return MyLogger{}, err
+	}
+
+	return MyLogger{SugaredLogger: logger.Sugar()}, nil
+}
+
+// With returns the logger which adds key-value pairs to every line.
+func (l MyLogger) With(args ...any) MyLogger {
+	return MyLogger{SugaredLogger: l.SugaredLogger.With(args...)}
+}
+
+// WithContext stores the logger of a request in ctx.
+func WithContext(ctx context.Context, l MyLogger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger stored by WithContext or fallback.
+func FromContext(ctx context.Context, fallback MyLogger) MyLogger {
+	if l, ok := ctx.Value(ctxKey{}).(MyLogger); ok {
+		return l
+	}
 
-	return MyLogger{SugaredLogger: logger.Sugar()}
+	return fallback
 }
@@ -0,0 +1,34 @@
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNew(t *testing.T) {
+	lg, err := New(Config{Level: "warn", Format: FormatJSON})
+	require.NoError(t, err)
+	assert.Equal(t, zapcore.WarnLevel, lg.Level())
+
+	lg, err = New(Config{Format: FormatConsole})
+	require.NoError(t, err)
+	assert.Equal(t, zapcore.InfoLevel, lg.Level())
+
+	_, err = New(Config{Level: "loud"})
+	assert.Error(t, err)
+
+	_, err = New(Config{Format: "xml"})
+	assert.Error(t, err)
+}
+
+func TestFromContext(t *testing.T) {
+	fallback := NewLogger()
+	reqLog := fallback.With("request_id", "abc")
+
+	assert.Equal(t, fallback, FromContext(context.Background(), fallback))
+	assert.Equal(t, reqLog, FromContext(WithContext(context.Background(), reqLog), fallback))
+}
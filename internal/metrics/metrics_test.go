@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenStorage fails GetByUser as a lost database connection would.
+type brokenStorage struct {
+	*repository.InMemoryStorage
+}
+
+func (b *brokenStorage) GetByUser(context.Context, int) ([]repository.LinkRecord, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestInstrumentStorage(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+
+	mem, err := repository.NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	storage := InstrumentStorage(&brokenStorage{InMemoryStorage: mem}, m)
+
+	require.NoError(t, storage.Create(ctx, repository.LinkRecord{ShortURL: "abc", URL: "https://example.com"}))
+	assert.Error(t, storage.Create(ctx, repository.LinkRecord{ShortURL: "abd", URL: "https://example.com"}))
+	assert.ErrorIs(t, storage.Create(ctx, repository.LinkRecord{ShortURL: "abc", URL: "https://other.example.com"}), repository.ErrShortURLTaken)
+
+	_, err = storage.BatchCreate(ctx, []repository.LinkRecord{
+		{ShortURL: "one", URL: "https://one.example.com"},
+		{ShortURL: "old", URL: "https://old.example.com", ExpiresAt: time.Now().Add(-time.Minute)},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.Get(ctx, "missing")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+
+	_, err = storage.GetByUser(ctx, 1)
+	assert.Error(t, err)
+
+	purged, err := storage.PurgeExpired(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.linksCreated))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.linksPurged))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.storageErrors.WithLabelValues("Create")), "conflict and taken short url are not faults")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.storageErrors.WithLabelValues("Get")), "not found is not a fault")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.storageErrors.WithLabelValues("GetByUser")))
+	assert.Equal(t, 5, testutil.CollectAndCount(m.storageDuration), "one series per called method")
+}
+
+func TestWatchLinks(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+
+	mem, err := repository.NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	// links created by another replica, this process never saw them
+	_, err = mem.BatchCreate(ctx, []repository.LinkRecord{
+		{ShortURL: "one", URL: "https://one.example.com", UserID: 1},
+		{ShortURL: "two", URL: "https://two.example.com", UserID: 1},
+		{ShortURL: "gone", URL: "https://gone.example.com", UserID: 1},
+	})
+	require.NoError(t, err)
+	require.NoError(t, mem.BatchDelete(ctx, []repository.LinkRecord{{ShortURL: "gone", UserID: 1}}))
+
+	m.WatchLinks(InstrumentStorage(mem, m))
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Contains(t, w.Body.String(), "shortener_links 2")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.linksCreated), "the gauge doesn't come from process counters")
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.ObserveRequest("/{id}", http.MethodGet, http.StatusTemporaryRedirect, 3*time.Millisecond)
+	m.ObserveRequest("", http.MethodGet, http.StatusNotFound, time.Millisecond)
+	m.ObserveGzip(1000, 250)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	res := w.Result()
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `shortener_http_requests_total{method="GET",route="/{id}",status="307"} 1`)
+	assert.Contains(t, string(body), `route="unmatched"`)
+	assert.Contains(t, string(body), `shortener_gzip_compression_ratio_sum 0.25`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
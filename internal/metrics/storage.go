@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instrumentedStorage measures every call of the storage it wraps.
+type instrumentedStorage struct {
+	storage repository.IStorage
+	metrics *Metrics
+}
+
+// InstrumentStorage returns storage which reports latencies
+// and faults of each IStorage method to m.
+func InstrumentStorage(storage repository.IStorage, m *Metrics) repository.IStorage {
+	return &instrumentedStorage{storage: storage, metrics: m}
+}
+
+// observe is deferred with the start time and a pointer to the result,
+// so every method measures itself in one line.
+func (s *instrumentedStorage) observe(method string, begTime time.Time, err *error) {
+	s.metrics.storageDuration.WithLabelValues(method).Observe(time.Since(begTime).Seconds())
+
+	if isFault(*err) {
+		s.metrics.storageErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// isFault tells a broken storage from answers like "no such link".
+func isFault(err error) bool {
+	var conflict *repository.ErrConflict
+
+	return err != nil &&
+		!errors.Is(err, repository.ErrNotFound) &&
+		!errors.Is(err, repository.ErrDeleted) &&
+		!errors.Is(err, repository.ErrExpired) &&
+		!errors.Is(err, repository.ErrShortURLTaken) &&
+		!errors.As(err, &conflict)
+}
+
+func (s *instrumentedStorage) Create(ctx context.Context, lnkRec repository.LinkRecord) (err error) {
+	defer s.observe("Create", time.Now(), &err)
+
+	err = s.storage.Create(ctx, lnkRec)
+
+	if err == nil {
+		s.metrics.linksCreated.Inc()
+	}
+
+	return err
+}
+
+func (s *instrumentedStorage) Get(ctx context.Context, shorturl string) (lnkRec repository.LinkRecord, err error) {
+	defer s.observe("Get", time.Now(), &err)
+
+	return s.storage.Get(ctx, shorturl)
+}
+
+func (s *instrumentedStorage) GetByURL(ctx context.Context, url string) (shorturl string, err error) {
+	defer s.observe("GetByURL", time.Now(), &err)
+
+	return s.storage.GetByURL(ctx, url)
+}
+
+func (s *instrumentedStorage) GetByUser(ctx context.Context, userID int) (lnkRecs []repository.LinkRecord, err error) {
+	defer s.observe("GetByUser", time.Now(), &err)
+
+	return s.storage.GetByUser(ctx, userID)
+}
+
+func (s *instrumentedStorage) BatchCreate(ctx context.Context, lnkRecs []repository.LinkRecord) (results []repository.BatchResult, err error) {
+	defer s.observe("BatchCreate", time.Now(), &err)
+
+	results, err = s.storage.BatchCreate(ctx, lnkRecs)
+
+	for _, v := range results {
+		if v.Status == repository.BatchCreated {
+			s.metrics.linksCreated.Inc()
+		}
+	}
+
+	return results, err
+}
+
+func (s *instrumentedStorage) BatchDelete(ctx context.Context, lnkRecs []repository.LinkRecord) (err error) {
+	defer s.observe("BatchDelete", time.Now(), &err)
+
+	return s.storage.BatchDelete(ctx, lnkRecs)
+}
+
+func (s *instrumentedStorage) PurgeExpired(ctx context.Context, now time.Time) (purged int, err error) {
+	defer s.observe("PurgeExpired", time.Now(), &err)
+
+	purged, err = s.storage.PurgeExpired(ctx, now)
+	s.metrics.linksPurged.Add(float64(purged))
+
+	return purged, err
+}
+
+func (s *instrumentedStorage) SaveClicks(ctx context.Context, clicks []repository.Click) (err error) {
+	defer s.observe("SaveClicks", time.Now(), &err)
+
+	return s.storage.SaveClicks(ctx, clicks)
+}
+
+func (s *instrumentedStorage) GetStats(ctx context.Context, shorturl string) (stats repository.LinkStats, err error) {
+	defer s.observe("GetStats", time.Now(), &err)
+
+	return s.storage.GetStats(ctx, shorturl)
+}
+
+func (s *instrumentedStorage) VisitorSalt(ctx context.Context) (salt []byte, err error) {
+	defer s.observe("VisitorSalt", time.Now(), &err)
+
+	return s.storage.VisitorSalt(ctx)
+}
+
+func (s *instrumentedStorage) ReserveCounter(ctx context.Context, n uint64) (last uint64, err error) {
+	defer s.observe("ReserveCounter", time.Now(), &err)
+
+	return s.storage.ReserveCounter(ctx, n)
+}
+
+func (s *instrumentedStorage) Ping(ctx context.Context) bool {
+	var err error
+	defer s.observe("Ping", time.Now(), &err)
+
+	if !s.storage.Ping(ctx) {
+		err = errors.New("PING FAILED")
+		return false
+	}
+
+	return true
+}
+
+func (s *instrumentedStorage) Close() error {
+	return s.storage.Close()
+}
+
+func (s *instrumentedStorage) CreateAPIKey(ctx context.Context, apiKey repository.APIKey) (err error) {
+	defer s.observe("CreateAPIKey", time.Now(), &err)
+
+	return s.storage.CreateAPIKey(ctx, apiKey)
+}
+
+func (s *instrumentedStorage) GetAPIKey(ctx context.Context, hash string) (apiKey repository.APIKey, err error) {
+	defer s.observe("GetAPIKey", time.Now(), &err)
+
+	return s.storage.GetAPIKey(ctx, hash)
+}
+
+func (s *instrumentedStorage) ListAPIKeys(ctx context.Context) (apiKeys []repository.APIKey, err error) {
+	defer s.observe("ListAPIKeys", time.Now(), &err)
+
+	return s.storage.ListAPIKeys(ctx)
+}
+
+func (s *instrumentedStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) (err error) {
+	defer s.observe("RevokeAPIKey", time.Now(), &err)
+
+	return s.storage.RevokeAPIKey(ctx, id, at)
+}
+
+func (s *instrumentedStorage) Iterate(ctx context.Context, fn func(repository.LinkRecord) error) (err error) {
+	defer s.observe("Iterate", time.Now(), &err)
+
+	return s.storage.Iterate(ctx, fn)
+}
+
+func (s *instrumentedStorage) Upsert(ctx context.Context, lnkRecs []repository.LinkRecord) (results []repository.BatchResult, err error) {
+	defer s.observe("Upsert", time.Now(), &err)
+
+	results, err = s.storage.Upsert(ctx, lnkRecs)
+
+	for _, v := range results {
+		if v.Status == repository.BatchCreated {
+			s.metrics.linksCreated.Inc()
+		}
+	}
+
+	return results, err
+}
+
+func (s *instrumentedStorage) CountLinks(ctx context.Context) (count int, err error) {
+	defer s.observe("CountLinks", time.Now(), &err)
+
+	return s.storage.CountLinks(ctx)
+}
+
+func (s *instrumentedStorage) List(ctx context.Context, q repository.ListQuery) (lnkRecs []repository.LinkRecord, err error) {
+	defer s.observe("List", time.Now(), &err)
+
+	return s.storage.List(ctx, q)
+}
+
+const (
+	linksCountTTL     = 30 * time.Second
+	linksCountTimeout = 5 * time.Second
+)
+
+// linksCollector reports how many links the storage holds, whichever
+// process created them. Some storages count by walking all links, so
+// the count is kept for linksCountTTL between scrapes.
+type linksCollector struct {
+	storage repository.IStorage
+	desc    *prometheus.Desc
+
+	mu        sync.Mutex
+	count     int
+	countedAt time.Time
+}
+
+// WatchLinks makes the metrics report the number of links in storage.
+func (m *Metrics) WatchLinks(storage repository.IStorage) {
+	m.registry.MustRegister(&linksCollector{
+		storage: storage,
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "links"),
+			"Links in the storage, deleted ones are not counted.", nil, nil),
+	})
+}
+
+func (c *linksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect reports the last count when the storage fails, and nothing
+// when it has never answered.
+func (c *linksCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.countedAt) >= linksCountTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), linksCountTimeout)
+		count, err := c.storage.CountLinks(ctx)
+
+		cancel()
+
+		if err == nil {
+			c.count, c.countedAt = count, time.Now()
+		}
+	}
+
+	if c.countedAt.IsZero() {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(c.count))
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"compress/gzip"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/DmitryM7/short-url.git/internal/logger"
@@ -19,10 +20,24 @@ type (
 	ResponseData struct {
 		Status int
 		Size   int
-		Logger logger.MyLogger
+		// GzipIn and GzipOut are sizes before and after compression.
+		GzipIn  int
+		GzipOut int
+		Logger  logger.MyLogger
+	}
+
+	countingWriter struct {
+		io.Writer
+		n int
 	}
 )
 
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	c.n += n
+	return n, err
+}
+
 func (r *CustomResponseWriter) isContentTypeNeedZip() bool {
 	needGZip := false
 
@@ -43,7 +58,8 @@ func (r *CustomResponseWriter) Write(b []byte) (int, error) {
 	)
 
 	if r.NeedGZip && r.isContentTypeNeedZip() {
-		gz, err = gzip.NewWriterLevel(r.ResponseWriter, gzip.BestSpeed)
+		out := &countingWriter{Writer: r.ResponseWriter}
+		gz, err = gzip.NewWriterLevel(out, gzip.BestSpeed)
 
 		if err != nil {
 			size = 0
@@ -51,8 +67,14 @@ func (r *CustomResponseWriter) Write(b []byte) (int, error) {
 		} else {
 			r.Logger.Debugln("DO ZIPPING")
 			size, err = gz.Write(b)
+
+			if errClose := gz.Close(); err == nil {
+				err = errClose
+			}
+
+			r.ResponseData.GzipIn += size
+			r.ResponseData.GzipOut += out.n
 		}
-		defer gz.Close()
 	} else {
 		size, err = r.ResponseWriter.Write(b)
 	}
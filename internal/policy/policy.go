@@ -0,0 +1,274 @@
+// Package policy decides which domains may be shortened and redirected to.
+//
+// Rules are read from a file, one per line:
+//
+//	# comment
+//	deny evil.com          exact host
+//	deny *.phish.net       any subdomain of phish.net
+//	deny re:^login-.*\.com$ regular expression over the host
+//	allow example.com
+//
+// Hosts of exact and subdomain rules may be written in Unicode, they are
+// compared in punycode like hosts of normalized urls. Regular expressions
+// see the punycode host.
+//
+// A host matching any deny rule is blocked. When there are allow rules,
+// a host matching none of them is blocked too.
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/urlnorm"
+)
+
+var (
+	ErrDenied     = errors.New("DOMAIN IS IN DENY LIST")
+	ErrNotAllowed = errors.New("DOMAIN IS NOT IN ALLOW LIST")
+	ErrNoHost     = errors.New("URL HAS NO HOST")
+)
+
+type (
+	rule interface {
+		match(host string) bool
+		String() string
+	}
+
+	exactRule  string
+	suffixRule string // holds ".example.com" for "*.example.com"
+	regexRule  struct{ re *regexp.Regexp }
+
+	Rules struct {
+		allow []rule
+		deny  []rule
+	}
+)
+
+func (r exactRule) match(host string) bool  { return host == string(r) }
+func (r exactRule) String() string          { return string(r) }
+func (r suffixRule) match(host string) bool { return strings.HasSuffix(host, string(r)) }
+func (r suffixRule) String() string         { return "*" + string(r) }
+func (r regexRule) match(host string) bool  { return r.re.MatchString(host) }
+func (r regexRule) String() string          { return "re:" + r.re.String() }
+
+// Parse reads rules in the format described in the package doc.
+func Parse(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		kind, pattern, ok := strings.Cut(text, " ")
+		pattern = strings.TrimSpace(pattern)
+
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("POLICY LINE %d: EXPECTED \"allow|deny PATTERN\"", line)
+		}
+
+		rl, err := parseRule(pattern)
+
+		if err != nil {
+			return nil, fmt.Errorf("POLICY LINE %d: %w", line, err)
+		}
+
+		switch strings.ToLower(kind) {
+		case "allow":
+			rules.allow = append(rules.allow, rl)
+		case "deny":
+			rules.deny = append(rules.deny, rl)
+		default:
+			return nil, fmt.Errorf("POLICY LINE %d: UNKNOWN RULE %q", line, kind)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+func parseRule(pattern string) (rule, error) {
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return regexRule{re: re}, nil
+	case strings.HasPrefix(pattern, "*."):
+		host, err := urlnorm.NormalizeHost(pattern[2:])
+
+		if err != nil {
+			return nil, fmt.Errorf("BAD HOST %q", pattern)
+		}
+
+		return suffixRule("." + host), nil
+	}
+
+	host, err := urlnorm.NormalizeHost(pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("BAD HOST %q", pattern)
+	}
+
+	return exactRule(host), nil
+}
+
+// Check returns nil when the url may be used.
+func (rs *Rules) Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+
+	if err != nil || u.Hostname() == "" {
+		return ErrNoHost
+	}
+
+	host, err := urlnorm.NormalizeHost(u.Hostname())
+
+	if err != nil {
+		return ErrNoHost
+	}
+
+	for _, v := range rs.deny {
+		if v.match(host) {
+			return fmt.Errorf("%w: %s", ErrDenied, v)
+		}
+	}
+
+	if len(rs.allow) == 0 {
+		return nil
+	}
+
+	for _, v := range rs.allow {
+		if v.match(host) {
+			return nil
+		}
+	}
+
+	return ErrNotAllowed
+}
+
+// Policy holds rules from a file and reloads them when the file changes.
+// A file which fails to parse is logged and the previous rules stay.
+type Policy struct {
+	logger  logger.MyLogger
+	path    string
+	rules   atomic.Pointer[Rules]
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Load reads the rules and checks the file for changes every reloadEvery,
+// 0 disables reloading.
+func Load(lg logger.MyLogger, path string, reloadEvery time.Duration) (*Policy, error) {
+	p := &Policy{
+		logger: lg,
+		path:   path,
+	}
+
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	if reloadEvery > 0 {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.watch(reloadEvery)
+	}
+
+	return p, nil
+}
+
+func (p *Policy) Check(rawURL string) error {
+	return p.rules.Load().Check(rawURL)
+}
+
+func (p *Policy) reload() error {
+	info, err := os.Stat(p.path)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(p.path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	rules, err := Parse(file)
+
+	if err != nil {
+		return err
+	}
+
+	p.rules.Store(rules)
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+
+	return nil
+}
+
+func (p *Policy) changed() bool {
+	info, err := os.Stat(p.path)
+
+	if err != nil {
+		p.logger.Errorln("CAN'T STAT POLICY FILE:" + err.Error())
+		return false
+	}
+
+	return !info.ModTime().Equal(p.modTime) || info.Size() != p.size
+}
+
+func (p *Policy) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(p.done)
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if !p.changed() {
+				continue
+			}
+
+			if err := p.reload(); err != nil {
+				p.logger.Errorln("CAN'T RELOAD POLICY. KEEP OLD RULES:" + err.Error())
+				continue
+			}
+
+			p.logger.Infoln("POLICY RELOADED", "path", p.path)
+		}
+	}
+}
+
+// Close stops watching the file.
+func (p *Policy) Close() {
+	if p.stop == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.done
+}
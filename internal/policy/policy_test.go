@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulesCheck(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`
+# phishing
+deny evil.com
+deny *.phish.net
+deny re:^login-[a-z]+\.com$
+deny пример.рф
+deny *.ПОДДЕЛКА.рф
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{url: "https://evil.com/path", want: ErrDenied},
+		{url: "https://EVIL.com.", want: ErrDenied},
+		{url: "https://sub.evil.com", want: nil},
+		{url: "https://a.phish.net", want: ErrDenied},
+		{url: "https://a.b.phish.net:8080", want: ErrDenied},
+		{url: "https://phish.net", want: nil},
+		{url: "http://login-bank.com", want: ErrDenied},
+		{url: "http://login-bank.com.example.org", want: nil},
+		{url: "https://practicum.yandex.ru", want: nil},
+		{url: "not a url", want: ErrNoHost},
+		{url: "https://xn--e1afmkfd.xn--p1ai/login", want: ErrDenied},
+		{url: "https://пример.рф", want: ErrDenied},
+		{url: "https://a.xn--80ahaezfrh.xn--p1ai", want: ErrDenied},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			err := rules.Check(test.url)
+
+			if test.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, test.want)
+		})
+	}
+}
+
+func TestRulesAllowList(t *testing.T) {
+	rules, err := Parse(strings.NewReader("allow example.com\nallow *.example.com\ndeny bad.example.com\n"))
+	require.NoError(t, err)
+
+	assert.NoError(t, rules.Check("https://example.com"))
+	assert.NoError(t, rules.Check("https://docs.example.com"))
+	assert.ErrorIs(t, rules.Check("https://bad.example.com"), ErrDenied, "deny wins over allow")
+	assert.ErrorIs(t, rules.Check("https://other.org"), ErrNotAllowed)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, text := range []string{"deny", "block evil.com", "deny re:[a-", "deny xn--zz"} {
+		_, err := Parse(strings.NewReader(text))
+		assert.Error(t, err, text)
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.txt")
+	require.NoError(t, os.WriteFile(path, []byte("deny evil.com\n"), 0o600))
+
+	p, err := Load(logger.NewLogger(), path, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer p.Close()
+
+	assert.ErrorIs(t, p.Check("https://evil.com"), ErrDenied)
+	assert.NoError(t, p.Check("https://later.com"))
+
+	require.NoError(t, os.WriteFile(path, []byte("deny evil.com\ndeny later.com\n"), 0o600))
+
+	assert.Eventually(t, func() bool {
+		return p.Check("https://later.com") != nil
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(path, []byte("broken rule\n"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+
+	assert.ErrorIs(t, p.Check("https://later.com"), ErrDenied, "broken file keeps old rules")
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := Load(logger.NewLogger(), filepath.Join(t.TempDir(), "none"), 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	per    time.Duration
+}
+
+// MemoryStore keeps buckets of one process. Buckets which are full
+// again are dropped from time to time, so idle clients cost nothing.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (m *MemoryStore) Take(_ context.Context, key string, limit Limit, n int) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	if now.Sub(m.lastSweep) > sweepInterval {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = limit.refill(b.tokens, now.Sub(b.last))
+	b.last = now
+	b.per = limit.Per
+
+	allowed := b.tokens >= float64(n)
+
+	if allowed {
+		b.tokens -= float64(n)
+	}
+
+	return limit.result(b.tokens, n, allowed), nil
+}
+
+// sweep drops buckets which had time to become full, must be called with mu held.
+func (m *MemoryStore) sweep(now time.Time) {
+	for k, v := range m.buckets {
+		if now.Sub(v.last) > v.per {
+			delete(m.buckets, k)
+		}
+	}
+
+	m.lastSweep = now
+}
@@ -0,0 +1,127 @@
+// Package ratelimit counts requests of clients with token buckets.
+//
+// A bucket of Limit{Burst: 60, Per: time.Minute} holds up to 60 tokens
+// and gets one back every second, so a client can make 60 requests at
+// once and then one request per second.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBadLimit = errors.New(`LIMIT MUST LOOK LIKE "60/m", "1000/h" OR "10/30s"`)
+
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Result of taking tokens from a bucket.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long to wait until the request fits in the bucket.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store keeps buckets. Take removes n tokens from the bucket under key
+// if it has them, a bucket seen the first time is full.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, n int) (Result, error)
+}
+
+// ParseLimit reads "N/period" where period is s, m, h or a duration
+// like 30s. Empty string and "0" mean no limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+
+	count, period, ok := strings.Cut(s, "/")
+
+	if !ok {
+		return Limit{}, ErrBadLimit
+	}
+
+	burst, err := strconv.Atoi(count)
+
+	if err != nil || burst < 0 {
+		return Limit{}, ErrBadLimit
+	}
+
+	var per time.Duration
+
+	switch period {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		if per, err = time.ParseDuration(period); err != nil || per <= 0 {
+			return Limit{}, ErrBadLimit
+		}
+	}
+
+	return Limit{Burst: burst, Per: per}, nil
+}
+
+func (l Limit) Enabled() bool {
+	return l.Burst > 0 && l.Per > 0
+}
+
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "0"
+	}
+
+	return fmt.Sprintf("%d/%s", l.Burst, l.Per)
+}
+
+// perSecond is how many tokens come back to the bucket in a second.
+func (l Limit) perSecond() float64 {
+	return float64(l.Burst) / l.Per.Seconds()
+}
+
+// refill returns tokens the bucket has after elapsed time.
+func (l Limit) refill(tokens float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return tokens
+	}
+
+	return math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.perSecond())
+}
+
+// result describes a bucket with tokens left after it was asked for n.
+func (l Limit) result(tokens float64, n int, allowed bool) Result {
+	res := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(l.Burst) - tokens) / l.perSecond()),
+	}
+
+	if !allowed {
+		res.RetryAfter = seconds((float64(n) - tokens) / l.perSecond())
+	}
+
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+
+	return time.Duration(s * float64(time.Second))
+}
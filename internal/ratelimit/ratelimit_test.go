@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+		err  bool
+	}{
+		{in: "", want: Limit{}},
+		{in: "0", want: Limit{}},
+		{in: "60/m", want: Limit{Burst: 60, Per: time.Minute}},
+		{in: "5/s", want: Limit{Burst: 5, Per: time.Second}},
+		{in: "1000/h", want: Limit{Burst: 1000, Per: time.Hour}},
+		{in: "10/30s", want: Limit{Burst: 10, Per: 30 * time.Second}},
+		{in: "60", err: true},
+		{in: "x/m", err: true},
+		{in: "10/week", err: true},
+		{in: "-1/m", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseLimit(test.in)
+
+		if test.err {
+			assert.ErrorIs(t, err, ErrBadLimit, test.in)
+			continue
+		}
+
+		require.NoError(t, err, test.in)
+		assert.Equal(t, test.want, got, test.in)
+	}
+}
+
+// fakeClock lets tests move time of both stores.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func testStore(t *testing.T, store Store, clock *fakeClock) {
+	ctx := context.Background()
+	limit := Limit{Burst: 3, Per: 3 * time.Second}
+
+	for i := 2; i >= 0; i-- {
+		res, err := store.Take(ctx, "create:ip:10.0.0.1", limit, 1)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+
+	res, err := store.Take(ctx, "create:ip:10.0.0.1", limit, 1)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+
+	res, err = store.Take(ctx, "create:ip:10.0.0.2", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed, "other clients have own buckets")
+
+	clock.t = clock.t.Add(time.Second)
+
+	res, err = store.Take(ctx, "create:ip:10.0.0.1", limit, 2)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed, "one token came back, two are asked")
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	res, err = store.Take(ctx, "create:ip:10.0.0.1", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+
+	clock.t = clock.t.Add(time.Hour)
+
+	res, err = store.Take(ctx, "create:ip:10.0.0.1", limit, 3)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed, "bucket is full again, not overfull")
+	assert.Equal(t, 0, res.Remaining)
+}
+
+func TestMemoryStore(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	store := NewMemoryStore()
+	store.now = clock.now
+
+	testStore(t, store, clock)
+
+	clock.t = clock.t.Add(2 * sweepInterval)
+	_, err := store.Take(context.Background(), "other", Limit{Burst: 1, Per: time.Second}, 1)
+	require.NoError(t, err)
+	assert.Len(t, store.buckets, 1, "full buckets are swept")
+}
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	store, err := NewRedisStore(mr.Addr())
+	require.NoError(t, err)
+	defer store.Close()
+
+	clock := &fakeClock{t: time.Now()}
+	store.now = clock.now
+
+	testStore(t, store, clock)
+
+	assert.True(t, mr.Exists(redisPrefix+"create:ip:10.0.0.1"))
+	mr.FastForward(4 * time.Second)
+	assert.False(t, mr.Exists(redisPrefix+"create:ip:10.0.0.1"), "idle buckets expire")
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisPrefix = "shortener:ratelimit:"
+
+// takeScript refills and takes tokens in one step, so replicas sharing
+// the bucket never give away the same token twice.
+var takeScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local per_ms = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+
+if tokens == nil then
+	tokens = burst
+	ts = now
+end
+
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * burst / per_ms)
+	ts = now
+end
+
+local allowed = 0
+
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], per_ms)
+
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStore keeps buckets in redis, so all replicas share them.
+type RedisStore struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+// NewRedisStore connects to addr given as host:port or redis:// url.
+func NewRedisStore(addr string) (*RedisStore, error) {
+	opts := &redis.Options{Addr: addr}
+
+	if strings.Contains(addr, "://") {
+		var err error
+
+		opts, err = redis.ParseURL(addr)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := redis.NewClient(opts)
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &RedisStore{client: client, now: time.Now}, nil
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit, n int) (Result, error) {
+	reply, err := takeScript.Run(ctx, s.client, []string{redisPrefix + key},
+		limit.Burst, limit.Per.Milliseconds(), s.now().UnixMilli(), n).Slice()
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	allowed, _ := reply[0].(int64)
+	left, _ := reply[1].(string)
+
+	tokens, err := strconv.ParseFloat(left, 64)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	return limit.result(tokens, n, allowed == 1), nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,25 @@
+package repository
+
+import (
+	"regexp"
+	"strings"
+)
+
+var aliasRe = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// reservedAliases are the first path segments of server routes,
+// a link with such alias would be unreachable.
+var reservedAliases = map[string]bool{
+	"api":     true,
+	"metrics": true,
+	"ping":    true,
+	"tst":     true,
+}
+
+func ValidateAlias(alias string) error {
+	if !aliasRe.MatchString(alias) || reservedAliases[strings.ToLower(alias)] {
+		return ErrInvalidAlias
+	}
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Scope string
+
+const (
+	ScopeCreate    Scope = "create"
+	ScopeReadStats Scope = "read-stats"
+	ScopeDelete    Scope = "delete"
+	ScopeAdmin     Scope = "admin"
+
+	apiKeyPrefix = "shk_"
+)
+
+var (
+	ErrAPIKeyInvalid = errors.New("API KEY IS INVALID OR REVOKED")
+	ErrBadScope      = errors.New("SCOPE MUST BE create, read-stats, delete OR admin")
+)
+
+// APIKey lets a service call the API. Only the hash of the key is kept,
+// the key itself is shown once when it is created.
+type APIKey struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Hash   string  `json:"hash"`
+	Scopes []Scope `json:"scopes"`
+	// UserID owns links created with the key.
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// Allows reports whether the key may be used for scope,
+// admin may do everything.
+func (k APIKey) Allows(scope Scope) bool {
+	for _, v := range k.Scopes {
+		if v == scope || v == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k APIKey) IsRevoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// ParseScopes reads a comma separated list like "create,read-stats".
+func ParseScopes(s string) ([]Scope, error) {
+	scopes := []Scope{}
+
+	for _, v := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(v))
+
+		switch scope {
+		case ScopeCreate, ScopeReadStats, ScopeDelete, ScopeAdmin:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrBadScope, scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+func joinScopes(scopes []Scope) string {
+	s := make([]string, len(scopes))
+
+	for k, v := range scopes {
+		s[k] = string(v)
+	}
+
+	return strings.Join(s, ",")
+}
+
+// splitScopes reads scopes written by joinScopes.
+func splitScopes(s string) []Scope {
+	scopes := []Scope{}
+
+	if s == "" {
+		return scopes
+	}
+
+	for _, v := range strings.Split(s, ",") {
+		scopes = append(scopes, Scope(v))
+	}
+
+	return scopes
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// newAPIKey returns the secret key and its record to be saved.
+func newAPIKey(name string, scopes []Scope, now time.Time) (string, APIKey, error) {
+	id, err := randomHex(6)
+
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	secret, err := randomHex(32)
+
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	userID, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	key := apiKeyPrefix + secret
+
+	return key, APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      HashAPIKey(key),
+		Scopes:    scopes,
+		UserID:    int(userID.Int64()) + 1,
+		CreatedAt: now.UTC(),
+	}, nil
+}
+
+// CreateAPIKey saves a new key and returns it, the key can't be
+// read from the storage later.
+func (s *StorageService) CreateAPIKey(ctx context.Context, name string, scopes []Scope) (string, APIKey, error) {
+	if len(scopes) == 0 {
+		return "", APIKey{}, ErrBadScope
+	}
+
+	key, apiKey, err := newAPIKey(name, scopes, time.Now())
+
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	ctx, cancel := s.writeCtx(ctx)
+	defer cancel()
+
+	return key, apiKey, s.storage.CreateAPIKey(ctx, apiKey)
+}
+
+// Authenticate returns the record of a valid key
+// or ErrAPIKeyInvalid for an unknown or revoked one.
+func (s *StorageService) Authenticate(ctx context.Context, key string) (APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	apiKey, err := s.storage.GetAPIKey(ctx, HashAPIKey(key))
+
+	if errors.Is(err, ErrNotFound) || (err == nil && apiKey.IsRevoked()) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+
+	return apiKey, err
+}
+
+func (s *StorageService) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	return s.storage.ListAPIKeys(ctx)
+}
+
+func (s *StorageService) RevokeAPIKey(ctx context.Context, id string) error {
+	ctx, cancel := s.writeCtx(ctx)
+	defer cancel()
+
+	return s.storage.RevokeAPIKey(ctx, id, time.Now().UTC())
+}
+
+// apiKeyStore keeps keys in memory for InMemoryStorage and InFileStorage.
+type apiKeyStore struct {
+	mu     sync.RWMutex
+	byID   map[string]APIKey
+	byHash map[string]string
+}
+
+func newAPIKeyStore() *apiKeyStore {
+	return &apiKeyStore{
+		byID:   map[string]APIKey{},
+		byHash: map[string]string{},
+	}
+}
+
+func (s *apiKeyStore) put(apiKey APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byID[apiKey.ID] = apiKey
+	s.byHash[apiKey.Hash] = apiKey.ID
+}
+
+// replace drops all keys and puts apiKeys instead.
+func (s *apiKeyStore) replace(apiKeys []APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byID = make(map[string]APIKey, len(apiKeys))
+	s.byHash = make(map[string]string, len(apiKeys))
+
+	for _, v := range apiKeys {
+		s.byID[v.ID] = v
+		s.byHash[v.Hash] = v.ID
+	}
+}
+
+func (s *apiKeyStore) get(hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.byHash[hash]
+
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+
+	return s.byID[id], nil
+}
+
+// all returns keys from the oldest one.
+func (s *apiKeyStore) all() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	apiKeys := make([]APIKey, 0, len(s.byID))
+
+	for _, v := range s.byID {
+		apiKeys = append(apiKeys, v)
+	}
+
+	sortAPIKeys(apiKeys)
+
+	return apiKeys
+}
+
+func (s *apiKeyStore) revoke(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apiKey, ok := s.byID[id]
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	if !apiKey.IsRevoked() {
+		apiKey.RevokedAt = at
+		s.byID[id] = apiKey
+	}
+
+	return nil
+}
+
+func sortAPIKeys(apiKeys []APIKey) {
+	sort.Slice(apiKeys, func(i, j int) bool {
+		if apiKeys[i].CreatedAt.Equal(apiKeys[j].CreatedAt) {
+			return apiKeys[i].ID < apiKeys[j].ID
+		}
+		return apiKeys[i].CreatedAt.Before(apiKeys[j].CreatedAt)
+	})
+}
@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("create, read-stats")
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeCreate, ScopeReadStats}, scopes)
+
+	_, err = ParseScopes("create,everything")
+	assert.ErrorIs(t, err, ErrBadScope)
+
+	apiKey := APIKey{Scopes: []Scope{ScopeCreate}}
+	assert.True(t, apiKey.Allows(ScopeCreate))
+	assert.False(t, apiKey.Allows(ScopeDelete))
+	assert.True(t, APIKey{Scopes: []Scope{ScopeAdmin}}.Allows(ScopeDelete))
+}
+
+func TestAPIKeysOnEveryBackend(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: MemType},
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			ctx := context.Background()
+
+			key, created, err := s.CreateAPIKey(ctx, "ci", []Scope{ScopeCreate, ScopeReadStats})
+			require.NoError(t, err)
+			assert.NotContains(t, created.Hash, key, "only the hash of the key is kept")
+
+			apiKey, err := s.Authenticate(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, created.ID, apiKey.ID)
+			assert.Equal(t, created.UserID, apiKey.UserID)
+			assert.Equal(t, []Scope{ScopeCreate, ScopeReadStats}, apiKey.Scopes)
+
+			_, err = s.Authenticate(ctx, key+"0")
+			assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+
+			_, err = s.Authenticate(ctx, "not-a-key")
+			assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+
+			apiKeys, err := s.ListAPIKeys(ctx)
+			require.NoError(t, err)
+			require.Len(t, apiKeys, 1)
+			assert.Equal(t, "ci", apiKeys[0].Name)
+			assert.False(t, apiKeys[0].IsRevoked())
+
+			require.NoError(t, s.RevokeAPIKey(ctx, created.ID))
+			assert.ErrorIs(t, s.RevokeAPIKey(ctx, "missing"), ErrNotFound)
+
+			_, err = s.Authenticate(ctx, key)
+			assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+
+			apiKeys, err = s.ListAPIKeys(ctx)
+			require.NoError(t, err)
+			require.Len(t, apiKeys, 1)
+			assert.True(t, apiKeys[0].IsRevoked())
+		})
+	}
+}
+
+func TestInFileStorageKeepsAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+
+	r := openFileStorage(t, path)
+	key, apiKey, err := newAPIKey("ci", []Scope{ScopeAdmin}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, r.CreateAPIKey(ctx, apiKey))
+	require.NoError(t, r.Close())
+
+	r = openFileStorage(t, path)
+	defer r.Close()
+
+	got, err := r.GetAPIKey(ctx, HashAPIKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, apiKey.ID, got.ID)
+	assert.Equal(t, []Scope{ScopeAdmin}, got.Scopes)
+}
+
+func TestInFileStorageSeesKeysOfAnotherProcess(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+
+	server := openFileStorage(t, path)
+	key, apiKey, err := newAPIKey("ci", []Scope{ScopeCreate}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, server.CreateAPIKey(ctx, apiKey))
+
+	// the CLI next to the running server
+	cli := openFileStorage(t, path)
+	require.NoError(t, cli.RevokeAPIKey(ctx, apiKey.ID, time.Now()))
+
+	otherKey, other, err := newAPIKey("web", []Scope{ScopeCreate}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, cli.CreateAPIKey(ctx, other))
+	require.NoError(t, cli.Close())
+
+	got, err := server.GetAPIKey(ctx, HashAPIKey(key))
+	require.NoError(t, err)
+	assert.True(t, got.IsRevoked(), "revoke of the CLI must reach the server")
+
+	_, err = server.GetAPIKey(ctx, HashAPIKey(otherKey))
+	assert.NoError(t, err)
+
+	_, third, err := newAPIKey("bot", []Scope{ScopeCreate}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, server.CreateAPIKey(ctx, third))
+
+	apiKeys, err := openFileStorage(t, path).ListAPIKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, apiKeys, 3, "server must not overwrite keys it hasn't read")
+	assert.True(t, apiKeys[0].IsRevoked())
+}
@@ -0,0 +1,29 @@
+package repository
+
+import "errors"
+
+type BatchStatus string
+
+const (
+	BatchCreated  BatchStatus = "created"
+	BatchExisting BatchStatus = "existing"
+	BatchInvalid  BatchStatus = "invalid"
+	// statuses of Upsert
+	BatchUpdated   BatchStatus = "updated"
+	BatchUnchanged BatchStatus = "unchanged"
+)
+
+// BatchResult is what happened to one link of a batch. For an existing url
+// ShortURL holds the code it already has, for an invalid link Err says why.
+type BatchResult struct {
+	LinkRecord
+	Status BatchStatus
+	Err    error
+}
+
+// isInvalidLink tells errors of a single link, which fail only this link
+// of a batch, from storage faults, which fail the whole batch.
+func isInvalidLink(err error) bool {
+	return errors.Is(err, ErrInvalidAlias) || errors.Is(err, ErrAliasTaken) || errors.Is(err, ErrCollision) ||
+		errors.Is(err, ErrBlocked)
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// cachedStorage answers Get and GetByURL from memory, misses are kept too,
+// so probing random codes does not reach the storage. Writes made through
+// the cache drop the entries they touch, writes of other replicas are
+// seen when entries expire.
+type cachedStorage struct {
+	IStorage
+
+	links *expirable.LRU[string, LinkRecord]
+	urls  *expirable.LRU[string, string]
+	// missing links and urls live shorter than found ones
+	missingLinks *expirable.LRU[string, struct{}]
+	missingURLs  *expirable.LRU[string, struct{}]
+
+	// gen grows on every invalidation. A read which started before it
+	// must not put what it has read into the cache.
+	mu  sync.Mutex
+	gen uint64
+}
+
+// NewCachedStorage puts an LRU cache of size entries in front of storage.
+// missTTL is how long a miss is remembered, zero disables caching of misses.
+func NewCachedStorage(storage IStorage, size int, ttl, missTTL time.Duration) IStorage {
+	c := &cachedStorage{
+		IStorage: storage,
+		links:    expirable.NewLRU[string, LinkRecord](size, nil, ttl),
+		urls:     expirable.NewLRU[string, string](size, nil, ttl),
+	}
+
+	if missTTL > 0 {
+		c.missingLinks = expirable.NewLRU[string, struct{}](size, nil, missTTL)
+		c.missingURLs = expirable.NewLRU[string, struct{}](size, nil, missTTL)
+	}
+
+	return c
+}
+
+func (c *cachedStorage) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// remember runs add unless the cache was invalidated since gen.
+func (c *cachedStorage) remember(gen uint64, add func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen == gen {
+		add()
+	}
+}
+
+func (c *cachedStorage) invalidate(shortURLs, urls []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for _, v := range shortURLs {
+		c.links.Remove(v)
+
+		if c.missingLinks != nil {
+			c.missingLinks.Remove(v)
+		}
+	}
+
+	for _, v := range urls {
+		c.urls.Remove(v)
+
+		if c.missingURLs != nil {
+			c.missingURLs.Remove(v)
+		}
+	}
+}
+
+func (c *cachedStorage) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.links.Purge()
+	c.urls.Purge()
+
+	if c.missingLinks != nil {
+		c.missingLinks.Purge()
+		c.missingURLs.Purge()
+	}
+}
+
+func (c *cachedStorage) purgeURLs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.urls.Purge()
+}
+
+func (c *cachedStorage) Get(ctx context.Context, shorturl string) (LinkRecord, error) {
+	if lnkRec, ok := c.links.Get(shorturl); ok {
+		return lnkRec, nil
+	}
+
+	if c.missingLinks != nil && c.missingLinks.Contains(shorturl) {
+		return LinkRecord{}, ErrNotFound
+	}
+
+	gen := c.generation()
+	lnkRec, err := c.IStorage.Get(ctx, shorturl)
+
+	switch {
+	case err == nil:
+		c.remember(gen, func() { c.links.Add(shorturl, lnkRec) })
+	case errors.Is(err, ErrNotFound) && c.missingLinks != nil:
+		c.remember(gen, func() { c.missingLinks.Add(shorturl, struct{}{}) })
+	}
+
+	return lnkRec, err
+}
+
+func (c *cachedStorage) GetByURL(ctx context.Context, url string) (string, error) {
+	if shorturl, ok := c.urls.Get(url); ok {
+		return shorturl, nil
+	}
+
+	if c.missingURLs != nil && c.missingURLs.Contains(url) {
+		return "", ErrNotFound
+	}
+
+	gen := c.generation()
+	shorturl, err := c.IStorage.GetByURL(ctx, url)
+
+	switch {
+	case err == nil:
+		c.remember(gen, func() { c.urls.Add(url, shorturl) })
+	case errors.Is(err, ErrNotFound) && c.missingURLs != nil:
+		c.remember(gen, func() { c.missingURLs.Add(url, struct{}{}) })
+	}
+
+	return shorturl, err
+}
+
+func (c *cachedStorage) Create(ctx context.Context, lnkRec LinkRecord) error {
+	defer c.invalidate([]string{lnkRec.ShortURL}, []string{lnkRec.URL})
+
+	return c.IStorage.Create(ctx, lnkRec)
+}
+
+func (c *cachedStorage) BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	shortURLs := make([]string, len(lnkRecs))
+	urls := make([]string, len(lnkRecs))
+
+	for k, v := range lnkRecs {
+		shortURLs[k] = v.ShortURL
+		urls[k] = v.URL
+	}
+
+	defer c.invalidate(shortURLs, urls)
+
+	return c.IStorage.BatchCreate(ctx, lnkRecs)
+}
+
+// BatchDelete drops all cached urls, deleted links free their urls
+// and the batch does not tell which ones.
+func (c *cachedStorage) BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error {
+	shortURLs := make([]string, len(lnkRecs))
+
+	for k, v := range lnkRecs {
+		shortURLs[k] = v.ShortURL
+	}
+
+	defer c.purgeURLs()
+	defer c.invalidate(shortURLs, nil)
+
+	return c.IStorage.BatchDelete(ctx, lnkRecs)
+}
+
+// PurgeExpired drops the whole cache when links were purged,
+// the storage does not tell which ones.
+func (c *cachedStorage) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	n, err := c.IStorage.PurgeExpired(ctx, now)
+
+	if n > 0 {
+		c.purge()
+	}
+
+	return n, err
+}
+
+// Upsert drops the whole cache, links may move to other urls
+// and imports are rare.
+func (c *cachedStorage) Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	defer c.purge()
+
+	return c.IStorage.Upsert(ctx, lnkRecs)
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage counts reads which reach the storage.
+type countingStorage struct {
+	*InMemoryStorage
+	gets      atomic.Int32
+	getsByURL atomic.Int32
+	afterRead func()
+}
+
+func (c *countingStorage) Get(ctx context.Context, shorturl string) (LinkRecord, error) {
+	c.gets.Add(1)
+	lnkRec, err := c.InMemoryStorage.Get(ctx, shorturl)
+
+	if c.afterRead != nil {
+		c.afterRead()
+	}
+
+	return lnkRec, err
+}
+
+func (c *countingStorage) GetByURL(ctx context.Context, url string) (string, error) {
+	c.getsByURL.Add(1)
+	return c.InMemoryStorage.GetByURL(ctx, url)
+}
+
+func newCountingStorage(t *testing.T) *countingStorage {
+	t.Helper()
+
+	mem, err := NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	return &countingStorage{InMemoryStorage: mem}
+}
+
+func TestCachedStorage(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStorage(t)
+	cache := NewCachedStorage(backend, 100, time.Minute, time.Minute)
+
+	_, err := cache.Get(ctx, "abc")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = cache.Get(ctx, "abc")
+	require.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(1), backend.gets.Load(), "miss is cached")
+
+	_, err = cache.GetByURL(ctx, "https://example.com")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, cache.Create(ctx, LinkRecord{ShortURL: "abc", URL: "https://example.com", UserID: 1}))
+
+	lnkRec, err := cache.Get(ctx, "abc")
+	require.NoError(t, err, "create drops the cached miss")
+	assert.Equal(t, "https://example.com", lnkRec.URL)
+
+	shorturl, err := cache.GetByURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", shorturl)
+
+	for i := 0; i < 3; i++ {
+		_, err = cache.Get(ctx, "abc")
+		require.NoError(t, err)
+		_, err = cache.GetByURL(ctx, "https://example.com")
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(2), backend.gets.Load())
+	assert.Equal(t, int32(2), backend.getsByURL.Load())
+
+	require.NoError(t, cache.BatchDelete(ctx, []LinkRecord{{ShortURL: "abc", UserID: 1}}))
+
+	lnkRec, err = cache.Get(ctx, "abc")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.IsDeleted, "delete drops the cached link")
+}
+
+func TestCachedStorageExpires(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStorage(t)
+	cache := NewCachedStorage(backend, 100, 50*time.Millisecond, 0)
+
+	require.NoError(t, backend.Create(ctx, LinkRecord{ShortURL: "abc", URL: "https://example.com"}))
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.Get(ctx, "abc")
+		require.NoError(t, err)
+		_, err = cache.Get(ctx, "missing")
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+
+	assert.Equal(t, int32(3), backend.gets.Load(), "misses are not cached with zero miss ttl")
+
+	assert.Eventually(t, func() bool {
+		_, err := cache.Get(ctx, "abc")
+		return err == nil && backend.gets.Load() > 3
+	}, time.Second, 20*time.Millisecond)
+}
+
+func TestCachedStorageSkipsReadRacingWrite(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStorage(t)
+	cache := NewCachedStorage(backend, 100, time.Minute, time.Minute)
+
+	// the link is created while the miss is on its way back
+	backend.afterRead = func() {
+		backend.afterRead = nil
+		require.NoError(t, cache.Create(ctx, LinkRecord{ShortURL: "abc", URL: "https://example.com"}))
+	}
+
+	_, err := cache.Get(ctx, "abc")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	lnkRec, err := cache.Get(ctx, "abc")
+	require.NoError(t, err, "the stale miss is not cached")
+	assert.Equal(t, "https://example.com", lnkRec.URL)
+}
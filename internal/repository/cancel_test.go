@@ -0,0 +1,36 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/DmitryM7/short-url.git/internal/repository/repotest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelledContextCancelsStorageCall(t *testing.T) {
+	s, storage := repotest.NewBlockingService(t, repository.StorageConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := s.Get(ctx, "anything")
+		done <- err
+	}()
+
+	cancel()
+
+	assert.ErrorIs(t, storage.Cancelled(t), context.Canceled)
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestReadTimeoutCancelsStorageCall(t *testing.T) {
+	s, storage := repotest.NewBlockingService(t, repository.StorageConfig{ReadTimeout: 50 * time.Millisecond})
+
+	_, err := s.Get(context.Background(), "anything")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, storage.Cancelled(t), context.DeadlineExceeded)
+}
@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	// rawClicksPerLink caps the list of raw clicks Redis keeps for a link
+	rawClicksPerLink = 10000
+	statsDayFmt      = "2006-01-02"
+	statsHourFmt     = "2006-01-02 15:00"
+)
+
+type Click struct {
+	ShortURL  string    `json:"short_url"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer"`
+	UserAgent string    `json:"user_agent"`
+	IPHash    string    `json:"ip_hash"`
+}
+
+type LinkStats struct {
+	TotalClicks int
+	// UniqueVisitors is exact on Postgres and SQLite, which count distinct
+	// ip hashes of the raw clicks. Memory, file and Redis estimate it with
+	// a HyperLogLog, so there it may be off by a few percent.
+	UniqueVisitors int
+	ByDay          map[string]int
+	ByHour         map[string]int
+}
+
+func newLinkStats() LinkStats {
+	return LinkStats{
+		ByDay:  map[string]int{},
+		ByHour: map[string]int{},
+	}
+}
+
+// clickCounters keeps stats of every link for the storages which have
+// no place for raw clicks, the way Redis keeps its counters. The memory
+// storage keeps nothing but these counters, and the file storage keeps
+// raw clicks only in its log until the next compaction. Raw clicks are
+// kept for good by the database storages and, up to rawClicksPerLink,
+// by Redis. Visitors are estimated by a sketch of fixed size, so a
+// popular link costs no more memory than a quiet one.
+type clickCounters struct {
+	mu    sync.RWMutex
+	links map[string]*linkCounters
+}
+
+type linkCounters struct {
+	Total    int            `json:"total"`
+	Visitors visitorSketch  `json:"visitor_sketch"`
+	ByDay    map[string]int `json:"by_day"`
+	ByHour   map[string]int `json:"by_hour"`
+}
+
+// clickSnapshot is how InFileStorage saves the counters. Gen is the
+// generation of the click log which goes on from them.
+type clickSnapshot struct {
+	Gen   int                      `json:"gen"`
+	Links map[string]*linkCounters `json:"links"`
+}
+
+func newClickCounters() *clickCounters {
+	return &clickCounters{links: map[string]*linkCounters{}}
+}
+
+func newLinkCounters() *linkCounters {
+	return &linkCounters{Visitors: newVisitorSketch(), ByDay: map[string]int{}, ByHour: map[string]int{}}
+}
+
+func (c *clickCounters) add(clicks ...Click) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, v := range clicks {
+		lc, ok := c.links[v.ShortURL]
+
+		if !ok {
+			lc = newLinkCounters()
+			c.links[v.ShortURL] = lc
+		}
+
+		t := v.Time.UTC()
+		lc.Total++
+		lc.Visitors.add(v.IPHash)
+		lc.ByDay[t.Format(statsDayFmt)]++
+		lc.ByHour[t.Format(statsHourFmt)]++
+	}
+}
+
+func (c *clickCounters) stats(shorturl string) LinkStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := newLinkStats()
+	lc, ok := c.links[shorturl]
+
+	if !ok {
+		return stats
+	}
+
+	stats.TotalClicks = lc.Total
+	stats.UniqueVisitors = lc.Visitors.count()
+
+	for k, v := range lc.ByDay {
+		stats.ByDay[k] = v
+	}
+
+	for k, v := range lc.ByHour {
+		stats.ByHour[k] = v
+	}
+
+	return stats
+}
+
+func (c *clickCounters) marshal(gen int) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return json.Marshal(clickSnapshot{Gen: gen, Links: c.links})
+}
+
+// unmarshal reads a snapshot and returns its generation. Counters of
+// older versions kept visitors as a set, they are put into sketches.
+func (c *clickCounters) unmarshal(buffer []byte) (int, error) {
+	snapshot := clickSnapshot{}
+
+	if err := json.Unmarshal(buffer, &snapshot); err != nil || snapshot.Links == nil {
+		legacy := map[string]*struct {
+			linkCounters
+			Visitors map[string]bool `json:"visitors"`
+		}{}
+
+		if err := json.Unmarshal(buffer, &legacy); err != nil {
+			return 0, err
+		}
+
+		snapshot.Links = make(map[string]*linkCounters, len(legacy))
+
+		for k, v := range legacy {
+			v.linkCounters.Visitors = newVisitorSketch()
+
+			for ipHash := range v.Visitors {
+				v.linkCounters.Visitors.add(ipHash)
+			}
+
+			snapshot.Links[k] = &v.linkCounters
+		}
+	}
+
+	for _, v := range snapshot.Links {
+		if len(v.Visitors) != visitorRegisters {
+			v.Visitors = newVisitorSketch()
+		}
+
+		if v.ByDay == nil {
+			v.ByDay = map[string]int{}
+		}
+
+		if v.ByHour == nil {
+			v.ByHour = map[string]int{}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.links = snapshot.Links
+
+	return snapshot.Gen, nil
+}
+
+const (
+	visitorSaltLength  = 32
+	visitorSaltSetting = "visitor_salt"
+)
+
+func newVisitorSalt() ([]byte, error) {
+	salt := make([]byte, visitorSaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// visitorRegisters is the size of a visitor sketch, a HyperLogLog which
+// counts any number of visitors within about 3%.
+const visitorRegisters = 1 << visitorBits
+
+const visitorBits = 10
+
+type visitorSketch []byte
+
+func newVisitorSketch() visitorSketch {
+	return make(visitorSketch, visitorRegisters)
+}
+
+func (s visitorSketch) add(ipHash string) {
+	h := fnv.New64a()
+	h.Write([]byte(ipHash))
+	x := h.Sum64()
+
+	// fnv spreads short keys poorly over the high bits, so they are
+	// mixed the way murmur3 finishes its hash
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	// the first bits choose a register, it keeps the longest run
+	// of zeros seen in the rest
+	rank := byte(bits.LeadingZeros64(x<<visitorBits|1<<(visitorBits-1))) + 1
+
+	if i := x >> (64 - visitorBits); s[i] < rank {
+		s[i] = rank
+	}
+}
+
+func (s visitorSketch) count() int {
+	const m = float64(visitorRegisters)
+
+	sum, zeros := 0.0, 0
+
+	for _, v := range s {
+		sum += math.Ldexp(1, -int(v))
+
+		if v == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// few visitors are counted by empty registers, that is exact enough
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int(math.Round(estimate))
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVisitorSketch(t *testing.T) {
+	tests := []int{0, 1, 2, 100, 10000, 100000}
+
+	for _, visitors := range tests {
+		t.Run(strconv.Itoa(visitors), func(t *testing.T) {
+			c := newClickCounters()
+
+			for i := 0; i < visitors; i++ {
+				c.add(Click{ShortURL: "busy", IPHash: strconv.Itoa(i)}, Click{ShortURL: "busy", IPHash: strconv.Itoa(i)})
+			}
+
+			stats := c.stats("busy")
+			assert.Equal(t, 2*visitors, stats.TotalClicks)
+			assert.InDelta(t, visitors, stats.UniqueVisitors, float64(visitors)*0.1)
+
+			if visitors > 0 {
+				assert.Len(t, c.links["busy"].Visitors, visitorRegisters, "memory doesn't grow with visitors")
+			}
+		})
+	}
+}
+
+func TestClickCountersReadOldVisitors(t *testing.T) {
+	c := newClickCounters()
+
+	gen, err := c.unmarshal([]byte(`{"busy":{"total":3,"visitors":{"a":true,"b":true},"by_day":{"2024-05-01":3}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, gen)
+
+	stats := c.stats("busy")
+	assert.Equal(t, 3, stats.TotalClicks)
+	assert.Equal(t, 2, stats.UniqueVisitors)
+	assert.Equal(t, map[string]int{"2024-05-01": 3}, stats.ByDay)
+}
@@ -0,0 +1,28 @@
+package repository
+
+import "errors"
+
+var (
+	ErrNotFound       = errors.New("LINK NOT FOUND")
+	ErrDeleted        = errors.New("LINK WAS DELETED")
+	ErrExpired        = errors.New("LINK IS EXPIRED")
+	ErrCollision      = errors.New("CAN'T GENERATE UNIQUE SHORT URL")
+	ErrInvalidAlias   = errors.New("ALIAS MUST BE 3-64 CHARS OF LATIN LETTERS, DIGITS, '-' OR '_' AND NOT A RESERVED WORD")
+	ErrAliasTaken     = errors.New("ALIAS IS ALREADY TAKEN BY ANOTHER URL")
+	ErrShortURLTaken  = errors.New("SHORT URL IS ALREADY TAKEN BY ANOTHER URL")
+	ErrBlocked        = errors.New("URL IS BLOCKED BY DOMAIN POLICY")
+	ErrIncompleteLink = errors.New("LINK NEEDS SHORT URL AND URL")
+	ErrFileInUse      = errors.New("STORAGE FILE IS USED BY ANOTHER PROCESS")
+	ErrTooManyLinks   = errors.New("TOO MANY LINKS IN ONE REQUEST")
+	ErrQueueFull      = errors.New("DELETE QUEUE IS FULL, TRY AGAIN LATER")
+)
+
+// ErrConflict is returned by Create when the url is already
+// shortened, ShortURL holds the short url it has.
+type ErrConflict struct {
+	ShortURL string
+}
+
+func (e *ErrConflict) Error() string {
+	return "URL IS ALREADY SHORTENED AS " + e.ShortURL
+}
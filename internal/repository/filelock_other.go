@@ -0,0 +1,10 @@
+//go:build !unix
+
+package repository
+
+import "os"
+
+// lockFile can't lock files here, every process is taken for the owner.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, defFilePerm)
+}
@@ -3,9 +3,14 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
 
 	"github.com/DmitryM7/short-url.git/internal/logger"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
 )
 
 type InDBStorage struct {
@@ -20,113 +25,657 @@ func NewInDBStorage(lg logger.MyLogger, dsn string) (*InDBStorage, error) {
 		Logger:      lg,
 	}
 
-	err := st.connect()
+	ctx := context.Background()
+
+	db, err := openPostgres(ctx, dsn)
 
 	if err != nil {
-		lg.Infoln("HERE1")
 		return &st, err
 	}
 
-	err = st.createSchema()
+	st.db = db
+
+	err = migrate(ctx, lg, db, goose.DialectPostgres)
 
 	if err != nil {
-		lg.Infoln("HERE2")
+		db.Close()
 		return &st, err
 	}
 
-	return &st, err
+	return &st, nil
+}
+
+func openPostgres(ctx context.Context, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (l *InDBStorage) Get(ctx context.Context, shorturl string) (LinkRecord, error) {
+	var expiresAt sql.NullTime
+
+	lnkRec := LinkRecord{ShortURL: shorturl}
+	row := l.db.QueryRowContext(ctx, "SELECT COALESCE(url, ''), userid, is_deleted, expires_at FROM repo WHERE shorturl=$1", shorturl)
+	err := row.Scan(&lnkRec.URL, &lnkRec.UserID, &lnkRec.IsDeleted, &expiresAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return lnkRec, ErrNotFound
+	}
+
+	lnkRec.ExpiresAt = expiresAt.Time
+
+	return lnkRec, err
+}
+
+func (l *InDBStorage) GetByURL(ctx context.Context, url string) (string, error) {
+	var shorturl string
+	row := l.db.QueryRowContext(ctx, "SELECT shorturl FROM repo WHERE url=$1 AND NOT is_deleted", url)
+	err := row.Scan(&shorturl)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return shorturl, ErrNotFound
+	}
+
+	return shorturl, err
+}
+
+func (l *InDBStorage) GetByUser(ctx context.Context, userID int) ([]LinkRecord, error) {
+	lnkRecs := []LinkRecord{}
+
+	rows, err := l.db.QueryContext(ctx, "SELECT shorturl, url FROM repo WHERE userid=$1 AND NOT is_deleted", userID)
+
+	if err != nil {
+		return lnkRecs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		lnkRec := LinkRecord{UserID: userID}
+
+		err = rows.Scan(&lnkRec.ShortURL, &lnkRec.URL)
+
+		if err != nil {
+			return lnkRecs, err
+		}
+
+		lnkRecs = append(lnkRecs, lnkRec)
+	}
+
+	return lnkRecs, rows.Err()
 }
 
-func (l *InDBStorage) connect() error {
-	db, err := sql.Open("pgx", l.DatabaseDSN)
+func (l *InDBStorage) Create(ctx context.Context, lnkRec LinkRecord) error {
+	return createLink(ctx, l.db, lnkRec, nullTime(lnkRec.ExpiresAt))
+}
+
+// createLink inserts the link unless its url is already shortened,
+// then it returns ErrConflict with the short url the url has, or its
+// short url belongs to another url, then it returns ErrShortURLTaken.
+// A deleted link holding the url gives it up, see releaseURL.
+func createLink(ctx context.Context, db *sql.DB, lnkRec LinkRecord, expiresAt any) error {
+	var shorturl string
+
+	insert := func() error {
+		return db.QueryRowContext(ctx, `INSERT INTO repo (shorturl,url,userid,expires_at) VALUES($1,$2,$3,$4)
+	                                               ON CONFLICT DO NOTHING RETURNING shorturl`,
+			lnkRec.ShortURL, lnkRec.URL, lnkRec.UserID, expiresAt).Scan(&shorturl)
+	}
+
+	err := insert()
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	released, err := releaseURL(ctx, db, lnkRec.URL)
 
 	if err != nil {
 		return err
 	}
 
-	if err := db.PingContext(context.Background()); err != nil {
+	if released {
+		if err = insert(); !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	err = db.QueryRowContext(ctx, "SELECT shorturl FROM repo WHERE url=$1", lnkRec.URL).Scan(&shorturl)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrShortURLTaken
+	}
+
+	if err != nil {
 		return err
 	}
 
-	l.db = db
+	return &ErrConflict{ShortURL: shorturl}
+}
 
-	return nil
+func (l *InDBStorage) BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	return batchCreate(ctx, l.db, lnkRecs, func(t time.Time) any { return nullTime(t) })
 }
 
-func (l *InDBStorage) createSchema() error {
-	var tableName string
+// batchCreate inserts links in one transaction, which is rolled back
+// on any error. Urls that are already shortened are left as they are
+// and get the short url they have, a short url of another url fails the
+// batch with ErrShortURLTaken. It serves Postgres and SQLite, the
+// latter stores times its own way, so expires converts them.
+func batchCreate(ctx context.Context, db *sql.DB, lnkRecs []LinkRecord, expires func(time.Time) any) ([]BatchResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
 
-	row := l.db.QueryRowContext(context.Background(), "SELECT schemaname from pg_stat_user_tables WHERE relname LIKE 'repo'")
+	defer tx.Rollback()
 
-	err := row.Scan(&tableName)
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO repo (shorturl,url,userid,expires_at) VALUES($1,$2,$3,$4)
+	                                                     ON CONFLICT DO NOTHING RETURNING shorturl`)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_, err = l.db.ExecContext(context.Background(), `CREATE TABLE repo ("id" SERIAL PRIMARY KEY,
-			                                                                   "shorturl" VARCHAR NOT NULL UNIQUE,
-																			"url" VARCHAR NOT NULL UNIQUE)`)
-			if err != nil {
-				return err
+		return nil, err
+	}
+
+	defer stmt.Close()
+
+	results := make([]BatchResult, 0, len(lnkRecs))
+
+	for _, lnk := range lnkRecs {
+		res := BatchResult{LinkRecord: lnk, Status: BatchCreated}
+
+		err := stmt.QueryRowContext(ctx, lnk.ShortURL, lnk.URL, lnk.UserID, expires(lnk.ExpiresAt)).Scan(&res.ShortURL)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			released, errRelease := releaseURL(ctx, tx, lnk.URL)
+
+			if errRelease != nil {
+				return nil, errRelease
+			}
+
+			if released {
+				err = stmt.QueryRowContext(ctx, lnk.ShortURL, lnk.URL, lnk.UserID, expires(lnk.ExpiresAt)).Scan(&res.ShortURL)
 			}
 		}
 
-		return err
+		if errors.Is(err, sql.ErrNoRows) {
+			res.Status = BatchExisting
+			err = tx.QueryRowContext(ctx, "SELECT shorturl FROM repo WHERE url=$1", lnk.URL).Scan(&res.ShortURL)
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrShortURLTaken
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, res)
 	}
 
-	return nil
+	return results, tx.Commit()
 }
 
-func (l *InDBStorage) Get(url string) (string, error) {
-	var shorturl string
-	row := l.db.QueryRowContext(context.Background(), "SELECT url FROM repo WHERE shorturl=$1", url)
-	err := row.Scan(&shorturl)
-	return shorturl, err
+func (l *InDBStorage) Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	return upsert(ctx, l.db, lnkRecs, func(t time.Time) any { return nullTime(t) })
 }
 
-func (l *InDBStorage) GetByURL(url string) (string, error) {
-	var shorturl string
-	row := l.db.QueryRowContext(context.Background(), "SELECT shorturl FROM repo WHERE url=$1", url)
-	err := row.Scan(&shorturl)
-	return shorturl, err
+// upsert writes links in one transaction like batchCreate does. A link is
+// updated only when it differs, so importing the same links again changes
+// nothing.
+func upsert(ctx context.Context, db *sql.DB, lnkRecs []LinkRecord, expires func(time.Time) any) ([]BatchResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	results := make([]BatchResult, 0, len(lnkRecs))
+
+	for _, lnk := range lnkRecs {
+		lnk.CorrelationID = ""
+		res := BatchResult{LinkRecord: lnk, Status: BatchExisting}
+
+		var ownerDeleted bool
+
+		err := tx.QueryRowContext(ctx, "SELECT shorturl, is_deleted FROM repo WHERE url=$1", lnk.URL).Scan(&res.ShortURL, &ownerDeleted)
+
+		if err == nil && res.ShortURL != lnk.ShortURL {
+			if !ownerDeleted {
+				results = append(results, res)
+				continue
+			}
+
+			if _, err := releaseURL(ctx, tx, lnk.URL); err != nil {
+				return nil, err
+			}
+		}
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		res.ShortURL = lnk.ShortURL
+		args := []any{lnk.ShortURL, lnk.URL, lnk.UserID, lnk.IsDeleted, expires(lnk.ExpiresAt)}
+
+		res.Status, err = upsertOne(ctx, tx, args)
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, res)
+	}
+
+	return results, tx.Commit()
 }
 
-func (l *InDBStorage) Create(lnkRec LinkRecord) error {
-	_, err := l.db.ExecContext(context.Background(), "INSERT INTO repo (shorturl,url) VALUES($1,$2)", lnkRec.ShortURL, lnkRec.URL)
+func upsertOne(ctx context.Context, tx *sql.Tx, args []any) (BatchStatus, error) {
+	updated, err := tx.ExecContext(ctx, `UPDATE repo SET url=$2, userid=$3, is_deleted=$4, expires_at=$5
+	                                     WHERE shorturl=$1 AND (url IS DISTINCT FROM $2 OR userid<>$3 OR is_deleted<>$4
+	                                                            OR expires_at IS DISTINCT FROM $5)`, args...)
 
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if n, err := updated.RowsAffected(); err != nil || n > 0 {
+		return BatchUpdated, err
+	}
+
+	inserted, err := tx.ExecContext(ctx, `INSERT INTO repo (shorturl,url,userid,is_deleted,expires_at) VALUES($1,$2,$3,$4,$5)
+	                                      ON CONFLICT (shorturl) DO NOTHING`, args...)
+
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := inserted.RowsAffected(); err != nil || n > 0 {
+		return BatchCreated, err
 	}
-	return nil
+
+	return BatchUnchanged, nil
 }
 
-func (l *InDBStorage) BatchCreate(lnkRecs []LinkRecord) error {
-	tx, err := l.db.Begin()
+// releaseURL lets a deleted link give its url up, the url column is
+// unique. The link stays deleted with no url, like a tombstone.
+func releaseURL(ctx context.Context, db execer, url string) (bool, error) {
+	res, err := db.ExecContext(ctx, "UPDATE repo SET url=NULL WHERE url=$1 AND is_deleted", url)
 
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	stmt, err := tx.PrepareContext(context.Background(), "INSERT INTO repo (shorturl,url) VALUES($1,$2)")
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+func (l *InDBStorage) BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error {
+	shortURLs := make([]string, 0, len(lnkRecs))
+	userIDs := make([]int, 0, len(lnkRecs))
+
+	for _, lnk := range lnkRecs {
+		shortURLs = append(shortURLs, lnk.ShortURL)
+		userIDs = append(userIDs, lnk.UserID)
+	}
+
+	_, err := l.db.ExecContext(ctx, `UPDATE repo SET is_deleted = TRUE
+	                                                   FROM (SELECT unnest($1::varchar[]) AS shorturl,
+	                                                                unnest($2::integer[]) AS userid) AS del
+	                                                   WHERE repo.shorturl = del.shorturl AND repo.userid = del.userid`,
+		shortURLs, userIDs)
+
+	return err
+}
+
+func (l *InDBStorage) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	return purgeExpired(ctx, l.db, now)
+}
+
+// purgeExpired turns expired links into tombstones: the row keeps its
+// short url and expiry, the url is set to NULL.
+func purgeExpired(ctx context.Context, db *sql.DB, now any) (int, error) {
+	res, err := db.ExecContext(ctx, `UPDATE repo SET url=NULL, is_deleted=TRUE
+	                                 WHERE expires_at <= $1 AND url IS NOT NULL`, now)
+
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+
+	return int(purged), err
+}
+
+func (l *InDBStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	shortURLs := make([]string, 0, len(clicks))
+	times := make([]time.Time, 0, len(clicks))
+	referrers := make([]string, 0, len(clicks))
+	userAgents := make([]string, 0, len(clicks))
+	ipHashes := make([]string, 0, len(clicks))
+
+	for _, v := range clicks {
+		shortURLs = append(shortURLs, v.ShortURL)
+		times = append(times, v.Time)
+		referrers = append(referrers, v.Referrer)
+		userAgents = append(userAgents, v.UserAgent)
+		ipHashes = append(ipHashes, v.IPHash)
+	}
+
+	_, err := l.db.ExecContext(ctx, `INSERT INTO clicks (shorturl, clicked_at, referrer, user_agent, ip_hash)
+	                                                   SELECT * FROM unnest($1::varchar[], $2::timestamptz[],
+	                                                                        $3::varchar[], $4::varchar[], $5::varchar[])`,
+		shortURLs, times, referrers, userAgents, ipHashes)
+
+	return err
+}
+
+func (l *InDBStorage) GetStats(ctx context.Context, shorturl string) (LinkStats, error) {
+	stats := newLinkStats()
+
+	row := l.db.QueryRowContext(ctx, "SELECT count(*), count(DISTINCT ip_hash) FROM clicks WHERE shorturl=$1", shorturl)
+
+	err := row.Scan(&stats.TotalClicks, &stats.UniqueVisitors)
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = l.histogram(ctx, shorturl, "day", "YYYY-MM-DD", stats.ByDay)
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = l.histogram(ctx, shorturl, "hour", "YYYY-MM-DD HH24:00", stats.ByHour)
+
+	return stats, err
+}
+
+func (l *InDBStorage) histogram(ctx context.Context, shorturl, period, format string, hist map[string]int) error {
+	rows, err := l.db.QueryContext(ctx, `SELECT to_char(date_trunc($2, clicked_at AT TIME ZONE 'UTC'), $3), count(*)
+	                                                       FROM clicks WHERE shorturl=$1 GROUP BY 1`,
+		shorturl, period, format)
 
 	if err != nil {
 		return err
 	}
 
-	for _, lnk := range lnkRecs {
-		_, err := stmt.ExecContext(context.Background(), lnk.ShortURL, lnk.URL)
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			bucket string
+			count  int
+		)
+
+		err = rows.Scan(&bucket, &count)
 
 		if err != nil {
 			return err
 		}
+
+		hist[bucket] = count
+	}
+
+	return rows.Err()
+}
+
+func (l *InDBStorage) VisitorSalt(ctx context.Context) ([]byte, error) {
+	return visitorSalt(ctx, l.db)
+}
+
+// visitorSalt keeps the salt in settings. Only the first replica to
+// need it inserts one, the others read it.
+func visitorSalt(ctx context.Context, db *sql.DB) ([]byte, error) {
+	salt, err := newVisitorSalt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING",
+		visitorSaltSetting, hex.EncodeToString(salt))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var value string
+
+	err = db.QueryRowContext(ctx, "SELECT value FROM settings WHERE name=$1", visitorSaltSetting).Scan(&value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(value)
+}
+
+func (l *InDBStorage) ReserveCounter(ctx context.Context, n uint64) (uint64, error) {
+	return reserveCounter(ctx, l.db, n)
+}
+
+const counterSetting = "short_code_counter"
+
+// reserveCounter keeps the counter in settings. The upsert locks the
+// row, so replicas never take the same values.
+func reserveCounter(ctx context.Context, db *sql.DB, n uint64) (uint64, error) {
+	var value string
+
+	err := db.QueryRowContext(ctx, `INSERT INTO settings (name, value) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET value = CAST(CAST(settings.value AS BIGINT) + $3 AS VARCHAR)
+		RETURNING value`, counterSetting, strconv.FormatUint(n, 10), int64(n)).Scan(&value)
+
+	if err != nil {
+		return 0, err
 	}
 
-	return tx.Commit()
+	return strconv.ParseUint(value, 10, 64)
 }
 
-func (l *InDBStorage) Ping() bool {
-	if err := l.db.PingContext(context.Background()); err != nil {
+func (l *InDBStorage) Ping(ctx context.Context) bool {
+	if err := l.db.PingContext(ctx); err != nil {
 		return false
 	}
 
 	return true
 }
+
+func (l *InDBStorage) Close() error {
+	return l.db.Close()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (l *InDBStorage) CreateAPIKey(ctx context.Context, apiKey APIKey) error {
+	_, err := l.db.ExecContext(ctx,
+		"INSERT INTO api_keys (id, name, hash, scopes, userid, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		apiKey.ID, apiKey.Name, apiKey.Hash, joinScopes(apiKey.Scopes), apiKey.UserID, apiKey.CreatedAt)
+
+	return err
+}
+
+func (l *InDBStorage) GetAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	row := l.db.QueryRowContext(ctx, "SELECT id, name, hash, scopes, userid, created_at, revoked_at FROM api_keys WHERE hash=$1", hash)
+	apiKey, err := scanDBAPIKey(row)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiKey, ErrNotFound
+	}
+
+	return apiKey, err
+}
+
+func (l *InDBStorage) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	apiKeys := []APIKey{}
+
+	rows, err := l.db.QueryContext(ctx, "SELECT id, name, hash, scopes, userid, created_at, revoked_at FROM api_keys ORDER BY created_at, id")
+
+	if err != nil {
+		return apiKeys, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		apiKey, err := scanDBAPIKey(rows)
+
+		if err != nil {
+			return apiKeys, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, rows.Err()
+}
+
+func (l *InDBStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return revokeAPIKey(ctx, l.db, id, at)
+}
+
+// revokeAPIKey keeps the first revocation time of a key.
+func revokeAPIKey(ctx context.Context, db *sql.DB, id string, at any) error {
+	res, err := db.ExecContext(ctx, "UPDATE api_keys SET revoked_at=COALESCE(revoked_at, $1) WHERE id=$2", at, id)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// execer is *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func scanDBAPIKey(row rowScanner) (APIKey, error) {
+	var (
+		apiKey    APIKey
+		scopes    string
+		revokedAt sql.NullTime
+	)
+
+	err := row.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Hash, &scopes, &apiKey.UserID, &apiKey.CreatedAt, &revokedAt)
+	apiKey.Scopes = splitScopes(scopes)
+	apiKey.RevokedAt = revokedAt.Time
+
+	return apiKey, err
+}
+
+func (l *InDBStorage) Iterate(ctx context.Context, fn func(LinkRecord) error) error {
+	return iterate(ctx, l.db, fn, scanDBLink)
+}
+
+// List walks the index of short urls from the cursor, so a page costs
+// the same wherever it is. LIKE is case sensitive in Postgres, prefixes
+// are served by the pattern index of url and other searches by the
+// trigram one when pg_trgm is there.
+func (l *InDBStorage) List(ctx context.Context, q ListQuery) ([]LinkRecord, error) {
+	return list(ctx, l.db, q, `url LIKE $2 ESCAPE '\'`, q.likePattern(), scanDBLink)
+}
+
+func scanDBLink(row rowScanner) (LinkRecord, error) {
+	var expiresAt sql.NullTime
+
+	lnkRec := LinkRecord{}
+	err := row.Scan(&lnkRec.ShortURL, &lnkRec.URL, &lnkRec.UserID, &lnkRec.IsDeleted, &expiresAt)
+	lnkRec.ExpiresAt = expiresAt.Time
+
+	return lnkRec, err
+}
+
+func (l *InDBStorage) CountLinks(ctx context.Context) (int, error) {
+	return countLinks(ctx, l.db)
+}
+
+// countLinks is shared with InSQLiteStorage, tombstones are deleted too.
+func countLinks(ctx context.Context, db *sql.DB) (int, error) {
+	count := 0
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM repo WHERE NOT is_deleted").Scan(&count)
+
+	return count, err
+}
+
+// iterate walks all links but tombstones in the order of short urls,
+// scan reads a row the way the database stores times.
+func iterate(ctx context.Context, db *sql.DB, fn func(LinkRecord) error, scan func(rowScanner) (LinkRecord, error)) error {
+	rows, err := db.QueryContext(ctx, "SELECT shorturl, url, userid, is_deleted, expires_at FROM repo WHERE url IS NOT NULL ORDER BY shorturl")
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		lnkRec, err := scan(rows)
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(lnkRec); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// list reads a page of links whose url passes match, a condition
+// over the pattern in $2.
+func list(ctx context.Context, db *sql.DB, q ListQuery, match, pattern string,
+	scan func(rowScanner) (LinkRecord, error)) ([]LinkRecord, error) {
+	lnkRecs := []LinkRecord{}
+
+	rows, err := db.QueryContext(ctx, `SELECT shorturl, url, userid, is_deleted, expires_at FROM repo
+	                                   WHERE shorturl > $1 AND NOT is_deleted AND `+match+`
+	                                   ORDER BY shorturl LIMIT $3`, q.After, pattern, q.Limit)
+
+	if err != nil {
+		return lnkRecs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		lnkRec, err := scan(rows)
+
+		if err != nil {
+			return lnkRecs, err
+		}
+
+		lnkRecs = append(lnkRecs, lnkRec)
+	}
+
+	return lnkRecs, rows.Err()
+}
@@ -1,18 +1,61 @@
 package repository
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/DmitryM7/short-url.git/internal/logger"
 )
 
-const defFilePerm os.FileMode = 0644
+const (
+	defFilePerm  os.FileMode = 0644
+	compactEvery             = 1000
+)
 
+// InFileStorage keeps links in memory and persists them as JSON lines:
+// every change is appended to the log at SavePath, and from time to time
+// the whole state is compacted into the snapshot next to it.
+//
+// Only the process holding the lock file writes the log. Others, like
+// CLI commands run next to a server, open the storage read only.
 type InFileStorage struct {
 	InMemoryStorage
 	SavePath string
+
+	mu       sync.Mutex // guards log, logLines, lock and dirty
+	log      *os.File
+	logLines int
+	lock     *os.File // nil when another process owns the storage
+	dirty    bool     // something was logged since the last compaction
+
+	// keys may be changed by another process, like "apikey revoke"
+	// next to a running server, so the file is read again when its
+	// stamp changes
+	keysMu    sync.Mutex
+	keysStamp fileStamp
+
+	clicksMu   sync.Mutex // guards clicksLog, clicksGen and clickLines
+	clicksLog  *os.File   // nil when the storage is read only
+	clicksGen  int
+	clickLines int
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
 }
 
 func NewInFileStorage(lg logger.MyLogger, exportFile string) (*InFileStorage, error) {
@@ -26,76 +69,1068 @@ func NewInFileStorage(lg logger.MyLogger, exportFile string) (*InFileStorage, er
 	}, nil
 }
 
-func (r *InFileStorage) Create(lnkRec LinkRecord) error {
-	err := r.InMemoryStorage.Create(lnkRec)
+func (r *InFileStorage) Create(ctx context.Context, lnkRec LinkRecord) error {
+	results, err := r.BatchCreate(ctx, []LinkRecord{lnkRec})
+
+	if err != nil {
+		return err
+	}
+
+	if results[0].Status == BatchExisting {
+		return &ErrConflict{ShortURL: results[0].ShortURL}
+	}
+
+	return nil
+}
+
+// BatchCreate logs only links with new urls. It holds the log lock while
+// it looks for existing urls and short urls, so another batch can't add
+// them meanwhile. A taken short url fails the batch before anything is
+// logged.
+func (r *InFileStorage) BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(lnkRecs))
+	logRecs := make([]LinkRecord, 0, len(lnkRecs))
+	inBatch := make(map[string]string, len(lnkRecs))
+	codes := make(map[string]bool, len(lnkRecs))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range lnkRecs {
+		res := BatchResult{LinkRecord: v, Status: BatchExisting}
+		shorturl, ok := inBatch[v.URL]
+
+		if !ok {
+			var err error
+
+			shorturl, err = r.InMemoryStorage.GetByURL(ctx, v.URL)
+			ok = err == nil
+		}
+
+		if ok {
+			res.ShortURL = shorturl
+			results = append(results, res)
+			continue
+		}
+
+		if _, err := r.InMemoryStorage.Get(ctx, v.ShortURL); err == nil || codes[v.ShortURL] {
+			return nil, ErrShortURLTaken
+		}
+
+		res.Status = BatchCreated
+		inBatch[v.URL] = v.ShortURL
+		codes[v.ShortURL] = true
+		v.CorrelationID = ""
+		logRecs = append(logRecs, v)
+		results = append(results, res)
+	}
+
+	buf, err := encodeLog(logRecs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.writeLog(buf, len(logRecs))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range logRecs {
+		r.put(v)
+	}
+
+	r.compactIfDue()
+
+	return results, nil
+}
+
+// Upsert logs changed links before they get into memory, like BatchCreate.
+func (r *InFileStorage) Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plan := r.newUpsertPlan()
+	results := make([]BatchResult, 0, len(lnkRecs))
+	logRecs := make([]LinkRecord, 0, len(lnkRecs))
+
+	for _, v := range lnkRecs {
+		res, err := plan.result(ctx, v)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if isWritten(res) {
+			logRecs = append(logRecs, res.LinkRecord)
+		}
+
+		results = append(results, res)
+	}
+
+	buf, err := encodeLog(logRecs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.writeLog(buf, len(logRecs))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range logRecs {
+		r.put(v)
+	}
+
+	r.compactIfDue()
+
+	return results, nil
+}
+
+func (r *InFileStorage) BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deleted := []LinkRecord{}
+
+	for _, v := range lnkRecs {
+		lnkRec, err := r.InMemoryStorage.Get(ctx, v.ShortURL)
+
+		if err != nil || lnkRec.UserID != v.UserID || lnkRec.IsDeleted {
+			continue
+		}
+
+		lnkRec.IsDeleted = true
+		deleted = append(deleted, lnkRec)
+	}
+
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	buf, err := encodeLog(deleted...)
+
+	if err != nil {
+		return err
+	}
+
+	err = r.writeLog(buf, len(deleted))
 
 	if err != nil {
 		return err
 	}
 
-	_, err = r.Unload()
+	err = r.InMemoryStorage.BatchDelete(ctx, lnkRecs)
 
 	if err != nil {
 		return err
 	}
 
+	r.compactIfDue()
+
 	return nil
 }
 
-func (r *InFileStorage) SetSavePath(p string) {
-	r.SavePath = p
-}
+// PurgeExpired logs tombstones of expired links. It holds the log lock,
+// so no batch changes them meanwhile.
+func (r *InFileStorage) PurgeExpired(_ context.Context, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tombstones := []LinkRecord{}
+
+	r.each(func(v LinkRecord) {
+		if v.purgeable(now) {
+			tombstones = append(tombstones, v.tombstone())
+		}
+	})
 
-func (r *InFileStorage) Unload() (int, error) {
-	j, err := json.Marshal(r.Repo)
+	buf, err := encodeLog(tombstones...)
 
 	if err != nil {
 		return 0, err
 	}
 
-	file, err := os.OpenFile(r.SavePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defFilePerm)
+	err = r.writeLog(buf, len(tombstones))
 
 	if err != nil {
-		r.Logger.Debugln("FIND PATH:" + r.SavePath)
 		return 0, err
 	}
 
-	defer file.Close()
+	for _, v := range tombstones {
+		r.put(v)
+	}
+
+	r.compactIfDue()
 
-	return file.Write(j)
+	return len(tombstones), nil
 }
 
-func (r *InFileStorage) Load() error {
-	file, err := os.OpenFile(r.SavePath, os.O_RDONLY|os.O_CREATE, defFilePerm)
+// SaveClicks appends the clicks to the click log, from time to time
+// the counters of all links are compacted into a snapshot. Raw clicks
+// are not kept.
+func (r *InFileStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	if r.readOnly() {
+		return ErrFileInUse
+	}
+
+	r.clicksMu.Lock()
+	defer r.clicksMu.Unlock()
+
+	if r.clicksLog == nil {
+		return ErrFileInUse
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, v := range clicks {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.clicksLog.Write(buf.Bytes())
 
 	if err != nil {
-		r.Logger.Errorln("CANT CREATE AND OPEN STORAGE FILE:" + r.SavePath)
 		return err
 	}
 
-	defer file.Close()
+	err = r.InMemoryStorage.SaveClicks(ctx, clicks)
+
+	if err != nil {
+		return err
+	}
+
+	r.clickLines += len(clicks)
+
+	if r.clickLines < compactEvery {
+		return nil
+	}
+
+	// the clicks are already logged, so a failed compaction is only
+	// logged and tried again later
+	if err := r.compactClicks(); err != nil {
+		r.Logger.Errorln("CANT COMPACT CLICKS FILE", "error", err.Error())
+	}
+
+	return nil
+}
+
+// compactClicks must be called with clicksMu held. New clicks go to the
+// log of the next generation, which the snapshot names, so a crash in
+// between replays the old log over the old snapshot.
+func (r *InFileStorage) compactClicks() error {
+	gen := r.clicksGen + 1
+
+	log, err := os.OpenFile(r.clicksLogPath(gen), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, defFilePerm)
+
+	if err != nil {
+		return err
+	}
+
+	j, err := r.clicks.marshal(gen)
+
+	if err == nil {
+		err = replaceFile(r.clicksPath(), j, defFilePerm)
+	}
+
+	if err != nil {
+		log.Close()
+		os.Remove(r.clicksLogPath(gen))
+		return err
+	}
+
+	r.clicksLog.Close()
+	os.Remove(r.clicksLogPath(r.clicksGen))
+
+	r.clicksLog = log
+	r.clicksGen = gen
+	r.clickLines = 0
+
+	return nil
+}
+
+// replaceFile writes a temporary file and renames it over path,
+// so a crash can't leave path half written.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (r *InFileStorage) clicksPath() string {
+	return r.SavePath + ".clicks"
+}
+
+func (r *InFileStorage) clicksLogPath(gen int) string {
+	return fmt.Sprintf("%s.clicks.%d.log", r.SavePath, gen)
+}
+
+func (r *InFileStorage) lockPath() string {
+	return r.SavePath + ".lock"
+}
+
+func (r *InFileStorage) snapshotPath() string {
+	return r.SavePath + ".snapshot"
+}
+
+// loadClicks reads the counters, or raw clicks which older versions
+// saved, and replays the click logs from the generation of the snapshot
+// on. Stats are not worth refusing to start, so a broken file only
+// loses them.
+func (r *InFileStorage) loadClicks() error {
+	gen, err := r.loadClickSnapshot()
+
+	if err != nil {
+		return err
+	}
 
-	buffer, err := io.ReadAll(file)
+	logs, err := filepath.Glob(r.SavePath + ".clicks.*.log")
 
 	if err != nil {
-		r.Logger.Errorln("CANT READ STORAGE FROM FILE")
 		return err
 	}
 
-	if string(buffer) != "" {
-		err = json.Unmarshal(buffer, &r.Repo)
+	gens := []int{}
+
+	for _, v := range logs {
+		var logGen int
+
+		if _, err := fmt.Sscanf(strings.TrimPrefix(v, r.SavePath), ".clicks.%d.log", &logGen); err != nil {
+			continue
+		}
+
+		// logs older than the snapshot are left by a crash in the
+		// middle of a compaction
+		if logGen < gen {
+			if r.lock != nil {
+				os.Remove(v)
+			}
+
+			continue
+		}
+
+		gens = append(gens, logGen)
+	}
+
+	sort.Ints(gens)
+
+	r.clicksMu.Lock()
+	defer r.clicksMu.Unlock()
+
+	r.clicksGen = gen
+	r.clickLines = 0
+
+	for _, v := range gens {
+		lines, err := r.replayClicks(r.clicksLogPath(v))
 
 		if err != nil {
-			r.Logger.Errorln("CANT UNMARSHAL STORAGE BODY:" + string(buffer))
 			return err
 		}
-	} else {
-		r.Logger.Infoln("EMPTY BUFFER. PROBABLY FIRST RUN")
+
+		r.clicksGen = v
+		r.clickLines += lines
+	}
+
+	if r.lock == nil {
+		return nil
+	}
+
+	r.clicksLog, err = os.OpenFile(r.clicksLogPath(r.clicksGen), os.O_WRONLY|os.O_CREATE|os.O_APPEND, defFilePerm)
+
+	return err
+}
+
+func (r *InFileStorage) loadClickSnapshot() (int, error) {
+	buffer, err := os.ReadFile(r.clicksPath())
+
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	gen, err := r.clicks.unmarshal(buffer)
+
+	if err == nil {
+		return gen, nil
+	}
+
+	clicks := []Click{}
+
+	if json.Unmarshal(buffer, &clicks) == nil {
+		r.clicks.add(clicks...)
+		return 0, nil
+	}
+
+	r.Logger.Warnln("BROKEN CLICKS FILE. STATS START EMPTY", "path", r.clicksPath(), "error", err.Error())
+
+	return 0, nil
+}
+
+// replayClicks adds the clicks of a log. Broken lines are skipped, and
+// a torn last one is cut off when this process owns the storage, so
+// the next click is not appended to it.
+func (r *InFileStorage) replayClicks(path string) (int, error) {
+	buffer, err := os.ReadFile(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	lines := 0
+
+	for rest := buffer; len(rest) > 0; {
+		line, next, complete := bytes.Cut(rest, []byte("\n"))
+
+		if !complete {
+			r.Logger.Infoln("DROP BROKEN LAST LINE OF CLICKS FILE", "path", path)
+
+			if r.lock == nil {
+				break
+			}
+
+			return lines, os.Truncate(path, int64(len(buffer)-len(rest)))
+		}
+
+		rest = next
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		click := Click{}
+
+		if err := json.Unmarshal(line, &click); err != nil {
+			r.Logger.Warnln("SKIP BROKEN LINE OF CLICKS FILE", "path", path, "error", err.Error())
+			continue
+		}
+
+		r.clicks.add(click)
+		lines++
+	}
+
+	return lines, nil
+}
+
+func (r *InFileStorage) keysPath() string {
+	return r.SavePath + ".keys"
+}
+
+// loadAPIKeys must be called with keysMu held.
+func (r *InFileStorage) loadAPIKeys() error {
+	stamp, err := r.statAPIKeys()
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
 	}
 
+	buffer, err := os.ReadFile(r.keysPath())
+
+	if err != nil {
+		return err
+	}
+
+	apiKeys := []APIKey{}
+
+	err = json.Unmarshal(buffer, &apiKeys)
+
+	if err != nil {
+		return err
+	}
+
+	r.keys.replace(apiKeys)
+	r.keysStamp = stamp
+
 	return nil
 }
 
-func (r *InFileStorage) Ping() bool {
-	return true
+func (r *InFileStorage) statAPIKeys() (fileStamp, error) {
+	info, err := os.Stat(r.keysPath())
+
+	if err != nil {
+		return fileStamp{}, err
+	}
+
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// reloadAPIKeys must be called with keysMu held. It reads the keys
+// again only when the file was changed since they were read or saved.
+func (r *InFileStorage) reloadAPIKeys() error {
+	stamp, err := r.statAPIKeys()
+
+	if errors.Is(err, os.ErrNotExist) || (err == nil && stamp == r.keysStamp) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.loadAPIKeys()
+}
+
+// saveAPIKeys must be called with keysMu held. It rewrites the keys
+// file through a temporary one.
+func (r *InFileStorage) saveAPIKeys() error {
+	j, err := json.Marshal(r.keys.all())
+
+	if err != nil {
+		return err
+	}
+
+	err = replaceFile(r.keysPath(), j, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	r.keysStamp, err = r.statAPIKeys()
+
+	return err
+}
+
+func (r *InFileStorage) CreateAPIKey(ctx context.Context, apiKey APIKey) error {
+	r.keysMu.Lock()
+	defer r.keysMu.Unlock()
+
+	if err := r.reloadAPIKeys(); err != nil {
+		return err
+	}
+
+	if err := r.InMemoryStorage.CreateAPIKey(ctx, apiKey); err != nil {
+		return err
+	}
+
+	return r.saveAPIKeys()
+}
+
+func (r *InFileStorage) GetAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	r.keysMu.Lock()
+	defer r.keysMu.Unlock()
+
+	if err := r.reloadAPIKeys(); err != nil {
+		return APIKey{}, err
+	}
+
+	return r.InMemoryStorage.GetAPIKey(ctx, hash)
+}
+
+func (r *InFileStorage) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	r.keysMu.Lock()
+	defer r.keysMu.Unlock()
+
+	if err := r.reloadAPIKeys(); err != nil {
+		return nil, err
+	}
+
+	return r.InMemoryStorage.ListAPIKeys(ctx)
+}
+
+func (r *InFileStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	r.keysMu.Lock()
+	defer r.keysMu.Unlock()
+
+	if err := r.reloadAPIKeys(); err != nil {
+		return err
+	}
+
+	if err := r.InMemoryStorage.RevokeAPIKey(ctx, id, at); err != nil {
+		return err
+	}
+
+	return r.saveAPIKeys()
+}
+
+func (r *InFileStorage) SetSavePath(p string) {
+	r.SavePath = p
+}
+
+func encodeLog(lnkRecs ...LinkRecord) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+
+	for _, v := range lnkRecs {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeLog must be called with mu held. It doesn't compact, callers
+// do it through compactIfDue once the links are in memory.
+func (r *InFileStorage) writeLog(buf []byte, lines int) error {
+	if lines == 0 {
+		return nil
+	}
+
+	if r.lock == nil {
+		return ErrFileInUse
+	}
+
+	if r.log == nil {
+		return fmt.Errorf("STORAGE FILE IS NOT OPENED")
+	}
+
+	_, err := r.log.Write(buf)
+
+	if err != nil {
+		return err
+	}
+
+	r.logLines += lines
+	r.dirty = true
+
+	return nil
+}
+
+// compactIfDue must be called with mu held. The links are already
+// logged, so a failed compaction is only logged and tried again later.
+func (r *InFileStorage) compactIfDue() {
+	if r.logLines < compactEvery {
+		return
+	}
+
+	if err := r.compact(); err != nil {
+		r.Logger.Errorln("CANT COMPACT STORAGE FILE", "error", err.Error())
+	}
+}
+
+func (r *InFileStorage) readOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lock == nil
+}
+
+// Compact writes all links into a new snapshot and starts an empty log.
+// The snapshot is renamed into place only when it is fully written,
+// so a crash leaves either the old or the new one.
+func (r *InFileStorage) Compact() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lock == nil {
+		return ErrFileInUse
+	}
+
+	return r.compact()
+}
+
+func (r *InFileStorage) compact() error {
+	tmpPath := r.snapshotPath() + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defFilePerm)
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+
+	r.each(func(v LinkRecord) {
+		if err == nil {
+			err = enc.Encode(v)
+		}
+	})
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, r.snapshotPath())
+
+	if err != nil {
+		return err
+	}
+
+	if r.log != nil {
+		r.log.Close()
+	}
+
+	r.log, err = os.OpenFile(r.SavePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, defFilePerm)
+	r.logLines = 0
+	r.dirty = false
+
+	return err
+}
+
+// Load restores links from the snapshot and replays the log over it.
+// A broken last line of the log means the process died in the middle
+// of a write, such line is dropped.
+//
+// When another process holds the lock file the storage is only read:
+// the log is neither repaired nor converted nor written.
+func (r *InFileStorage) Load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lock, err := lockFile(r.lockPath())
+
+	if err != nil {
+		r.Logger.Errorln("CANT LOCK STORAGE FILE:" + r.lockPath())
+		return err
+	}
+
+	if lock == nil {
+		r.Logger.Warnln("STORAGE FILE IS USED BY ANOTHER PROCESS. OPEN IT READ ONLY", "path", r.SavePath)
+	}
+
+	r.lock = lock
+
+	_, err = r.loadLines(r.snapshotPath(), false)
+
+	if err != nil {
+		r.Logger.Errorln("CANT LOAD SNAPSHOT:" + r.snapshotPath())
+		return err
+	}
+
+	lines, err := r.loadLines(r.SavePath, true)
+	legacy := errors.Is(err, errLegacyFormat)
+
+	if err != nil && !legacy {
+		r.Logger.Errorln("CANT LOAD STORAGE FILE:" + r.SavePath)
+		return err
+	}
+
+	err = r.loadClicks()
+
+	if err != nil {
+		r.Logger.Errorln("CANT LOAD CLICKS FROM FILE:" + r.clicksPath())
+		return err
+	}
+
+	r.keysMu.Lock()
+	err = r.loadAPIKeys()
+	r.keysMu.Unlock()
+
+	if err != nil {
+		r.Logger.Errorln("CANT LOAD API KEYS FROM FILE:" + r.keysPath())
+		return err
+	}
+
+	if r.lock == nil {
+		return nil
+	}
+
+	if legacy {
+		r.Logger.Infoln("OLD STORAGE FORMAT. CONVERT TO JSON LINES")
+		return r.compact()
+	}
+
+	r.log, err = os.OpenFile(r.SavePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, defFilePerm)
+	r.logLines = lines
+
+	return err
+}
+
+var errLegacyFormat = errors.New("LEGACY STORAGE FORMAT")
+
+// loadLines applies every line of the file to the memory and returns
+// how many lines were read.
+func (r *InFileStorage) loadLines(path string, isLog bool) (int, error) {
+	file, err := os.Open(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	var (
+		lines  int
+		goodAt int64
+	)
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, errRead := reader.ReadBytes('\n')
+
+		if errRead != nil && !errors.Is(errRead, io.EOF) {
+			return lines, errRead
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			lnkRec := LinkRecord{}
+			errJSON := json.Unmarshal(line, &lnkRec)
+
+			if lines == 0 && isLog && (errJSON != nil || lnkRec.ShortURL == "") && r.loadLegacy(line) == nil {
+				return lines, errLegacyFormat
+			}
+
+			// every complete line ends with a newline, so the last one
+			// without it is a torn write
+			if errors.Is(errRead, io.EOF) && isLog {
+				r.Logger.Infoln("DROP BROKEN LAST LINE OF STORAGE FILE", "offset", goodAt)
+
+				if r.lock == nil {
+					return lines, nil
+				}
+
+				return lines, os.Truncate(path, goodAt)
+			}
+
+			if errJSON != nil || lnkRec.ShortURL == "" {
+				return lines, fmt.Errorf("BROKEN LINE %d IN %s", lines+1, path)
+			}
+
+			r.put(lnkRec)
+			lines++
+		}
+
+		goodAt += int64(len(line))
+
+		if errors.Is(errRead, io.EOF) {
+			return lines, nil
+		}
+	}
+}
+
+// loadLegacy reads files written before the storage became a log:
+// a single JSON object of shorturl => record, or even shorturl => url.
+func (r *InFileStorage) loadLegacy(buffer []byte) error {
+	records := map[string]LinkRecord{}
+
+	if err := json.Unmarshal(buffer, &records); err == nil {
+		for k, v := range records {
+			v.ShortURL = k
+			r.put(v)
+		}
+
+		return nil
+	}
+
+	legacy := map[string]string{}
+
+	err := json.Unmarshal(buffer, &legacy)
+
+	if err != nil {
+		return err
+	}
+
+	for k, v := range legacy {
+		r.put(LinkRecord{ShortURL: k, URL: v})
+	}
+
+	return nil
+}
+
+// VisitorSalt is kept next to the storage file. The first process to
+// need it links a fully written file into place, so concurrent ones
+// can't see it half written or make two.
+func (r *InFileStorage) VisitorSalt(_ context.Context) ([]byte, error) {
+	salt, err := r.readVisitorSalt()
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return salt, err
+	}
+
+	salt, err = newVisitorSalt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.saltPath()), filepath.Base(r.saltPath())+".*.tmp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(hex.EncodeToString(salt))
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Link(tmp.Name(), r.saltPath())
+
+	if errors.Is(err, os.ErrExist) {
+		return r.readVisitorSalt()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+func (r *InFileStorage) readVisitorSalt() ([]byte, error) {
+	buffer, err := os.ReadFile(r.saltPath())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(string(bytes.TrimSpace(buffer)))
+}
+
+func (r *InFileStorage) saltPath() string {
+	return r.SavePath + ".salt"
+}
+
+// ReserveCounter keeps the counter next to the storage file. It is
+// written before the values are handed out, so a crash loses some
+// codes but never gives one twice. Only the owner of the storage may
+// take values.
+func (r *InFileStorage) ReserveCounter(_ context.Context, n uint64) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lock == nil {
+		return 0, ErrFileInUse
+	}
+
+	counter := uint64(0)
+	buffer, err := os.ReadFile(r.counterPath())
+
+	if err == nil {
+		counter, err = strconv.ParseUint(string(bytes.TrimSpace(buffer)), 10, 64)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	counter += n
+	tmpPath := r.counterPath() + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defFilePerm)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = file.WriteString(strconv.FormatUint(counter, 10))
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, r.counterPath())
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return counter, nil
+}
+
+func (r *InFileStorage) counterPath() string {
+	return r.SavePath + ".counter"
+}
+
+func (r *InFileStorage) Ping(_ context.Context) bool {
+	return true
+}
+
+// Close compacts the log only if this process wrote into it.
+func (r *InFileStorage) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+
+	if r.log != nil && r.dirty {
+		err = r.compact()
+	}
+
+	if r.log != nil {
+		if errClose := r.log.Close(); err == nil {
+			err = errClose
+		}
+
+		r.log = nil
+	}
+
+	r.clicksMu.Lock()
+
+	if r.clicksLog != nil {
+		if errClose := r.clicksLog.Close(); err == nil {
+			err = errClose
+		}
+
+		r.clicksLog = nil
+	}
+
+	r.clicksMu.Unlock()
+
+	if r.lock != nil {
+		if errClose := r.lock.Close(); err == nil {
+			err = errClose
+		}
+
+		r.lock = nil
+	}
+
+	return err
 }
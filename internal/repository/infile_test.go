@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openFileStorage(t *testing.T, path string) *InFileStorage {
+	t.Helper()
+
+	r, err := NewInFileStorage(logger.NewLogger(), path)
+	require.NoError(t, err)
+	require.NoError(t, r.Load())
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+// crash drops the storage like a killed process: nothing is compacted,
+// only the files are closed, which releases the lock.
+func crash(t *testing.T, r *InFileStorage) {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	require.NoError(t, r.log.Close())
+	require.NoError(t, r.lock.Close())
+	r.log, r.lock = nil, nil
+}
+
+func TestInFileStorageRecovery(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+
+	r := openFileStorage(t, path)
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "first", URL: "https://first.example.com", UserID: 1}))
+	_, err := r.BatchCreate(ctx, []LinkRecord{{ShortURL: "second", URL: "https://second.example.com", UserID: 1}})
+	require.NoError(t, err)
+	require.NoError(t, r.BatchDelete(ctx, []LinkRecord{{ShortURL: "second", UserID: 1}}))
+
+	// the process dies in the middle of the next write
+	crash(t, r)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, defFilePerm)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"short_url":"third","url":"https://thi`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	r = openFileStorage(t, path)
+
+	lnkRec, err := r.Get(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, "https://first.example.com", lnkRec.URL)
+
+	lnkRec, err = r.Get(ctx, "second")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.IsDeleted, "delete must be replayed from the log")
+
+	_, err = r.Get(ctx, "third")
+	assert.ErrorIs(t, err, ErrNotFound, "torn line must be dropped")
+
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "fourth", URL: "https://fourth.example.com"}))
+	require.NoError(t, r.Close())
+
+	log, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, log, "close must compact the log into the snapshot")
+
+	r = openFileStorage(t, path)
+
+	for _, id := range []string{"first", "second", "fourth"} {
+		_, err = r.Get(ctx, id)
+		assert.NoError(t, err, id)
+	}
+}
+
+func TestInFileStorageLegacyFormat(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"b8da4f2d":"www.ya.ru"}`), defFilePerm))
+
+	r := openFileStorage(t, path)
+
+	lnkRec, err := r.Get(ctx, "b8da4f2d")
+	require.NoError(t, err)
+	assert.Equal(t, "www.ya.ru", lnkRec.URL)
+
+	snapshot, err := os.ReadFile(path + ".snapshot")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(snapshot), `{"short_url":"b8da4f2d"`), "legacy file must be converted")
+}
+
+func TestInFileStorageKeepsTombstones(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+	now := time.Now()
+
+	r := openFileStorage(t, path)
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "old", URL: "https://old.example.com", ExpiresAt: now.Add(-time.Minute)}))
+
+	purged, err := r.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	// the process dies without compaction, the tombstone is in the log
+	crash(t, r)
+
+	r = openFileStorage(t, path)
+
+	lnkRec, err := r.Get(ctx, "old")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.isTombstone() && lnkRec.IsExpired(now))
+
+	_, err = r.GetByURL(ctx, "https://old.example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, r.Create(ctx, LinkRecord{ShortURL: "old", URL: "https://other.example.com"}), ErrShortURLTaken)
+}
+
+func TestInFileStorageReplaysFreedURL(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+
+	r := openFileStorage(t, path)
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "gone", URL: "https://again.example.com", UserID: 1}))
+	require.NoError(t, r.BatchDelete(ctx, []LinkRecord{{ShortURL: "gone", UserID: 1}}))
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "again", URL: "https://again.example.com", UserID: 1}))
+
+	crash(t, r)
+
+	r = openFileStorage(t, path)
+
+	shorturl, err := r.GetByURL(ctx, "https://again.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "again", shorturl, "the deleted link does not take its url back on replay")
+}
+
+func TestInFileStorageClicks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	r := openFileStorage(t, path)
+
+	// more clicks than raw clicks were ever kept, spread over two links
+	clicks := make([]Click, 0, 2*rawClicksPerLink)
+
+	for i := 0; i < rawClicksPerLink; i++ {
+		clicks = append(clicks, Click{ShortURL: "busy", Time: at, IPHash: "a"}, Click{ShortURL: "quiet", Time: at, IPHash: "b"})
+	}
+
+	require.NoError(t, r.SaveClicks(ctx, clicks[:len(clicks)-1]))
+	require.NoError(t, r.Close())
+
+	r = openFileStorage(t, path)
+
+	stats, err := r.GetStats(ctx, "busy")
+	require.NoError(t, err)
+	assert.Equal(t, rawClicksPerLink, stats.TotalClicks)
+	assert.Equal(t, 1, stats.UniqueVisitors)
+	assert.Equal(t, map[string]int{"2024-05-01": rawClicksPerLink}, stats.ByDay)
+
+	stats, err = r.GetStats(ctx, "quiet")
+	require.NoError(t, err)
+	assert.Equal(t, rawClicksPerLink-1, stats.TotalClicks)
+
+	// a crash in the middle of a write of older versions
+	require.NoError(t, r.Close())
+	require.NoError(t, os.WriteFile(path+".clicks", []byte(`{"busy":{"total":`), defFilePerm))
+
+	r = openFileStorage(t, path)
+
+	stats, err = r.GetStats(ctx, "busy")
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.TotalClicks, "broken clicks file starts empty")
+
+	// raw clicks saved by older versions
+	require.NoError(t, r.Close())
+	require.NoError(t, os.WriteFile(path+".clicks", []byte(`[{"short_url":"old","time":"2024-05-01T10:30:00Z","ip_hash":"a"}]`), defFilePerm))
+
+	r = openFileStorage(t, path)
+
+	stats, err = r.GetStats(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.TotalClicks)
+}
+
+func TestInFileStorageReplaysClickLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	owner := openFileStorage(t, path)
+	require.NoError(t, owner.SaveClicks(ctx, []Click{{ShortURL: "first", Time: at, IPHash: "a"}}))
+	require.NoError(t, owner.SaveClicks(ctx, []Click{{ShortURL: "first", Time: at, IPHash: "b"}}))
+
+	// the clicks are only appended, the snapshot is not written yet
+	_, err := os.Stat(path + ".clicks")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// a torn click of a crash is dropped, the next one is not glued to it
+	_, err = owner.clicksLog.WriteString(`{"short_url":"first","ti`)
+	require.NoError(t, err)
+	require.NoError(t, owner.clicksLog.Close())
+	require.NoError(t, owner.lock.Close())
+
+	r := openFileStorage(t, path)
+	require.NoError(t, r.SaveClicks(ctx, []Click{{ShortURL: "first", Time: at, IPHash: "a"}}))
+	require.NoError(t, r.Close())
+
+	r = openFileStorage(t, path)
+
+	stats, err := r.GetStats(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.TotalClicks)
+	assert.Equal(t, 2, stats.UniqueVisitors)
+}
+
+func TestInFileStorageSecondOpenerIsReadOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.json")
+
+	owner := openFileStorage(t, path)
+	require.NoError(t, owner.Create(ctx, LinkRecord{ShortURL: "first", URL: "https://first.example.com"}))
+
+	// a torn line the owner is still going to complete
+	_, err := owner.log.WriteString(`{"short_url":"second","url":"https://sec`)
+	require.NoError(t, err)
+
+	reader := openFileStorage(t, path)
+
+	lnkRec, err := reader.Get(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, "https://first.example.com", lnkRec.URL)
+
+	assert.ErrorIs(t, reader.Create(ctx, LinkRecord{ShortURL: "third", URL: "https://third.example.com"}), ErrFileInUse)
+	assert.ErrorIs(t, reader.SaveClicks(ctx, []Click{{ShortURL: "first"}}), ErrFileInUse)
+	require.NoError(t, reader.Close())
+
+	_, err = owner.log.WriteString("ond.example.com\"}\n")
+	require.NoError(t, err)
+
+	log, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(log), "\n"), "reader must neither compact nor truncate the log")
+
+	_, err = os.Stat(path + ".snapshot")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, owner.Close())
+
+	reader = openFileStorage(t, path)
+
+	_, err = reader.Get(ctx, "first")
+	assert.NoError(t, err)
+}
@@ -1,63 +1,488 @@
 package repository
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/DmitryM7/short-url.git/internal/logger"
 )
 
 const (
-	rLength int64 = 100
+	rLength    int64 = 100
+	shardCount       = 32
 )
 
+// InMemoryStorage is safe for concurrent use. Links are spread over
+// shards by short url and every shard has its own lock, so requests
+// for different links rarely wait for each other. The urls index
+// is sharded the same way by original url and makes GetByURL O(1).
+// Short urls are also kept sorted, so List seeks to its cursor.
 type InMemoryStorage struct {
-	Repo   map[string]string
 	Logger logger.MyLogger
+	links  [shardCount]*linkShard
+	urls   [shardCount]*urlShard
+	sorted *shortIndex
+	clicks *clickCounters
+	keys   *apiKeyStore
+	salt   []byte
+	// a pointer, the file storage copies this struct
+	counter *atomic.Uint64
+}
+
+type linkShard struct {
+	mu    sync.RWMutex
+	links map[string]LinkRecord
+}
+
+type urlShard struct {
+	mu   sync.RWMutex
+	urls map[string]string
+}
+
+// shortIndex is the sorted slice of all short urls. A short url is added
+// and removed under the lock of its shard, so the index agrees with the
+// shards.
+type shortIndex struct {
+	mu        sync.RWMutex
+	shortURLs []string
+}
+
+func (x *shortIndex) add(shorturl string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	i, found := slices.BinarySearch(x.shortURLs, shorturl)
+
+	if !found {
+		x.shortURLs = slices.Insert(x.shortURLs, i, shorturl)
+	}
+}
+
+func (x *shortIndex) remove(shorturl string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	i, found := slices.BinarySearch(x.shortURLs, shorturl)
+
+	if found {
+		x.shortURLs = slices.Delete(x.shortURLs, i, i+1)
+	}
+}
+
+// after returns at most n short urls which follow after in order.
+func (x *shortIndex) after(after string, n int) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	i, found := slices.BinarySearch(x.shortURLs, after)
+
+	if found {
+		i++
+	}
+
+	return slices.Clone(x.shortURLs[i:min(i+n, len(x.shortURLs))])
 }
 
 func NewInMemoryStorage(lg logger.MyLogger) (*InMemoryStorage, error) {
-	return &InMemoryStorage{
-		Logger: lg,
-		Repo:   make(map[string]string, rLength),
-	}, nil
+	salt, err := newVisitorSalt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &InMemoryStorage{
+		Logger:  lg,
+		clicks:  newClickCounters(),
+		keys:    newAPIKeyStore(),
+		salt:    salt,
+		sorted:  &shortIndex{},
+		counter: &atomic.Uint64{},
+	}
+
+	for i := 0; i < shardCount; i++ {
+		r.links[i] = &linkShard{links: make(map[string]LinkRecord, rLength)}
+		r.urls[i] = &urlShard{urls: make(map[string]string, rLength)}
+	}
+
+	return r, nil
+}
+
+func shardIndex(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % shardCount
+}
+
+func (r *InMemoryStorage) linkShard(shorturl string) *linkShard {
+	return r.links[shardIndex(shorturl)]
+}
+
+func (r *InMemoryStorage) urlShard(url string) *urlShard {
+	return r.urls[shardIndex(url)]
+}
+
+// put saves the record as is and keeps the urls index in sync. A deleted
+// link keeps its url but does not own it, so the url may be shortened
+// again.
+func (r *InMemoryStorage) put(lnkRec LinkRecord) {
+	ls := r.linkShard(lnkRec.ShortURL)
+
+	ls.mu.Lock()
+	old, existed := ls.links[lnkRec.ShortURL]
+	ls.links[lnkRec.ShortURL] = lnkRec
+
+	if !existed {
+		r.sorted.add(lnkRec.ShortURL)
+	}
+
+	ls.mu.Unlock()
+
+	if existed && (old.URL != lnkRec.URL || lnkRec.IsDeleted) {
+		r.unindexURL(old)
+	}
+
+	if lnkRec.IsDeleted {
+		return
+	}
+
+	us := r.urlShard(lnkRec.URL)
+
+	us.mu.Lock()
+	us.urls[lnkRec.URL] = lnkRec.ShortURL
+	us.mu.Unlock()
 }
 
-func (r *InMemoryStorage) Create(lnkRec LinkRecord) error {
-	r.Repo[lnkRec.ShortURL] = lnkRec.URL
+// insert saves the record unless its url is already shortened, then it
+// returns ErrConflict, or its short url belongs to another url, then it
+// returns ErrShortURLTaken. The url shard stays locked until the link is
+// saved, so the same url can't be inserted twice.
+func (r *InMemoryStorage) insert(lnkRec LinkRecord) error {
+	us := r.urlShard(lnkRec.URL)
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if shorturl, ok := us.urls[lnkRec.URL]; ok {
+		return &ErrConflict{ShortURL: shorturl}
+	}
+
+	ls := r.linkShard(lnkRec.ShortURL)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if _, ok := ls.links[lnkRec.ShortURL]; ok {
+		return ErrShortURLTaken
+	}
+
+	ls.links[lnkRec.ShortURL] = LinkRecord{
+		ShortURL:  lnkRec.ShortURL,
+		URL:       lnkRec.URL,
+		UserID:    lnkRec.UserID,
+		ExpiresAt: lnkRec.ExpiresAt,
+	}
+	us.urls[lnkRec.URL] = lnkRec.ShortURL
+	r.sorted.add(lnkRec.ShortURL)
+
 	return nil
 }
 
-func (r *InMemoryStorage) BatchCreate(lnkRecs []LinkRecord) error {
+// remove drops links which insert has just saved.
+func (r *InMemoryStorage) remove(lnkRecs []LinkRecord) {
 	for _, v := range lnkRecs {
-		err := r.Create(v)
+		ls := r.linkShard(v.ShortURL)
 
-		if err != nil {
-			return err
+		ls.mu.Lock()
+		delete(ls.links, v.ShortURL)
+		r.sorted.remove(v.ShortURL)
+		ls.mu.Unlock()
+
+		r.unindexURL(v)
+	}
+}
+
+func (r *InMemoryStorage) unindexURL(lnkRec LinkRecord) {
+	us := r.urlShard(lnkRec.URL)
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.urls[lnkRec.URL] == lnkRec.ShortURL {
+		delete(us.urls, lnkRec.URL)
+	}
+}
+
+// each calls fn for every record. The records of a shard are copied
+// under its read lock and fn runs after the lock is released, so a slow
+// fn holds no writer up. fn sees a snapshot of every shard, not of the
+// whole storage.
+func (r *InMemoryStorage) each(fn func(lnkRec LinkRecord)) {
+	var recs []LinkRecord
+
+	for _, ls := range r.links {
+		ls.mu.RLock()
+		recs = recs[:0]
+
+		for _, v := range ls.links {
+			recs = append(recs, v)
+		}
+
+		ls.mu.RUnlock()
+
+		for _, v := range recs {
+			fn(v)
+		}
+	}
+}
+
+func (r *InMemoryStorage) Create(_ context.Context, lnkRec LinkRecord) error {
+	return r.insert(lnkRec)
+}
+
+// BatchCreate does not touch urls which are already shortened, their
+// results carry the short url they have. When a short url is taken
+// the links saved so far are removed and the batch fails.
+func (r *InMemoryStorage) BatchCreate(_ context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(lnkRecs))
+	inserted := make([]LinkRecord, 0, len(lnkRecs))
+
+	for _, v := range lnkRecs {
+		res := BatchResult{LinkRecord: v, Status: BatchCreated}
+		err := r.insert(v)
+
+		var conflict *ErrConflict
+
+		switch {
+		case errors.As(err, &conflict):
+			res.ShortURL = conflict.ShortURL
+			res.Status = BatchExisting
+		case err != nil:
+			r.remove(inserted)
+			return nil, err
+		default:
+			inserted = append(inserted, v)
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// BatchDelete frees urls of deleted links, see put.
+func (r *InMemoryStorage) BatchDelete(_ context.Context, lnkRecs []LinkRecord) error {
+	for _, v := range lnkRecs {
+		ls := r.linkShard(v.ShortURL)
+
+		ls.mu.Lock()
+		l, ok := ls.links[v.ShortURL]
+		ok = ok && l.UserID == v.UserID
+
+		if ok {
+			l.IsDeleted = true
+			ls.links[v.ShortURL] = l
+		}
+
+		ls.mu.Unlock()
+
+		if ok {
+			r.unindexURL(l)
 		}
 	}
 
 	return nil
 }
 
-func (r *InMemoryStorage) Get(shorturl string) (string, error) {
-	l, err := r.Repo[shorturl]
+// PurgeExpired turns expired links into tombstones.
+func (r *InMemoryStorage) PurgeExpired(_ context.Context, now time.Time) (int, error) {
+	purged := []LinkRecord{}
+
+	for _, ls := range r.links {
+		ls.mu.Lock()
+
+		for k, v := range ls.links {
+			if v.purgeable(now) {
+				ls.links[k] = v.tombstone()
+				purged = append(purged, v)
+			}
+		}
+
+		ls.mu.Unlock()
+	}
+
+	for _, v := range purged {
+		r.unindexURL(v)
+	}
+
+	return len(purged), nil
+}
+
+func (r *InMemoryStorage) Get(_ context.Context, shorturl string) (LinkRecord, error) {
+	ls := r.linkShard(shorturl)
+
+	ls.mu.RLock()
+	l, ok := ls.links[shorturl]
+	ls.mu.RUnlock()
 
-	if !err {
-		return "", fmt.Errorf("CAN'T FIND LINK BY HASH")
+	if !ok {
+		return LinkRecord{}, ErrNotFound
 	}
 
 	return l, nil
 }
 
-func (r *InMemoryStorage) GetByURL(url string) (string, error) {
-	for k, v := range r.Repo {
-		if v == url {
-			return k, nil
-		}
+func (r *InMemoryStorage) GetByURL(_ context.Context, url string) (string, error) {
+	us := r.urlShard(url)
+
+	us.mu.RLock()
+	shorturl, ok := us.urls[url]
+	us.mu.RUnlock()
+
+	if !ok {
+		return "", ErrNotFound
 	}
-	return "", fmt.Errorf("NO URL IN REPO")
+
+	return shorturl, nil
+}
+
+func (r *InMemoryStorage) GetByUser(_ context.Context, userID int) ([]LinkRecord, error) {
+	lnkRecs := []LinkRecord{}
+
+	r.each(func(v LinkRecord) {
+		if v.UserID == userID && !v.IsDeleted {
+			lnkRecs = append(lnkRecs, v)
+		}
+	})
+
+	return lnkRecs, nil
+}
+
+func (r *InMemoryStorage) SaveClicks(_ context.Context, clicks []Click) error {
+	r.clicks.add(clicks...)
+	return nil
+}
+
+func (r *InMemoryStorage) GetStats(_ context.Context, shorturl string) (LinkStats, error) {
+	return r.clicks.stats(shorturl), nil
 }
 
-func (r *InMemoryStorage) Ping() bool {
+// VisitorSalt lives as long as the process, the same as the clicks.
+func (r *InMemoryStorage) VisitorSalt(_ context.Context) ([]byte, error) {
+	return r.salt, nil
+}
+
+// ReserveCounter starts from scratch with every process, nothing else
+// shares the storage.
+func (r *InMemoryStorage) ReserveCounter(_ context.Context, n uint64) (uint64, error) {
+	return r.counter.Add(n), nil
+}
+
+func (r *InMemoryStorage) Ping(_ context.Context) bool {
 	return true
 }
+
+func (r *InMemoryStorage) Close() error {
+	return nil
+}
+
+func (r *InMemoryStorage) CreateAPIKey(_ context.Context, apiKey APIKey) error {
+	r.keys.put(apiKey)
+	return nil
+}
+
+func (r *InMemoryStorage) GetAPIKey(_ context.Context, hash string) (APIKey, error) {
+	return r.keys.get(hash)
+}
+
+func (r *InMemoryStorage) ListAPIKeys(_ context.Context) ([]APIKey, error) {
+	return r.keys.all(), nil
+}
+
+func (r *InMemoryStorage) RevokeAPIKey(_ context.Context, id string, at time.Time) error {
+	return r.keys.revoke(id, at)
+}
+
+func (r *InMemoryStorage) Iterate(ctx context.Context, fn func(LinkRecord) error) error {
+	var err error
+
+	r.each(func(v LinkRecord) {
+		if err == nil {
+			err = ctx.Err()
+		}
+
+		if err == nil && !v.isTombstone() {
+			err = fn(v)
+		}
+	})
+
+	return err
+}
+
+func (r *InMemoryStorage) CountLinks(ctx context.Context) (int, error) {
+	count := 0
+
+	r.each(func(v LinkRecord) {
+		if !v.IsDeleted && !v.isTombstone() {
+			count++
+		}
+	})
+
+	return count, ctx.Err()
+}
+
+func (r *InMemoryStorage) Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	plan := r.newUpsertPlan()
+	results := make([]BatchResult, 0, len(lnkRecs))
+
+	for _, v := range lnkRecs {
+		res, err := plan.result(ctx, v)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if isWritten(res) {
+			r.put(res.LinkRecord)
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// List seeks to the cursor in the sorted index and reads links from
+// there a page at a time until the page is full.
+func (r *InMemoryStorage) List(ctx context.Context, q ListQuery) ([]LinkRecord, error) {
+	lnkRecs := make([]LinkRecord, 0, q.Limit)
+	after := q.After
+
+	for len(lnkRecs) < q.Limit {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		shortURLs := r.sorted.after(after, q.Limit)
+
+		if len(shortURLs) == 0 {
+			break
+		}
+
+		for _, v := range shortURLs {
+			lnkRec, err := r.Get(ctx, v)
+
+			if err == nil && q.matches(lnkRec) && len(lnkRecs) < q.Limit {
+				lnkRecs = append(lnkRecs, lnkRec)
+			}
+		}
+
+		after = shortURLs[len(shortURLs)-1]
+	}
+
+	return lnkRecs, nil
+}
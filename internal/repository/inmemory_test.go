@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStorageConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+
+	r, err := NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	const workers, links = 8, 200
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < links; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				url := "https://concurrent.example.com/" + id
+
+				assert.NoError(t, r.Create(ctx, LinkRecord{ShortURL: id, URL: url, UserID: w}))
+
+				shorturl, err := r.GetByURL(ctx, url)
+				assert.NoError(t, err)
+				assert.Equal(t, id, shorturl)
+
+				assert.NoError(t, r.BatchDelete(ctx, []LinkRecord{{ShortURL: id, UserID: w}}))
+				_, err = r.PurgeExpired(ctx, time.Now())
+				assert.NoError(t, err)
+				_, err = r.GetByUser(ctx, w)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	lnkRec, err := r.Get(ctx, "0-0")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.IsDeleted)
+}
+
+func TestInMemoryStorageURLIndex(t *testing.T) {
+	ctx := context.Background()
+
+	r, err := NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "code", URL: "https://old.example.com"}))
+	assert.ErrorIs(t, r.Create(ctx, LinkRecord{ShortURL: "code", URL: "https://new.example.com"}), ErrShortURLTaken)
+
+	_, err = r.Upsert(ctx, []LinkRecord{{ShortURL: "code", URL: "https://new.example.com"}})
+	require.NoError(t, err)
+
+	_, err = r.GetByURL(ctx, "https://old.example.com")
+	assert.ErrorIs(t, err, ErrNotFound, "overwritten url must leave the index")
+
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "short", URL: "https://short.example.com", ExpiresAt: time.Now()}))
+
+	purged, err := r.PurgeExpired(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	_, err = r.GetByURL(ctx, "https://short.example.com")
+	assert.ErrorIs(t, err, ErrNotFound, "purged url must leave the index")
+}
+
+func TestInMemoryStorageListIndex(t *testing.T) {
+	ctx := context.Background()
+
+	r, err := NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: fmt.Sprintf("c%02d", i), URL: fmt.Sprintf("https://%d.example.com", i)}))
+	}
+
+	_, err = r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "a00", URL: "https://a.example.com"},
+		{ShortURL: "c00", URL: "https://taken.example.com"},
+	})
+	require.ErrorIs(t, err, ErrShortURLTaken)
+
+	_, err = r.Upsert(ctx, []LinkRecord{{ShortURL: "d00", URL: "https://d.example.com"}})
+	require.NoError(t, err)
+
+	require.NoError(t, r.BatchDelete(ctx, []LinkRecord{{ShortURL: "c11"}, {ShortURL: "c12"}}))
+
+	page, err := r.List(ctx, ListQuery{Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, page, 3)
+	assert.Equal(t, "c00", page[0].ShortURL, "removed links leave the index")
+
+	page, err = r.List(ctx, ListQuery{After: "c10", Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, []string{"c13", "c14"}, []string{page[0].ShortURL, page[1].ShortURL}, "deleted links are skipped")
+
+	page, err = r.List(ctx, ListQuery{After: "c485", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, []string{"c49", "d00"}, []string{page[0].ShortURL, page[1].ShortURL})
+}
@@ -0,0 +1,1004 @@
+package repository
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisPrefix       = "shortener:"
+	maxUpsertAttempts = 3
+	scanCount         = 500
+)
+
+// InRedisStorage keeps every link in a hash link:<shorturl>. Next to it live
+// the url:<url> => shorturl index, the user:<id> set of short urls, the
+// expires sorted set scored by expiry time for the reaper and the links
+// sorted set of short urls which are not deleted, all scored 0, which
+// pages and counts links. API keys are
+// hashes apikey:<id> indexed by apikey:hash:<hash> and listed in apikeys.
+type InRedisStorage struct {
+	Logger logger.MyLogger
+	Addr   string
+	client *redis.Client
+}
+
+// deleteScript marks a link deleted only if it belongs to the user and
+// frees its url, a deleted link does not own it. KEYS are the link and
+// the links set, ARGV the user id, short url and prefix of url keys.
+var deleteScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'userid') == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'deleted', '1')
+	redis.call('ZREM', KEYS[2], ARGV[2])
+	local url = ARGV[3] .. redis.call('HGET', KEYS[1], 'url')
+	if redis.call('GET', url) == ARGV[2] then
+		redis.call('DEL', url)
+	end
+	return 1
+end
+return 0
+`)
+
+// indexScript puts a link into the links set if it is not deleted.
+// KEYS are the link and the links set, ARGV the short url.
+var indexScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'url', 'deleted')
+if fields[1] and fields[1] ~= '' and fields[2] == '0' then
+	redis.call('ZADD', KEYS[2], 0, ARGV[1])
+end
+return 0
+`)
+
+// createScript writes the links of a batch whose urls are not shortened
+// yet. KEYS are the expires and links sets and then link, url and user
+// keys of every link, ARGV are short url, url, user id, expiry and its score of every
+// link. It returns "ok" and the short urls which already own the urls,
+// empty for created links, or "taken" when a short url is taken by
+// another url.
+var createScript = redis.NewScript(`
+local owners, codes, result = {}, {}, {'ok'}
+local n = #ARGV / 5
+for i = 0, n - 1 do
+	local link, url = KEYS[3 + i * 3], KEYS[4 + i * 3]
+	local owner = owners[url] or redis.call('GET', url)
+	if owner then
+		result[i + 2] = owner
+	elseif codes[link] or redis.call('EXISTS', link) == 1 then
+		return {'taken'}
+	else
+		owners[url] = ARGV[1 + i * 5]
+		codes[link] = true
+		result[i + 2] = ''
+	end
+end
+for i = 0, n - 1 do
+	if result[i + 2] == '' then
+		local link, url, user = KEYS[3 + i * 3], KEYS[4 + i * 3], KEYS[5 + i * 3]
+		local shorturl, expires, score = ARGV[1 + i * 5], ARGV[4 + i * 5], ARGV[5 + i * 5]
+		redis.call('HSET', link, 'url', ARGV[2 + i * 5], 'userid', ARGV[3 + i * 5], 'deleted', '0', 'expires', expires)
+		if score ~= '' then
+			redis.call('ZADD', KEYS[1], score, shorturl)
+		else
+			redis.call('ZREM', KEYS[1], shorturl)
+		end
+		redis.call('SET', url, shorturl)
+		redis.call('SADD', user, shorturl)
+		redis.call('ZADD', KEYS[2], 0, shorturl)
+	end
+end
+return result
+`)
+
+// NewInRedisStorage accepts either host:port or a redis:// url.
+func NewInRedisStorage(lg logger.MyLogger, addr string) (*InRedisStorage, error) {
+	st := &InRedisStorage{
+		Logger: lg,
+		Addr:   addr,
+	}
+
+	opts := &redis.Options{Addr: addr}
+
+	if strings.Contains(addr, "://") {
+		var err error
+
+		opts, err = redis.ParseURL(addr)
+
+		if err != nil {
+			return st, err
+		}
+	}
+
+	st.client = redis.NewClient(opts)
+
+	err := st.client.Ping(context.Background()).Err()
+
+	if err == nil {
+		err = st.indexLinks(context.Background())
+	}
+
+	if err != nil {
+		st.client.Close()
+		return st, err
+	}
+
+	return st, nil
+}
+
+// indexLinks fills the links set from the link hashes once, links which
+// were written before it existed get into it this way.
+func (r *InRedisStorage) indexLinks(ctx context.Context) error {
+	done, err := r.client.Exists(ctx, linksIndexedKey()).Result()
+
+	if err != nil || done == 1 {
+		return err
+	}
+
+	r.Logger.Infoln("INDEX REDIS LINKS")
+
+	err = r.Iterate(ctx, func(lnkRec LinkRecord) error {
+		return indexScript.Run(ctx, r.client, []string{linkKey(lnkRec.ShortURL), linksKey()}, lnkRec.ShortURL).Err()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return r.client.Set(ctx, linksIndexedKey(), "1", 0).Err()
+}
+
+func linkKey(shorturl string) string {
+	return redisPrefix + "link:" + shorturl
+}
+
+func urlKey(url string) string {
+	return redisPrefix + "url:" + url
+}
+
+func userKey(userID int) string {
+	return redisPrefix + "user:" + strconv.Itoa(userID)
+}
+
+func expiresKey() string {
+	return redisPrefix + "expires"
+}
+
+func linksKey() string {
+	return redisPrefix + "links"
+}
+
+func linksIndexedKey() string {
+	return redisPrefix + "links:indexed"
+}
+
+func clicksKey(shorturl string) string {
+	return redisPrefix + "clicks:" + shorturl
+}
+
+func clicksTotalKey(shorturl string) string {
+	return redisPrefix + "clicks:total:" + shorturl
+}
+
+func visitorsKey(shorturl string) string {
+	return redisPrefix + "clicks:visitors:" + shorturl
+}
+
+func byDayKey(shorturl string) string {
+	return redisPrefix + "clicks:day:" + shorturl
+}
+
+func counterKey() string {
+	return "counter"
+}
+
+func visitorSaltKey() string {
+	return redisPrefix + "visitor_salt"
+}
+
+func byHourKey(shorturl string) string {
+	return redisPrefix + "clicks:hour:" + shorturl
+}
+
+func (r *InRedisStorage) create(ctx context.Context, pipe redis.Pipeliner, lnkRec LinkRecord) {
+	fields := map[string]interface{}{
+		"url":     lnkRec.URL,
+		"userid":  lnkRec.UserID,
+		"deleted": "0",
+		"expires": "",
+	}
+
+	if !lnkRec.ExpiresAt.IsZero() {
+		fields["expires"] = lnkRec.ExpiresAt.UTC().Format(time.RFC3339Nano)
+		pipe.ZAdd(ctx, expiresKey(), redis.Z{Score: float64(lnkRec.ExpiresAt.Unix()), Member: lnkRec.ShortURL})
+	} else {
+		pipe.ZRem(ctx, expiresKey(), lnkRec.ShortURL)
+	}
+
+	pipe.HSet(ctx, linkKey(lnkRec.ShortURL), fields)
+	pipe.SAdd(ctx, userKey(lnkRec.UserID), lnkRec.ShortURL)
+
+	if lnkRec.IsDeleted {
+		pipe.HSet(ctx, linkKey(lnkRec.ShortURL), "deleted", "1")
+		pipe.ZRem(ctx, linksKey(), lnkRec.ShortURL)
+	} else {
+		pipe.Set(ctx, urlKey(lnkRec.URL), lnkRec.ShortURL, 0)
+		pipe.ZAdd(ctx, linksKey(), redis.Z{Member: lnkRec.ShortURL})
+	}
+}
+
+func (r *InRedisStorage) Create(ctx context.Context, lnkRec LinkRecord) error {
+	results, err := r.BatchCreate(ctx, []LinkRecord{lnkRec})
+
+	if err != nil {
+		return err
+	}
+
+	if results[0].Status == BatchExisting {
+		return &ErrConflict{ShortURL: results[0].ShortURL}
+	}
+
+	return nil
+}
+
+// BatchCreate runs createScript, so the whole batch is checked and
+// written at once: a url which is already shortened keeps its short url,
+// and a short url which is already taken fails the batch before anything
+// is written.
+func (r *InRedisStorage) BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	if len(lnkRecs) == 0 {
+		return []BatchResult{}, nil
+	}
+
+	keys := make([]string, 0, 2+len(lnkRecs)*3)
+	args := make([]interface{}, 0, len(lnkRecs)*5)
+
+	keys = append(keys, expiresKey(), linksKey())
+
+	for _, v := range lnkRecs {
+		expires, score := "", ""
+
+		if !v.ExpiresAt.IsZero() {
+			expires = v.ExpiresAt.UTC().Format(time.RFC3339Nano)
+			score = strconv.FormatInt(v.ExpiresAt.Unix(), 10)
+		}
+
+		keys = append(keys, linkKey(v.ShortURL), urlKey(v.URL), userKey(v.UserID))
+		args = append(args, v.ShortURL, v.URL, v.UserID, expires, score)
+	}
+
+	owners, err := createScript.Run(ctx, r.client, keys, args...).StringSlice()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if owners[0] != "ok" {
+		return nil, ErrShortURLTaken
+	}
+
+	results := make([]BatchResult, len(lnkRecs))
+
+	for k, v := range lnkRecs {
+		results[k] = BatchResult{LinkRecord: v, Status: BatchCreated}
+
+		if owners[k+1] != "" {
+			results[k].ShortURL = owners[k+1]
+			results[k].Status = BatchExisting
+		}
+	}
+
+	return results, nil
+}
+
+// Upsert writes every link in its own WATCH transaction over the link
+// and its url, which is tried again if another client changed them.
+func (r *InRedisStorage) Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(lnkRecs))
+
+	for _, v := range lnkRecs {
+		v.CorrelationID = ""
+
+		var (
+			res BatchResult
+			err error
+		)
+
+		for i := 0; i < maxUpsertAttempts; i++ {
+			res, err = r.upsert(ctx, v)
+
+			if !errors.Is(err, redis.TxFailedErr) {
+				break
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+func (r *InRedisStorage) upsert(ctx context.Context, lnkRec LinkRecord) (BatchResult, error) {
+	res := BatchResult{LinkRecord: lnkRec, Status: BatchCreated}
+
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.Get(ctx, urlKey(lnkRec.URL)).Result()
+
+		if err == nil && owner != lnkRec.ShortURL {
+			res.ShortURL = owner
+			res.Status = BatchExisting
+			return nil
+		}
+
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		fields, err := tx.HGetAll(ctx, linkKey(lnkRec.ShortURL)).Result()
+
+		if err != nil {
+			return err
+		}
+
+		var old LinkRecord
+
+		if len(fields) > 0 {
+			if old, err = linkFromHash(lnkRec.ShortURL, fields); err != nil {
+				return err
+			}
+
+			if old.sameAs(lnkRec) {
+				res.Status = BatchUnchanged
+				return nil
+			}
+
+			res.Status = BatchUpdated
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// only a live link owns its url
+			if res.Status == BatchUpdated && old.URL != lnkRec.URL && !old.IsDeleted {
+				pipe.Del(ctx, urlKey(old.URL))
+			}
+
+			if lnkRec.IsDeleted && owner == lnkRec.ShortURL {
+				pipe.Del(ctx, urlKey(lnkRec.URL))
+			}
+
+			if res.Status == BatchUpdated && old.UserID != lnkRec.UserID {
+				pipe.SRem(ctx, userKey(old.UserID), lnkRec.ShortURL)
+			}
+
+			r.create(ctx, pipe, lnkRec)
+
+			return nil
+		})
+
+		return err
+	}, urlKey(lnkRec.URL), linkKey(lnkRec.ShortURL))
+
+	return res, err
+}
+
+func (r *InRedisStorage) BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error {
+	if len(lnkRecs) == 0 {
+		return nil
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, v := range lnkRecs {
+			deleteScript.Eval(ctx, pipe, []string{linkKey(v.ShortURL), linksKey()}, v.UserID, v.ShortURL, urlKey(""))
+		}
+		return nil
+	})
+
+	return err
+}
+
+// PurgeExpired leaves a tombstone in the link hash and frees the url.
+// Every link is purged in its own WATCH transaction, which is tried
+// again if another client changed the link meanwhile.
+func (r *InRedisStorage) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	shortURLs, err := r.client.ZRangeByScore(ctx, expiresKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+
+	for _, v := range shortURLs {
+		var (
+			lnkRec LinkRecord
+			err    error
+		)
+
+		for i := 0; i < maxUpsertAttempts; i++ {
+			lnkRec, err = r.purge(ctx, v, now)
+
+			if !errors.Is(err, redis.TxFailedErr) {
+				break
+			}
+		}
+
+		if err != nil {
+			return purged, err
+		}
+
+		if lnkRec.ShortURL != "" {
+			r.unindexURL(ctx, lnkRec)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// purge tombstones the link if it is still expired and returns what it
+// was. A zero record means nothing was purged.
+func (r *InRedisStorage) purge(ctx context.Context, shorturl string, now time.Time) (LinkRecord, error) {
+	var purged LinkRecord
+
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, linkKey(shorturl)).Result()
+
+		if err != nil {
+			return err
+		}
+
+		if len(fields) == 0 {
+			return tx.ZRem(ctx, expiresKey(), shorturl).Err()
+		}
+
+		lnkRec, err := linkFromHash(shorturl, fields)
+
+		if err != nil {
+			return err
+		}
+
+		if lnkRec.isTombstone() {
+			return tx.ZRem(ctx, expiresKey(), shorturl).Err()
+		}
+
+		if !lnkRec.purgeable(now) {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, linkKey(shorturl), "url", "", "userid", 0, "deleted", "1")
+			pipe.SRem(ctx, userKey(lnkRec.UserID), shorturl)
+			pipe.ZRem(ctx, expiresKey(), shorturl)
+			pipe.ZRem(ctx, linksKey(), shorturl)
+			return nil
+		})
+
+		if err == nil {
+			purged = lnkRec
+		}
+
+		return err
+	}, linkKey(shorturl))
+
+	return purged, err
+}
+
+// unindexURL drops url:<url> only when it still points to the link,
+// the same url may have been shortened again since.
+func (r *InRedisStorage) unindexURL(ctx context.Context, lnkRec LinkRecord) {
+	key := urlKey(lnkRec.URL)
+
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		shorturl, err := tx.Get(ctx, key).Result()
+
+		if err != nil || shorturl != lnkRec.ShortURL {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+
+		return err
+	}, key)
+
+	if err != nil {
+		r.Logger.Errorln("CANT UNINDEX URL:" + err.Error())
+	}
+}
+
+func (r *InRedisStorage) Get(ctx context.Context, shorturl string) (LinkRecord, error) {
+	fields, err := r.client.HGetAll(ctx, linkKey(shorturl)).Result()
+
+	if err != nil {
+		return LinkRecord{}, err
+	}
+
+	if len(fields) == 0 {
+		return LinkRecord{}, ErrNotFound
+	}
+
+	return linkFromHash(shorturl, fields)
+}
+
+func linkFromHash(shorturl string, fields map[string]string) (LinkRecord, error) {
+	lnkRec := LinkRecord{
+		ShortURL:  shorturl,
+		URL:       fields["url"],
+		IsDeleted: fields["deleted"] == "1",
+	}
+
+	userID, err := strconv.Atoi(fields["userid"])
+
+	if err != nil {
+		return LinkRecord{}, err
+	}
+
+	lnkRec.UserID = userID
+
+	if fields["expires"] != "" {
+		lnkRec.ExpiresAt, err = time.Parse(time.RFC3339Nano, fields["expires"])
+
+		if err != nil {
+			return LinkRecord{}, err
+		}
+	}
+
+	return lnkRec, nil
+}
+
+func (r *InRedisStorage) GetByURL(ctx context.Context, url string) (string, error) {
+	shorturl, err := r.client.Get(ctx, urlKey(url)).Result()
+
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+
+	return shorturl, err
+}
+
+func (r *InRedisStorage) GetByUser(ctx context.Context, userID int) ([]LinkRecord, error) {
+	shortURLs, err := r.client.SMembers(ctx, userKey(userID)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(shortURLs))
+
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for k, v := range shortURLs {
+			cmds[k] = pipe.HGetAll(ctx, linkKey(v))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	lnkRecs := []LinkRecord{}
+
+	for k, v := range cmds {
+		fields := v.Val()
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		lnkRec, err := linkFromHash(shortURLs[k], fields)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if lnkRec.UserID == userID && !lnkRec.IsDeleted {
+			lnkRecs = append(lnkRecs, lnkRec)
+		}
+	}
+
+	return lnkRecs, nil
+}
+
+// SaveClicks keeps the last rawClicksPerLink raw events of a link and
+// maintains the counters GetStats needs. Unique visitors go into a
+// HyperLogLog, so the key stays at a fixed size however popular the link
+// gets, just like the visitorSketch of the memory and file storages.
+func (r *InRedisStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, v := range clicks {
+			j, err := json.Marshal(v)
+
+			if err != nil {
+				return err
+			}
+
+			t := v.Time.UTC()
+
+			pipe.LPush(ctx, clicksKey(v.ShortURL), j)
+			pipe.LTrim(ctx, clicksKey(v.ShortURL), 0, rawClicksPerLink-1)
+			pipe.Incr(ctx, clicksTotalKey(v.ShortURL))
+			pipe.PFAdd(ctx, visitorsKey(v.ShortURL), v.IPHash)
+			pipe.HIncrBy(ctx, byDayKey(v.ShortURL), t.Format(statsDayFmt), 1)
+			pipe.HIncrBy(ctx, byHourKey(v.ShortURL), t.Format(statsHourFmt), 1)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (r *InRedisStorage) GetStats(ctx context.Context, shorturl string) (LinkStats, error) {
+	var (
+		total    *redis.StringCmd
+		visitors *redis.IntCmd
+		byDay    *redis.MapStringStringCmd
+		byHour   *redis.MapStringStringCmd
+	)
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		total = pipe.Get(ctx, clicksTotalKey(shorturl))
+		visitors = pipe.PFCount(ctx, visitorsKey(shorturl))
+		byDay = pipe.HGetAll(ctx, byDayKey(shorturl))
+		byHour = pipe.HGetAll(ctx, byHourKey(shorturl))
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return LinkStats{}, err
+	}
+
+	stats := newLinkStats()
+
+	if total.Err() == nil {
+		stats.TotalClicks, err = total.Int()
+
+		if err != nil {
+			return LinkStats{}, err
+		}
+	}
+
+	stats.UniqueVisitors = int(visitors.Val())
+
+	for _, h := range []struct {
+		cmd  *redis.MapStringStringCmd
+		dest map[string]int
+	}{{byDay, stats.ByDay}, {byHour, stats.ByHour}} {
+		for k, v := range h.cmd.Val() {
+			n, err := strconv.Atoi(v)
+
+			if err != nil {
+				return LinkStats{}, err
+			}
+
+			h.dest[k] = n
+		}
+	}
+
+	return stats, nil
+}
+
+// VisitorSalt is set only by the first replica to need it.
+func (r *InRedisStorage) VisitorSalt(ctx context.Context) ([]byte, error) {
+	salt, err := newVisitorSalt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.client.SetNX(ctx, visitorSaltKey(), hex.EncodeToString(salt), 0).Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := r.client.Get(ctx, visitorSaltKey()).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(value)
+}
+
+// ReserveCounter takes the values with one INCRBY, so replicas never
+// get the same ones.
+func (r *InRedisStorage) ReserveCounter(ctx context.Context, n uint64) (uint64, error) {
+	last, err := r.client.IncrBy(ctx, counterKey(), int64(n)).Result()
+
+	return uint64(last), err
+}
+
+func (r *InRedisStorage) Ping(ctx context.Context) bool {
+	return r.client.Ping(ctx).Err() == nil
+}
+
+func (r *InRedisStorage) Close() error {
+	return r.client.Close()
+}
+
+// revokeScript keeps the first revocation time of a key.
+var revokeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSETNX', KEYS[1], 'revoked_at', ARGV[1])
+return 1
+`)
+
+func apiKeyKey(id string) string {
+	return redisPrefix + "apikey:" + id
+}
+
+func apiKeyHashKey(hash string) string {
+	return redisPrefix + "apikey:hash:" + hash
+}
+
+func apiKeysKey() string {
+	return redisPrefix + "apikeys"
+}
+
+func (r *InRedisStorage) CreateAPIKey(ctx context.Context, apiKey APIKey) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, apiKeyKey(apiKey.ID), map[string]interface{}{
+			"name":       apiKey.Name,
+			"hash":       apiKey.Hash,
+			"scopes":     joinScopes(apiKey.Scopes),
+			"userid":     apiKey.UserID,
+			"created_at": apiKey.CreatedAt.UTC().Format(time.RFC3339Nano),
+		})
+		pipe.Set(ctx, apiKeyHashKey(apiKey.Hash), apiKey.ID, 0)
+		pipe.SAdd(ctx, apiKeysKey(), apiKey.ID)
+		return nil
+	})
+
+	return err
+}
+
+func (r *InRedisStorage) GetAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	id, err := r.client.Get(ctx, apiKeyHashKey(hash)).Result()
+
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, ErrNotFound
+	}
+
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return r.getAPIKey(ctx, id)
+}
+
+func (r *InRedisStorage) getAPIKey(ctx context.Context, id string) (APIKey, error) {
+	fields, err := r.client.HGetAll(ctx, apiKeyKey(id)).Result()
+
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	if len(fields) == 0 {
+		return APIKey{}, ErrNotFound
+	}
+
+	return apiKeyFromHash(id, fields)
+}
+
+func apiKeyFromHash(id string, fields map[string]string) (APIKey, error) {
+	apiKey := APIKey{
+		ID:     id,
+		Name:   fields["name"],
+		Hash:   fields["hash"],
+		Scopes: splitScopes(fields["scopes"]),
+	}
+
+	var err error
+
+	if apiKey.UserID, err = strconv.Atoi(fields["userid"]); err != nil {
+		return apiKey, err
+	}
+
+	if apiKey.CreatedAt, err = time.Parse(time.RFC3339Nano, fields["created_at"]); err != nil {
+		return apiKey, err
+	}
+
+	if v := fields["revoked_at"]; v != "" {
+		apiKey.RevokedAt, err = time.Parse(time.RFC3339Nano, v)
+	}
+
+	return apiKey, err
+}
+
+func (r *InRedisStorage) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	apiKeys := []APIKey{}
+
+	ids, err := r.client.SMembers(ctx, apiKeysKey()).Result()
+
+	if err != nil {
+		return apiKeys, err
+	}
+
+	for _, id := range ids {
+		apiKey, err := r.getAPIKey(ctx, id)
+
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return apiKeys, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	sortAPIKeys(apiKeys)
+
+	return apiKeys, nil
+}
+
+func (r *InRedisStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	found, err := revokeScript.Run(ctx, r.client, []string{apiKeyKey(id)},
+		at.UTC().Format(time.RFC3339Nano)).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if found == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Iterate walks link hashes with SCAN, a link changed meanwhile
+// may be seen as it was or as it is.
+func (r *InRedisStorage) Iterate(ctx context.Context, fn func(LinkRecord) error) error {
+	prefix := linkKey("")
+	iter := r.client.Scan(ctx, 0, prefix+"*", scanCount).Iterator()
+
+	keys := make([]string, 0, scanCount)
+
+	flush := func() error {
+		cmds := make([]*redis.MapStringStringCmd, len(keys))
+
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for k, v := range keys {
+				cmds[k] = pipe.HGetAll(ctx, v)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for k, v := range cmds {
+			// purged between SCAN and HGETALL
+			if len(v.Val()) == 0 {
+				continue
+			}
+
+			lnkRec, err := linkFromHash(strings.TrimPrefix(keys[k], prefix), v.Val())
+
+			if err != nil {
+				return err
+			}
+
+			if lnkRec.isTombstone() {
+				continue
+			}
+
+			if err := fn(lnkRec); err != nil {
+				return err
+			}
+		}
+
+		keys = keys[:0]
+
+		return nil
+	}
+
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+
+		if len(keys) == scanCount {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// CountLinks counts the links set.
+func (r *InRedisStorage) CountLinks(ctx context.Context) (int, error) {
+	count, err := r.client.ZCard(ctx, linksKey()).Result()
+	return int(count), err
+}
+
+// List reads short urls from the links set after the cursor a page at a
+// time, so a page without search costs the same wherever it is. A search
+// reads on until the page is full or the links run out.
+func (r *InRedisStorage) List(ctx context.Context, q ListQuery) ([]LinkRecord, error) {
+	lnkRecs := make([]LinkRecord, 0, q.Limit)
+	after := q.After
+
+	for len(lnkRecs) < q.Limit {
+		from := "-"
+
+		if after != "" {
+			from = "(" + after
+		}
+
+		shortURLs, err := r.client.ZRangeByLex(ctx, linksKey(), &redis.ZRangeBy{
+			Min:   from,
+			Max:   "+",
+			Count: int64(q.Limit),
+		}).Result()
+
+		if err != nil {
+			return nil, err
+		}
+
+		cmds := make([]*redis.MapStringStringCmd, len(shortURLs))
+
+		_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for k, v := range shortURLs {
+				cmds[k] = pipe.HGetAll(ctx, linkKey(v))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range cmds {
+			// deleted between ZRANGE and HGETALL
+			if len(v.Val()) == 0 {
+				continue
+			}
+
+			lnkRec, err := linkFromHash(shortURLs[k], v.Val())
+
+			if err != nil {
+				return nil, err
+			}
+
+			if q.matches(lnkRec) && len(lnkRecs) < q.Limit {
+				lnkRecs = append(lnkRecs, lnkRec)
+			}
+		}
+
+		if len(shortURLs) < q.Limit {
+			break
+		}
+
+		after = shortURLs[len(shortURLs)-1]
+	}
+
+	return lnkRecs, nil
+}
@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedis(t *testing.T) *InRedisStorage {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+
+	r, err := NewInRedisStorage(logger.NewLogger(), mr.Addr())
+	require.NoError(t, err)
+
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+func TestInRedisStorageCreateAndGet(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t)
+
+	assert.True(t, r.Ping(ctx))
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "abc", URL: "https://example.com", UserID: 7, ExpiresAt: expires}))
+
+	lnkRec, err := r.Get(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, LinkRecord{ShortURL: "abc", URL: "https://example.com", UserID: 7, ExpiresAt: expires}, lnkRec)
+
+	shorturl, err := r.GetByURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", shorturl)
+
+	_, err = r.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = r.GetByURL(ctx, "https://missing.example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestInRedisStorageBatchCreateAndDelete(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t)
+
+	results, err := r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "one", URL: "https://one.example.com", UserID: 1},
+		{ShortURL: "two", URL: "https://two.example.com", UserID: 1},
+		{ShortURL: "three", URL: "https://three.example.com", UserID: 2},
+		{ShortURL: "again", URL: "https://one.example.com", UserID: 1},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	assert.Equal(t, BatchCreated, results[0].Status)
+	assert.Equal(t, BatchExisting, results[3].Status)
+	assert.Equal(t, "one", results[3].ShortURL)
+
+	_, err = r.Get(ctx, "again")
+	assert.ErrorIs(t, err, ErrNotFound, "existing url must not get a second link")
+
+	lnkRecs, err := r.GetByUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, lnkRecs, 2)
+
+	require.NoError(t, r.BatchDelete(ctx, []LinkRecord{
+		{ShortURL: "one", UserID: 1},
+		{ShortURL: "three", UserID: 1},
+	}))
+
+	lnkRec, err := r.Get(ctx, "one")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.IsDeleted)
+
+	lnkRec, err = r.Get(ctx, "three")
+	require.NoError(t, err)
+	assert.False(t, lnkRec.IsDeleted, "only the owner can delete a link")
+
+	lnkRecs, err = r.GetByUser(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, lnkRecs, 1)
+	assert.Equal(t, "two", lnkRecs[0].ShortURL)
+}
+
+func TestInRedisStorageBatchCreateKeepsTakenShortURL(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t)
+
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "one", URL: "https://one.example.com", UserID: 1}))
+
+	_, err := r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "two", URL: "https://two.example.com", UserID: 2},
+		{ShortURL: "one", URL: "https://other.example.com", UserID: 2},
+	})
+	require.ErrorIs(t, err, ErrShortURLTaken)
+
+	lnkRec, err := r.Get(ctx, "one")
+	require.NoError(t, err)
+	assert.Equal(t, LinkRecord{ShortURL: "one", URL: "https://one.example.com", UserID: 1}, lnkRec, "taken link must not be overwritten")
+
+	_, err = r.Get(ctx, "two")
+	assert.ErrorIs(t, err, ErrNotFound, "failed batch must write nothing")
+
+	for _, url := range []string{"https://two.example.com", "https://other.example.com"} {
+		_, err = r.GetByURL(ctx, url)
+		assert.ErrorIs(t, err, ErrNotFound, "failed batch must not claim %s", url)
+	}
+
+	_, err = r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "same", URL: "https://three.example.com"},
+		{ShortURL: "same", URL: "https://four.example.com"},
+	})
+	assert.ErrorIs(t, err, ErrShortURLTaken, "short url taken within the batch")
+}
+
+func TestInRedisStoragePurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t)
+	now := time.Now()
+
+	_, err := r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "old", URL: "https://old.example.com", ExpiresAt: now.Add(-time.Minute)},
+		{ShortURL: "new", URL: "https://new.example.com", ExpiresAt: now.Add(time.Hour)},
+		{ShortURL: "forever", URL: "https://forever.example.com"},
+	})
+	require.NoError(t, err)
+
+	purged, err := r.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	lnkRec, err := r.Get(ctx, "old")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.isTombstone() && lnkRec.IsDeleted, "purged link leaves a tombstone")
+	assert.True(t, lnkRec.IsExpired(now))
+
+	_, err = r.GetByURL(ctx, "https://old.example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	purged, err = r.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	_, err = r.Get(ctx, "new")
+	assert.NoError(t, err)
+
+	// the link was prolonged after its expiry was read
+	require.NoError(t, r.client.ZAdd(ctx, expiresKey(), redis.Z{Score: float64(now.Add(-time.Minute).Unix()), Member: "new"}).Err())
+
+	purged, err = r.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	lnkRec, err = r.Get(ctx, "new")
+	require.NoError(t, err)
+	assert.False(t, lnkRec.IsDeleted, "a link which is not expired is not purged")
+}
+
+func TestInRedisStorageStats(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t)
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	require.NoError(t, r.SaveClicks(ctx, []Click{
+		{ShortURL: "abc", Time: at, IPHash: "a"},
+		{ShortURL: "abc", Time: at.Add(time.Hour), IPHash: "a"},
+		{ShortURL: "abc", Time: at.Add(24 * time.Hour), IPHash: "b"},
+		{ShortURL: "other", Time: at, IPHash: "c"},
+	}))
+
+	stats, err := r.GetStats(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.TotalClicks)
+	assert.Equal(t, 2, stats.UniqueVisitors)
+	assert.Equal(t, map[string]int{"2024-05-01": 2, "2024-05-02": 1}, stats.ByDay)
+	assert.Equal(t, 1, stats.ByHour["2024-05-01 10:00"])
+
+	stats, err = r.GetStats(ctx, "none")
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.TotalClicks)
+}
+
+func TestInRedisStorageStatsCountsVisitors(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRedis(t)
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	var clicks []Click
+
+	for i := 0; i < 200; i++ {
+		clicks = append(clicks, Click{ShortURL: "abc", Time: at, IPHash: fmt.Sprintf("ip-%d", i%50)})
+	}
+
+	require.NoError(t, r.SaveClicks(ctx, clicks))
+	require.NoError(t, r.SaveClicks(ctx, clicks[:10]))
+
+	stats, err := r.GetStats(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, 210, stats.TotalClicks)
+	assert.InDelta(t, 50, stats.UniqueVisitors, 2, "repeated ip hashes count once")
+}
+
+func TestInRedisStorageIndexesLinks(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+
+	r, err := NewInRedisStorage(logger.NewLogger(), mr.Addr())
+	require.NoError(t, err)
+
+	_, err = r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "one", URL: "https://one.example.com", UserID: 1},
+		{ShortURL: "two", URL: "https://two.example.com", UserID: 1},
+		{ShortURL: "old", URL: "https://old.example.com", ExpiresAt: time.Now().Add(-time.Minute)},
+	})
+	require.NoError(t, err)
+
+	_, err = r.Upsert(ctx, []LinkRecord{{ShortURL: "gone", URL: "https://gone.example.com", IsDeleted: true}})
+	require.NoError(t, err)
+
+	require.NoError(t, r.BatchDelete(ctx, []LinkRecord{{ShortURL: "two", UserID: 1}}))
+
+	_, err = r.PurgeExpired(ctx, time.Now())
+	require.NoError(t, err)
+
+	count, err := r.CountLinks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// links written before the index existed get into it on the next start
+	mr.Del(linksKey())
+	mr.Del(linksIndexedKey())
+	require.NoError(t, r.Close())
+
+	r, err = NewInRedisStorage(logger.NewLogger(), mr.Addr())
+	require.NoError(t, err)
+	defer r.Close()
+
+	count, err = r.CountLinks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	page, err := r.List(ctx, ListQuery{Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one"}, shortURLs(page))
+}
@@ -0,0 +1,357 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/pressly/goose/v3"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteTimeFmt has fixed width so stored times compare as strings
+// and histogram buckets are just prefixes.
+const sqliteTimeFmt = "2006-01-02 15:04:05.000000000Z"
+
+// InSQLiteStorage keeps links in a single SQLite file. The schema is
+// the same as in Postgres and comes from the goose migrations.
+type InSQLiteStorage struct {
+	Logger logger.MyLogger
+	Path   string
+	db     *sql.DB
+}
+
+func NewInSQLiteStorage(lg logger.MyLogger, path string) (*InSQLiteStorage, error) {
+	st := InSQLiteStorage{
+		Logger: lg,
+		Path:   path,
+	}
+
+	db, err := openSQLite(path)
+
+	if err != nil {
+		return &st, err
+	}
+
+	st.db = db
+
+	err = migrate(context.Background(), lg, db, goose.DialectSQLite3)
+
+	if err != nil {
+		db.Close()
+		return &st, err
+	}
+
+	return &st, nil
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has a single writer, one connection avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+func sqliteTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: t.UTC().Format(sqliteTimeFmt), Valid: true}
+}
+
+func (l *InSQLiteStorage) Get(ctx context.Context, shorturl string) (LinkRecord, error) {
+	var expiresAt sql.NullString
+
+	lnkRec := LinkRecord{ShortURL: shorturl}
+	row := l.db.QueryRowContext(ctx, "SELECT COALESCE(url, ''), userid, is_deleted, expires_at FROM repo WHERE shorturl=$1", shorturl)
+	err := row.Scan(&lnkRec.URL, &lnkRec.UserID, &lnkRec.IsDeleted, &expiresAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return lnkRec, ErrNotFound
+	}
+
+	if err != nil || !expiresAt.Valid {
+		return lnkRec, err
+	}
+
+	lnkRec.ExpiresAt, err = time.Parse(sqliteTimeFmt, expiresAt.String)
+
+	return lnkRec, err
+}
+
+func (l *InSQLiteStorage) GetByURL(ctx context.Context, url string) (string, error) {
+	var shorturl string
+	row := l.db.QueryRowContext(ctx, "SELECT shorturl FROM repo WHERE url=$1 AND NOT is_deleted", url)
+	err := row.Scan(&shorturl)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return shorturl, ErrNotFound
+	}
+
+	return shorturl, err
+}
+
+func (l *InSQLiteStorage) GetByUser(ctx context.Context, userID int) ([]LinkRecord, error) {
+	lnkRecs := []LinkRecord{}
+
+	rows, err := l.db.QueryContext(ctx, "SELECT shorturl, url FROM repo WHERE userid=$1 AND NOT is_deleted", userID)
+
+	if err != nil {
+		return lnkRecs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		lnkRec := LinkRecord{UserID: userID}
+
+		err = rows.Scan(&lnkRec.ShortURL, &lnkRec.URL)
+
+		if err != nil {
+			return lnkRecs, err
+		}
+
+		lnkRecs = append(lnkRecs, lnkRec)
+	}
+
+	return lnkRecs, rows.Err()
+}
+
+func (l *InSQLiteStorage) Create(ctx context.Context, lnkRec LinkRecord) error {
+	return createLink(ctx, l.db, lnkRec, sqliteTime(lnkRec.ExpiresAt))
+}
+
+func (l *InSQLiteStorage) BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	return batchCreate(ctx, l.db, lnkRecs, func(t time.Time) any { return sqliteTime(t) })
+}
+
+func (l *InSQLiteStorage) Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	return upsert(ctx, l.db, lnkRecs, func(t time.Time) any { return sqliteTime(t) })
+}
+
+func (l *InSQLiteStorage) Iterate(ctx context.Context, fn func(LinkRecord) error) error {
+	return iterate(ctx, l.db, fn, scanSQLiteLink)
+}
+
+// List searches urls with GLOB, LIKE of SQLite ignores case of latin
+// letters unlike other storages.
+func (l *InSQLiteStorage) List(ctx context.Context, q ListQuery) ([]LinkRecord, error) {
+	return list(ctx, l.db, q, "url GLOB $2", q.globPattern(), scanSQLiteLink)
+}
+
+func scanSQLiteLink(row rowScanner) (LinkRecord, error) {
+	var expiresAt sql.NullString
+
+	lnkRec := LinkRecord{}
+	err := row.Scan(&lnkRec.ShortURL, &lnkRec.URL, &lnkRec.UserID, &lnkRec.IsDeleted, &expiresAt)
+
+	if err != nil || !expiresAt.Valid {
+		return lnkRec, err
+	}
+
+	lnkRec.ExpiresAt, err = time.Parse(sqliteTimeFmt, expiresAt.String)
+
+	return lnkRec, err
+}
+
+func (l *InSQLiteStorage) BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error {
+	return l.inTx(ctx, "UPDATE repo SET is_deleted = TRUE WHERE shorturl=$1 AND userid=$2", len(lnkRecs),
+		func(stmt *sql.Stmt, i int) error {
+			_, err := stmt.ExecContext(ctx, lnkRecs[i].ShortURL, lnkRecs[i].UserID)
+			return err
+		})
+}
+
+// inTx runs the statement n times in one transaction and rolls it back
+// on the first error.
+func (l *InSQLiteStorage) inTx(ctx context.Context, query string, n int, exec func(stmt *sql.Stmt, i int) error) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	for i := 0; i < n; i++ {
+		if err := exec(stmt, i); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (l *InSQLiteStorage) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	return purgeExpired(ctx, l.db, sqliteTime(now))
+}
+
+func (l *InSQLiteStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	return l.inTx(ctx, `INSERT INTO clicks (shorturl, clicked_at, referrer, user_agent, ip_hash)
+	                                       VALUES($1,$2,$3,$4,$5)`, len(clicks),
+		func(stmt *sql.Stmt, i int) error {
+			v := clicks[i]
+			_, err := stmt.ExecContext(ctx, v.ShortURL, sqliteTime(v.Time), v.Referrer, v.UserAgent, v.IPHash)
+			return err
+		})
+}
+
+func (l *InSQLiteStorage) GetStats(ctx context.Context, shorturl string) (LinkStats, error) {
+	stats := newLinkStats()
+
+	row := l.db.QueryRowContext(ctx, "SELECT count(*), count(DISTINCT ip_hash) FROM clicks WHERE shorturl=$1", shorturl)
+
+	err := row.Scan(&stats.TotalClicks, &stats.UniqueVisitors)
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = l.histogram(ctx, "substr(clicked_at, 1, 10)", shorturl, stats.ByDay)
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = l.histogram(ctx, "substr(clicked_at, 1, 13) || ':00'", shorturl, stats.ByHour)
+
+	return stats, err
+}
+
+func (l *InSQLiteStorage) histogram(ctx context.Context, bucket, shorturl string, hist map[string]int) error {
+	rows, err := l.db.QueryContext(ctx, "SELECT "+bucket+", count(*) FROM clicks WHERE shorturl=$1 GROUP BY 1", shorturl)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key   string
+			count int
+		)
+
+		err = rows.Scan(&key, &count)
+
+		if err != nil {
+			return err
+		}
+
+		hist[key] = count
+	}
+
+	return rows.Err()
+}
+
+func (l *InSQLiteStorage) CountLinks(ctx context.Context) (int, error) {
+	return countLinks(ctx, l.db)
+}
+
+func (l *InSQLiteStorage) VisitorSalt(ctx context.Context) ([]byte, error) {
+	return visitorSalt(ctx, l.db)
+}
+
+func (l *InSQLiteStorage) ReserveCounter(ctx context.Context, n uint64) (uint64, error) {
+	return reserveCounter(ctx, l.db, n)
+}
+
+func (l *InSQLiteStorage) Ping(ctx context.Context) bool {
+	return l.db.PingContext(ctx) == nil
+}
+
+func (l *InSQLiteStorage) Close() error {
+	return l.db.Close()
+}
+
+func (l *InSQLiteStorage) CreateAPIKey(ctx context.Context, apiKey APIKey) error {
+	_, err := l.db.ExecContext(ctx,
+		"INSERT INTO api_keys (id, name, hash, scopes, userid, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		apiKey.ID, apiKey.Name, apiKey.Hash, joinScopes(apiKey.Scopes), apiKey.UserID, sqliteTime(apiKey.CreatedAt))
+
+	return err
+}
+
+func (l *InSQLiteStorage) GetAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	row := l.db.QueryRowContext(ctx, "SELECT id, name, hash, scopes, userid, created_at, revoked_at FROM api_keys WHERE hash=$1", hash)
+	apiKey, err := scanSQLiteAPIKey(row)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiKey, ErrNotFound
+	}
+
+	return apiKey, err
+}
+
+func (l *InSQLiteStorage) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	apiKeys := []APIKey{}
+
+	rows, err := l.db.QueryContext(ctx, "SELECT id, name, hash, scopes, userid, created_at, revoked_at FROM api_keys ORDER BY created_at, id")
+
+	if err != nil {
+		return apiKeys, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		apiKey, err := scanSQLiteAPIKey(rows)
+
+		if err != nil {
+			return apiKeys, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, rows.Err()
+}
+
+func (l *InSQLiteStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return revokeAPIKey(ctx, l.db, id, sqliteTime(at))
+}
+
+func scanSQLiteAPIKey(row rowScanner) (APIKey, error) {
+	var (
+		apiKey    APIKey
+		scopes    string
+		createdAt string
+		revokedAt sql.NullString
+	)
+
+	err := row.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Hash, &scopes, &apiKey.UserID, &createdAt, &revokedAt)
+
+	if err != nil {
+		return apiKey, err
+	}
+
+	apiKey.Scopes = splitScopes(scopes)
+
+	if apiKey.CreatedAt, err = time.Parse(sqliteTimeFmt, createdAt); err != nil {
+		return apiKey, err
+	}
+
+	if revokedAt.Valid {
+		apiKey.RevokedAt, err = time.Parse(sqliteTimeFmt, revokedAt.String)
+	}
+
+	return apiKey, err
+}
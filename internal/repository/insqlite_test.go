@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLite(t *testing.T, path string) *InSQLiteStorage {
+	t.Helper()
+
+	r, err := NewInSQLiteStorage(logger.NewLogger(), path)
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestInSQLiteStorageSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "repo.db")
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Microsecond)
+
+	r := newTestSQLite(t, path)
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "abc", URL: "https://example.com", UserID: 7, ExpiresAt: expires}))
+	require.NoError(t, r.Close())
+
+	r = newTestSQLite(t, path)
+	defer r.Close()
+
+	lnkRec, err := r.Get(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, LinkRecord{ShortURL: "abc", URL: "https://example.com", UserID: 7, ExpiresAt: expires}, lnkRec)
+
+	shorturl, err := r.GetByURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", shorturl)
+
+	_, err = r.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestInSQLiteStorageBatchCreateIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLite(t, filepath.Join(t.TempDir(), "repo.db"))
+	defer r.Close()
+
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "one", URL: "https://one.example.com", UserID: 1}))
+
+	_, err := r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "two", URL: "https://two.example.com", UserID: 1},
+		{ShortURL: "one", URL: "https://other.example.com", UserID: 1},
+	})
+	require.ErrorIs(t, err, ErrShortURLTaken)
+
+	_, err = r.Get(ctx, "two")
+	assert.ErrorIs(t, err, ErrNotFound, "failed batch must be rolled back")
+
+	results, err := r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "two", URL: "https://two.example.com", UserID: 1},
+		{ShortURL: "three", URL: "https://three.example.com", UserID: 2},
+		{ShortURL: "dup", URL: "https://one.example.com", UserID: 1},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, BatchCreated, results[1].Status)
+	assert.Equal(t, BatchExisting, results[2].Status)
+	assert.Equal(t, "one", results[2].ShortURL)
+
+	require.NoError(t, r.BatchDelete(ctx, []LinkRecord{
+		{ShortURL: "one", UserID: 1},
+		{ShortURL: "three", UserID: 1},
+	}))
+
+	lnkRecs, err := r.GetByUser(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, lnkRecs, 1)
+	assert.Equal(t, "two", lnkRecs[0].ShortURL)
+
+	lnkRec, err := r.Get(ctx, "three")
+	require.NoError(t, err)
+	assert.False(t, lnkRec.IsDeleted, "only the owner can delete a link")
+}
+
+func TestInSQLiteStoragePurgeAndStats(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLite(t, filepath.Join(t.TempDir(), "repo.db"))
+	defer r.Close()
+
+	now := time.Now()
+
+	_, err := r.BatchCreate(ctx, []LinkRecord{
+		{ShortURL: "old", URL: "https://old.example.com", ExpiresAt: now.Add(-time.Minute)},
+		{ShortURL: "new", URL: "https://new.example.com", ExpiresAt: now.Add(time.Hour)},
+		{ShortURL: "forever", URL: "https://forever.example.com"},
+	})
+	require.NoError(t, err)
+
+	purged, err := r.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	lnkRec, err := r.Get(ctx, "old")
+	require.NoError(t, err)
+	assert.True(t, lnkRec.isTombstone() && lnkRec.IsDeleted, "purged link leaves a tombstone")
+	assert.True(t, lnkRec.IsExpired(now))
+
+	assert.ErrorIs(t, r.Create(ctx, LinkRecord{ShortURL: "old", URL: "https://other.example.com"}), ErrShortURLTaken)
+	require.NoError(t, r.Create(ctx, LinkRecord{ShortURL: "again", URL: "https://old.example.com"}))
+
+	purged, err = r.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	require.NoError(t, r.SaveClicks(ctx, []Click{
+		{ShortURL: "new", Time: at, IPHash: "a"},
+		{ShortURL: "new", Time: at.Add(time.Hour), IPHash: "a"},
+		{ShortURL: "new", Time: at.Add(24 * time.Hour), IPHash: "b"},
+	}))
+
+	stats, err := r.GetStats(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.TotalClicks)
+	assert.Equal(t, 2, stats.UniqueVisitors)
+	assert.Equal(t, map[string]int{"2024-05-01": 2, "2024-05-02": 1}, stats.ByDay)
+	assert.Equal(t, 1, stats.ByHour["2024-05-01 10:00"])
+}
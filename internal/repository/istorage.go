@@ -1,9 +1,47 @@
 package repository
 
+import (
+	"context"
+	"time"
+)
+
 type IStorage interface {
-	Create(lnkRec LinkRecord) error
-	Get(shorturl string) (string, error)
-	GetByURL(url string) (string, error)
-	BatchCreate(lnkRecs []LinkRecord) error
-	Ping() bool
+	Create(ctx context.Context, lnkRec LinkRecord) error
+	Get(ctx context.Context, shorturl string) (LinkRecord, error)
+	GetByURL(ctx context.Context, url string) (string, error)
+	GetByUser(ctx context.Context, userID int) ([]LinkRecord, error)
+	BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error)
+	BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error
+	// PurgeExpired turns expired links into tombstones, which keep
+	// their short urls taken and free their urls.
+	PurgeExpired(ctx context.Context, now time.Time) (int, error)
+	SaveClicks(ctx context.Context, clicks []Click) error
+	GetStats(ctx context.Context, shorturl string) (LinkStats, error)
+	// Iterate calls fn for every link, deleted ones too but not
+	// tombstones of purged ones, and stops at the first error of fn.
+	Iterate(ctx context.Context, fn func(LinkRecord) error) error
+	// Upsert saves links as they are, keyed by short url. A link whose
+	// url belongs to another short url is skipped as BatchExisting.
+	Upsert(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error)
+	// List returns up to q.Limit links which are not deleted,
+	// in order of short urls.
+	List(ctx context.Context, q ListQuery) ([]LinkRecord, error)
+	// CountLinks returns how many links are stored, not counting
+	// deleted ones and tombstones.
+	CountLinks(ctx context.Context) (int, error)
+	CreateAPIKey(ctx context.Context, apiKey APIKey) error
+	// GetAPIKey finds a key by hash, revoked keys are returned too.
+	GetAPIKey(ctx context.Context, hash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	// VisitorSalt returns the key addresses of visitors are hashed with.
+	// It is made once and kept, so a visitor stays the same one across
+	// restarts and replicas.
+	VisitorSalt(ctx context.Context) ([]byte, error)
+	// ReserveCounter takes n values of the short code counter, which no
+	// process took before, and returns the last of them. The first
+	// value ever taken is 1.
+	ReserveCounter(ctx context.Context, n uint64) (uint64, error)
+	Ping(ctx context.Context) bool
+	Close() error
 }
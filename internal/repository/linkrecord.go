@@ -1,7 +1,39 @@
 package repository
 
+import "time"
+
 type LinkRecord struct {
-	CorrelationID string
-	ShortURL      string
-	URL           string
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	ShortURL      string    `json:"short_url"`
+	URL           string    `json:"url"`
+	UserID        int       `json:"user_id"`
+	IsDeleted     bool      `json:"is_deleted"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// IsExpired reports whether link had a lifetime and it is over at now.
+func (l LinkRecord) IsExpired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+// tombstone is what PurgeExpired leaves of an expired link: the short
+// url stays taken and answers as expired, the url is free again.
+func (l LinkRecord) tombstone() LinkRecord {
+	return LinkRecord{ShortURL: l.ShortURL, IsDeleted: true, ExpiresAt: l.ExpiresAt}
+}
+
+func (l LinkRecord) isTombstone() bool {
+	return l.URL == ""
+}
+
+// purgeable reports whether PurgeExpired turns the link into a tombstone.
+func (l LinkRecord) purgeable(now time.Time) bool {
+	return l.IsExpired(now) && !l.isTombstone()
+}
+
+// sameAs reports whether both records store the same link,
+// CorrelationID is not stored and is not compared.
+func (l LinkRecord) sameAs(o LinkRecord) bool {
+	return l.ShortURL == o.ShortURL && l.URL == o.URL && l.UserID == o.UserID &&
+		l.IsDeleted == o.IsDeleted && l.ExpiresAt.Equal(o.ExpiresAt)
 }
@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"context"
+	"strings"
+)
+
+// ListQuery selects a page of links for List.
+type ListQuery struct {
+	// After is the short url the page starts after, "" starts from the first link.
+	After string
+	Limit int
+	// Search keeps links whose url contains it, or starts with it if Prefix is set.
+	Search string
+	Prefix bool
+}
+
+func (q ListQuery) matches(lnkRec LinkRecord) bool {
+	if lnkRec.IsDeleted || lnkRec.ShortURL <= q.After {
+		return false
+	}
+
+	if q.Prefix {
+		return strings.HasPrefix(lnkRec.URL, q.Search)
+	}
+
+	return strings.Contains(lnkRec.URL, q.Search)
+}
+
+// likePattern turns Search into a LIKE pattern with '\' as escape.
+func (q ListQuery) likePattern() string {
+	search := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Search)
+
+	if q.Prefix {
+		return search + "%"
+	}
+
+	return "%" + search + "%"
+}
+
+// globPattern turns Search into a GLOB pattern, wildcards are put
+// into brackets.
+func (q ListQuery) globPattern() string {
+	search := strings.NewReplacer(`*`, `[*]`, `?`, `[?]`, `[`, `[[]`).Replace(q.Search)
+
+	if q.Prefix {
+		return search + "*"
+	}
+
+	return "*" + search + "*"
+}
+
+// List returns links in order of short urls, deleted ones are skipped.
+func (s *StorageService) List(ctx context.Context, q ListQuery) ([]LinkRecord, error) {
+	if q.Limit <= 0 {
+		return []LinkRecord{}, nil
+	}
+
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	return s.storage.List(ctx, q)
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shortURLs(lnkRecs []LinkRecord) []string {
+	s := make([]string, len(lnkRecs))
+
+	for k, v := range lnkRecs {
+		s[k] = v.ShortURL
+	}
+
+	return s
+}
+
+func TestListOnEveryBackend(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: MemType},
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	lnkRecs := []LinkRecord{}
+
+	for i := 9; i >= 0; i-- {
+		host := "docs"
+
+		if i%2 == 0 {
+			host = "blog"
+		}
+
+		lnkRecs = append(lnkRecs, LinkRecord{
+			ShortURL: fmt.Sprintf("code%d", i),
+			URL:      fmt.Sprintf("https://%s.example.com/?q=100%%_%d", host, i),
+			UserID:   i,
+		})
+	}
+
+	lnkRecs[0].IsDeleted = true
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			ctx := context.Background()
+
+			_, err = s.Import(ctx, lnkRecs)
+			require.NoError(t, err)
+
+			page, err := s.List(ctx, ListQuery{Limit: 4})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"code0", "code1", "code2", "code3"}, shortURLs(page))
+
+			page, err = s.List(ctx, ListQuery{After: "code3", Limit: 4})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"code4", "code5", "code6", "code7"}, shortURLs(page))
+
+			page, err = s.List(ctx, ListQuery{After: "code7", Limit: 4})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"code8"}, shortURLs(page), "deleted code9 is skipped")
+
+			page, err = s.List(ctx, ListQuery{Limit: 10, Search: "https://blog.", Prefix: true})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"code0", "code2", "code4", "code6", "code8"}, shortURLs(page))
+
+			page, err = s.List(ctx, ListQuery{Limit: 10, Search: "%_3"})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"code3"}, shortURLs(page), "LIKE wildcards are searched as they are")
+
+			page, err = s.List(ctx, ListQuery{Limit: 10, Search: "docs", Prefix: true})
+			require.NoError(t, err)
+			assert.Empty(t, page)
+
+			page, err = s.List(ctx, ListQuery{Limit: 10, Search: "BLOG"})
+			require.NoError(t, err)
+			assert.Empty(t, page, "search is case sensitive")
+
+			_, err = s.Import(ctx, []LinkRecord{{ShortURL: "glob", URL: "https://docs.example.com/?q=[a]*?"}})
+			require.NoError(t, err)
+
+			page, err = s.List(ctx, ListQuery{Limit: 10, Search: "[a]*?"})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"glob"}, shortURLs(page), "GLOB wildcards are searched as they are")
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/migration"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+)
+
+// Migrator applies the embedded goose migrations to the sql backends.
+// On Postgres every run holds an advisory lock, so replicas which
+// start together apply migrations one after another.
+type Migrator struct {
+	logger   logger.MyLogger
+	provider *goose.Provider
+	db       *sql.DB // closed by Close when the migrator opened it itself
+}
+
+// NewMigrator opens the database from cfg, it is used by the migrate command.
+func NewMigrator(cfg StorageConfig) (*Migrator, error) {
+	var (
+		db      *sql.DB
+		dialect goose.Dialect
+		err     error
+	)
+
+	switch cfg.StorageType {
+	case DBType:
+		db, err = openPostgres(context.Background(), cfg.DatabaseDSN)
+		dialect = goose.DialectPostgres
+	case SQLiteType:
+		db, err = openSQLite(cfg.SQLitePath)
+		dialect = goose.DialectSQLite3
+	default:
+		return nil, fmt.Errorf("STORAGE %q HAS NO MIGRATIONS", cfg.StorageType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMigrator(cfg.Logger, db, dialect)
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	m.db = db
+
+	return m, nil
+}
+
+func newMigrator(lg logger.MyLogger, db *sql.DB, dialect goose.Dialect) (*Migrator, error) {
+	opts := []goose.ProviderOption{goose.WithGoMigrations(migration.GoMigrations(dialect, lg)...)}
+
+	if dialect == goose.DialectPostgres {
+		locker, err := lock.NewPostgresSessionLocker()
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, goose.WithSessionLocker(locker))
+	}
+
+	provider, err := goose.NewProvider(dialect, db, migration.FS, opts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{logger: lg, provider: provider}, nil
+}
+
+// migrate applies all pending migrations to db.
+func migrate(ctx context.Context, lg logger.MyLogger, db *sql.DB, dialect goose.Dialect) error {
+	m, err := newMigrator(lg, db, dialect)
+
+	if err != nil {
+		return err
+	}
+
+	return m.Up(ctx)
+}
+
+func (m *Migrator) Up(ctx context.Context) error {
+	results, err := m.provider.Up(ctx)
+
+	for _, v := range results {
+		m.logger.Infoln("MIGRATION APPLIED", "version", v.Source.Version, "source", v.Source.Path, "duration", v.Duration)
+	}
+
+	return err
+}
+
+// Down rolls back the last applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	result, err := m.provider.Down(ctx)
+
+	if result != nil {
+		m.logger.Infoln("MIGRATION ROLLED BACK", "version", result.Source.Version, "source", result.Source.Path, "duration", result.Duration)
+	}
+
+	return err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]*goose.MigrationStatus, error) {
+	return m.provider.Status(ctx)
+}
+
+func (m *Migrator) Close() error {
+	if m.db == nil {
+		return nil
+	}
+
+	return m.db.Close()
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigratorUpDownStatus(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := NewMigrator(StorageConfig{
+		StorageType: SQLiteType,
+		Logger:      logger.NewLogger(),
+		SQLitePath:  filepath.Join(t.TempDir(), "repo.db"),
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.NoError(t, m.Up(ctx))
+	require.NoError(t, m.Down(ctx))
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, statuses)
+
+	last := statuses[len(statuses)-1]
+	assert.Equal(t, goose.StatePending, last.State)
+
+	for _, v := range statuses[:len(statuses)-1] {
+		assert.Equal(t, goose.StateApplied, v.State, v.Source.Path)
+	}
+
+	_, err = NewMigrator(StorageConfig{StorageType: MemType})
+	assert.Error(t, err)
+}
+
+func TestMigratorKeepsTombstonesOnDown(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := NewMigrator(StorageConfig{
+		StorageType: SQLiteType,
+		Logger:      logger.NewLogger(),
+		SQLitePath:  filepath.Join(t.TempDir(), "repo.db"),
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.NoError(t, m.Up(ctx))
+
+	_, err = m.db.ExecContext(ctx, "INSERT INTO repo (shorturl, url, is_deleted) VALUES ('gone', NULL, TRUE), ('kept', 'https://example.com', FALSE)")
+	require.NoError(t, err)
+
+	// down to the version before urls could be NULL
+	require.NoError(t, m.Down(ctx))
+	require.NoError(t, m.Down(ctx))
+	assert.Error(t, m.Down(ctx), "tombstones would be lost")
+
+	_, err = m.db.ExecContext(ctx, "DELETE FROM repo WHERE url IS NULL")
+	require.NoError(t, err)
+	require.NoError(t, m.Down(ctx))
+
+	count := 0
+	require.NoError(t, m.db.QueryRowContext(ctx, "SELECT count(*) FROM repo").Scan(&count))
+	assert.Equal(t, 1, count)
+
+	_, err = m.db.ExecContext(ctx, "INSERT INTO repo (shorturl, url) VALUES ('null', NULL)")
+	assert.Error(t, err, "url is NOT NULL again")
+
+	require.NoError(t, m.Up(ctx))
+}
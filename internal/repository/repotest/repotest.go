@@ -0,0 +1,61 @@
+// Package repotest holds storages for tests of the repository
+// and of the packages built on it.
+package repotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/stretchr/testify/require"
+)
+
+// BlockingStorage answers Get only when the caller gives up.
+type BlockingStorage struct {
+	*repository.InMemoryStorage
+	cancelled chan error
+}
+
+func (b *BlockingStorage) Get(ctx context.Context, _ string) (repository.LinkRecord, error) {
+	<-ctx.Done()
+	b.cancelled <- ctx.Err()
+	return repository.LinkRecord{}, ctx.Err()
+}
+
+// Cancelled waits until a Get has given up and returns the error
+// of its context, the test fails if it takes more than a second.
+func (b *BlockingStorage) Cancelled(t testing.TB) error {
+	t.Helper()
+
+	select {
+	case err := <-b.cancelled:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("storage call was not cancelled")
+		return nil
+	}
+}
+
+// NewBlockingService builds the service around a BlockingStorage,
+// it is closed when the test ends.
+func NewBlockingService(t testing.TB, cfg repository.StorageConfig) (*repository.StorageService, *BlockingStorage) {
+	t.Helper()
+
+	if cfg.Logger.SugaredLogger == nil {
+		cfg.Logger = logger.NewLogger()
+	}
+
+	mem, err := repository.NewInMemoryStorage(cfg.Logger)
+	require.NoError(t, err)
+
+	storage := &BlockingStorage{InMemoryStorage: mem, cancelled: make(chan error, 1)}
+
+	s, err := repository.NewStorageServiceFor(storage, cfg)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { s.Close() })
+
+	return s, storage
+}
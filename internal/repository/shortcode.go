@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+const (
+	CRC32Gen   = "crc32"
+	RandomGen  = "random"
+	CounterGen = "counter"
+)
+
+const (
+	base62Alphabet    = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	randomCodeLength  = 8
+	counterCodeLength = 6
+	counterBlock      = 100
+)
+
+type ShortCodeGenerator interface {
+	// Generate returns short code for url. Attempt is the number of
+	// previous tries that ended with collision, so generator must
+	// return another code for the same url on the next attempt.
+	Generate(ctx context.Context, url string, attempt int) (string, error)
+}
+
+// CounterReserver takes n values of a counter no one took before and
+// returns the last of them, see IStorage.ReserveCounter.
+type CounterReserver func(ctx context.Context, n uint64) (uint64, error)
+
+func NewShortCodeGenerator(name, salt string, reserve CounterReserver) (ShortCodeGenerator, error) {
+	switch name {
+	case CRC32Gen, "":
+		return CRC32Generator{}, nil
+	case RandomGen:
+		return RandomGenerator{Length: randomCodeLength}, nil
+	case CounterGen:
+		return NewCounterGenerator(salt, reserve), nil
+	}
+	return nil, fmt.Errorf("UNKNOWN SHORT CODE GENERATOR: %s", name)
+}
+
+type CRC32Generator struct{}
+
+func (g CRC32Generator) Generate(_ context.Context, url string, attempt int) (string, error) {
+	if attempt > 0 {
+		url = fmt.Sprintf("%s#%d", url, attempt)
+	}
+
+	return fmt.Sprintf("%08x", crc32.Checksum([]byte(url), crc32.MakeTable(crc32.IEEE))), nil
+}
+
+type RandomGenerator struct {
+	Length int
+}
+
+func (g RandomGenerator) Generate(_ context.Context, _ string, _ int) (string, error) {
+	var code strings.Builder
+
+	alphabetLen := big.NewInt(int64(len(base62Alphabet)))
+
+	for i := 0; i < g.Length; i++ {
+		n, err := rand.Int(rand.Reader, alphabetLen)
+
+		if err != nil {
+			return "", err
+		}
+
+		code.WriteByte(base62Alphabet[n.Int64()])
+	}
+
+	return code.String(), nil
+}
+
+// CounterGenerator encodes increasing counter with alphabet shuffled
+// by salt, the same way Hashids/Sqids do. The counter is kept by the
+// storage and taken in blocks of counterBlock, so codes are short and
+// never repeat across processes and restarts.
+type CounterGenerator struct {
+	mu       sync.Mutex
+	next     uint64
+	last     uint64
+	reserve  CounterReserver
+	alphabet string
+}
+
+func NewCounterGenerator(salt string, reserve CounterReserver) *CounterGenerator {
+	return &CounterGenerator{
+		reserve:  reserve,
+		alphabet: shuffleAlphabet(base62Alphabet, salt),
+	}
+}
+
+func (g *CounterGenerator) Generate(ctx context.Context, _ string, _ int) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.next == 0 || g.next > g.last {
+		last, err := g.reserve(ctx, counterBlock)
+
+		if err != nil {
+			return "", err
+		}
+
+		g.next, g.last = last-counterBlock+1, last
+	}
+
+	n := g.next
+	g.next++
+
+	return g.encode(n), nil
+}
+
+func (g *CounterGenerator) encode(n uint64) string {
+	base := uint64(len(g.alphabet))
+	code := []byte{}
+
+	for n > 0 {
+		code = append(code, g.alphabet[n%base])
+		n /= base
+	}
+
+	for len(code) < counterCodeLength {
+		code = append(code, g.alphabet[0])
+	}
+
+	for i, j := 0, len(code)-1; i < j; i, j = i+1, j-1 {
+		code[i], code[j] = code[j], code[i]
+	}
+
+	return string(code)
+}
+
+func shuffleAlphabet(alphabet, salt string) string {
+	if salt == "" {
+		return alphabet
+	}
+
+	res := []byte(alphabet)
+
+	for i, v, p := len(res)-1, 0, 0; i > 0; i-- {
+		v %= len(salt)
+		p += int(salt[v])
+		j := (int(salt[v]) + v + p) % i
+		res[i], res[j] = res[j], res[i]
+		v++
+	}
+
+	return string(res)
+}
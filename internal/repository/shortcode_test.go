@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubGenerator struct {
+	codes []string
+}
+
+func (g stubGenerator) Generate(_ context.Context, _ string, attempt int) (string, error) {
+	return g.codes[attempt%len(g.codes)], nil
+}
+
+func TestShortCodeGenerators(t *testing.T) {
+	ctx := context.Background()
+	crc := CRC32Generator{}
+
+	first, err := crc.Generate(ctx, "www.ya.ru", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "b8da4f2d", first, "crc32 codes must stay compatible")
+
+	second, err := crc.Generate(ctx, "www.ya.ru", 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second, "retry must give another code")
+
+	random, err := RandomGenerator{Length: randomCodeLength}.Generate(ctx, "www.ya.ru", 0)
+	require.NoError(t, err)
+	assert.Len(t, random, randomCodeLength)
+
+	mem, err := NewInMemoryStorage(logger.NewLogger())
+	require.NoError(t, err)
+
+	// two replicas share the counter of one storage
+	counters := []*CounterGenerator{NewCounterGenerator("salt", mem.ReserveCounter), NewCounterGenerator("salt", mem.ReserveCounter)}
+	seen := map[string]bool{}
+
+	for i := 0; i < 1000; i++ {
+		code, err := counters[i%2].Generate(ctx, "www.ya.ru", 0)
+		require.NoError(t, err)
+		require.Len(t, code, counterCodeLength)
+		require.False(t, seen[code], "counter codes must not repeat")
+		seen[code] = true
+	}
+
+	_, err = NewShortCodeGenerator("unknown", "", mem.ReserveCounter)
+	assert.Error(t, err)
+}
+
+func TestCreateRetriesOnCollision(t *testing.T) {
+	lg := logger.NewLogger()
+	storage, err := NewInMemoryStorage(lg)
+	require.NoError(t, err)
+
+	s := &StorageService{
+		storage:   storage,
+		generator: stubGenerator{codes: []string{"same", "other"}},
+		logger:    lg,
+	}
+
+	first, err := s.Create(context.Background(), LinkRecord{URL: "https://first.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "same", first)
+
+	second, err := s.Create(context.Background(), LinkRecord{URL: "https://second.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "other", second, "colliding code must be regenerated")
+
+	url, err := s.Get(context.Background(), first)
+	require.NoError(t, err)
+	assert.Equal(t, "https://first.example.com", url, "first link must not be overwritten")
+
+	results, err := s.BatchCreate(context.Background(), []LinkRecord{{URL: "https://third.example.com"}, {URL: "https://fourth.example.com"}})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	for _, v := range results {
+		assert.Equal(t, BatchInvalid, v.Status)
+		assert.ErrorIs(t, v.Err, ErrCollision, "no free codes left")
+	}
+}
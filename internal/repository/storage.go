@@ -2,23 +2,51 @@ package repository
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/urlnorm"
 )
 
 const (
-	DBType   = "db"
-	MemType  = "mem"
-	FileType = "file"
+	DBType     = "db"
+	MemType    = "mem"
+	FileType   = "file"
+	RedisType  = "redis"
+	SQLiteType = "sqlite"
 )
 
 type StorageType string
 
 type StorageConfig struct {
-	StorageType StorageType
-	Logger      logger.MyLogger
-	DatabaseDSN string
-	FilePath    string
+	StorageType        StorageType
+	Logger             logger.MyLogger
+	DatabaseDSN        string
+	FilePath           string
+	RedisAddr          string
+	SQLitePath         string
+	ShortCodeGenerator string
+	ShortCodeSalt      string
+	ReaperInterval     time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	// CacheSize is how many links and urls are kept in memory
+	// for redirects, zero disables the cache. Every process has its
+	// own, so deletes by other replicas are seen after CacheTTL.
+	CacheSize    int
+	CacheTTL     time.Duration
+	CacheMissTTL time.Duration
+	// Policy is consulted before a url is shortened, nil allows every url.
+	Policy URLPolicy
+	// URLOptions normalize urls of imported links the way the server
+	// normalizes urls it is asked to shorten.
+	URLOptions urlnorm.Options
+}
+
+// URLPolicy returns an error for a url which must not be shortened
+// or redirected to.
+type URLPolicy interface {
+	Check(url string) error
 }
 
 func NewStorage(cfg StorageConfig) (IStorage, error) {
@@ -37,6 +65,10 @@ func NewStorage(cfg StorageConfig) (IStorage, error) {
 		}
 
 		return repo, err
+	case RedisType:
+		return NewInRedisStorage(cfg.Logger, cfg.RedisAddr)
+	case SQLiteType:
+		return NewInSQLiteStorage(cfg.Logger, cfg.SQLitePath)
 	case MemType:
 		return NewInMemoryStorage(cfg.Logger)
 	}
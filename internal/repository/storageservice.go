@@ -1,59 +1,563 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"hash/crc32"
+	"sync"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/DmitryM7/short-url.git/internal/urlnorm"
+)
+
+const (
+	delWorkers         = 4
+	delQueueSize       = 1024
+	delBatchSize       = 100
+	delFlushInterval   = time.Second
+	delEnqueueWait     = time.Second
+	maxGenAttempts     = 10
+	clickQueueSize     = 4096
+	clickBatchSize     = 500
+	clickFlushInterval = time.Second
 )
 
+// MaxDeleteURLs is how many links one DeleteURLs call may delete.
+const MaxDeleteURLs = 1000
+
 type StorageService struct {
-	storage IStorage
+	storage    IStorage
+	generator  ShortCodeGenerator
+	logger     logger.MyLogger
+	policy     URLPolicy
+	urlOpts    urlnorm.Options
+	delCh      chan LinkRecord
+	clickCh    chan Click
+	reaperStop chan struct{}
+	reaperDone chan struct{}
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu      sync.RWMutex // guards closed, senders to delCh and clickCh hold it for reading
+	closed  bool
+	workers sync.WaitGroup
 }
 
-func NewStorageService(cfg StorageConfig) (StorageService, error) {
+func NewStorageService(cfg StorageConfig) (*StorageService, error) {
 	repo, err := NewStorage(cfg)
 
 	if err != nil {
-		return StorageService{}, err
+		return nil, err
 	}
 
-	return StorageService{storage: repo}, nil
+	return NewStorageServiceFor(repo, cfg)
 }
 
-func (s *StorageService) BatchCreate(lnkRecs []LinkRecord) ([]LinkRecord, error) {
+// NewStorageServiceFor builds the service around an already created storage.
+func NewStorageServiceFor(repo IStorage, cfg StorageConfig) (*StorageService, error) {
+	generator, err := NewShortCodeGenerator(cfg.ShortCodeGenerator, cfg.ShortCodeSalt, repo.ReserveCounter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CacheSize > 0 {
+		repo = NewCachedStorage(repo, cfg.CacheSize, cfg.CacheTTL, cfg.CacheMissTTL)
+	}
+
+	s := &StorageService{
+		storage:   repo,
+		generator: generator,
+		logger:    cfg.Logger,
+		policy:    cfg.Policy,
+		urlOpts:   cfg.URLOptions,
+		delCh:     make(chan LinkRecord, delQueueSize),
+		clickCh:   make(chan Click, clickQueueSize),
+
+		readTimeout:  cfg.ReadTimeout,
+		writeTimeout: cfg.WriteTimeout,
+	}
+
+	s.workers.Add(delWorkers + 1)
+
+	for i := 0; i < delWorkers; i++ {
+		go s.deleteWorker()
+	}
+
+	go s.clickWorker()
+
+	if cfg.ReaperInterval > 0 {
+		s.reaperStop = make(chan struct{})
+		s.reaperDone = make(chan struct{})
+		go s.reaper(cfg.ReaperInterval)
+	}
+
+	return s, nil
+}
+
+// readCtx and writeCtx limit a single storage operation
+// with the timeouts from StorageConfig.
+func (s *StorageService) readCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.readTimeout)
+}
+
+func (s *StorageService) writeCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.writeTimeout)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// BatchCreate returns a result for every link in the same order. A link
+// with a bad alias or without a free code is only marked invalid, the
+// error is returned when the storage fails and then nothing is saved.
+// When the storage finds a code taken meanwhile, the whole batch is
+// tried again with codes picked anew.
+func (s *StorageService) BatchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	ctx, cancel := s.writeCtx(ctx)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		results, err := s.batchCreate(ctx, lnkRecs)
+
+		if !errors.Is(err, ErrShortURLTaken) {
+			return results, err
+		}
+
+		if attempt == maxGenAttempts {
+			return nil, ErrCollision
+		}
+
+		s.logger.Infoln("SHORT URL OF BATCH IS TAKEN", "attempt", attempt)
+	}
+}
+
+func (s *StorageService) batchCreate(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	results := make([]BatchResult, len(lnkRecs))
+	valid := make([]LinkRecord, 0, len(lnkRecs))
+	validAt := make([]int, 0, len(lnkRecs))
+	taken := make(map[string]string, len(lnkRecs))
+
 	for k, v := range lnkRecs {
-		lnkRecs[k].ShortURL = s.сalcShortURL(v.URL)
+		if err := s.CheckURL(v.URL); err != nil {
+			results[k] = BatchResult{LinkRecord: v, Status: BatchInvalid, Err: err}
+			continue
+		}
+
+		shortURL, err := s.shortURLFor(ctx, v, taken)
+
+		if isInvalidLink(err) {
+			results[k] = BatchResult{LinkRecord: v, Status: BatchInvalid, Err: err}
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		v.ShortURL = shortURL
+		taken[shortURL] = v.URL
+		valid = append(valid, v)
+		validAt = append(validAt, k)
+	}
+
+	saved, err := s.storage.BatchCreate(ctx, valid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range saved {
+		results[validAt[k]] = v
+	}
+
+	return results, nil
+}
+
+// CheckURL returns ErrBlocked with the reason when the domain policy
+// forbids the url.
+func (s *StorageService) CheckURL(url string) error {
+	if s.policy == nil {
+		return nil
+	}
+
+	if err := s.policy.Check(url); err != nil {
+		return fmt.Errorf("%w: %w", ErrBlocked, err)
+	}
+
+	return nil
+}
+
+// shortURLFor returns alias when the client asked for one in
+// lnkRec.ShortURL, otherwise it generates a new code.
+func (s *StorageService) shortURLFor(ctx context.Context, lnkRec LinkRecord, taken map[string]string) (string, error) {
+	if lnkRec.ShortURL == "" {
+		return s.сalcShortURL(ctx, lnkRec.URL, taken)
+	}
+
+	if err := ValidateAlias(lnkRec.ShortURL); err != nil {
+		return "", err
+	}
+
+	if takenURL, ok := taken[lnkRec.ShortURL]; ok && takenURL != lnkRec.URL {
+		return "", ErrAliasTaken
+	}
+
+	existing, err := s.storage.Get(ctx, lnkRec.ShortURL)
+
+	if errors.Is(err, ErrNotFound) {
+		return lnkRec.ShortURL, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if existing.URL != lnkRec.URL || existing.IsDeleted {
+		return "", ErrAliasTaken
+	}
+
+	return lnkRec.ShortURL, nil
+}
+
+// сalcShortURL asks generator for a new code until it finds one that is
+// free or already points to the same url. Taken holds codes which
+// are not saved yet but already given to other urls of the same batch.
+func (s *StorageService) сalcShortURL(ctx context.Context, url string, taken map[string]string) (string, error) {
+	for attempt := 0; attempt < maxGenAttempts; attempt++ {
+		shortURL, err := s.generator.Generate(ctx, url, attempt)
+
+		if err != nil {
+			return "", err
+		}
+
+		if takenURL, ok := taken[shortURL]; ok {
+			if takenURL == url {
+				return shortURL, nil
+			}
+			continue
+		}
+
+		lnkRec, err := s.storage.Get(ctx, shortURL)
+
+		if errors.Is(err, ErrNotFound) || (err == nil && lnkRec.URL == url && !lnkRec.IsDeleted) {
+			return shortURL, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		s.logger.Infoln("SHORT URL COLLISION", "shorturl", shortURL, "attempt", attempt)
+	}
+
+	return "", ErrCollision
+}
+
+// Create saves the link under lnkRec.ShortURL if it was set
+// as a custom alias, or under a generated code. The storage refuses
+// a code which another url took after it was checked, then a new
+// code is generated and an alias is reported as taken.
+func (s *StorageService) Create(ctx context.Context, lnkRec LinkRecord) (string, error) {
+	if err := s.CheckURL(lnkRec.URL); err != nil {
+		return "", err
 	}
 
-	err := s.storage.BatchCreate(lnkRecs)
+	ctx, cancel := s.writeCtx(ctx)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		shortURL, err := s.shortURLFor(ctx, lnkRec, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		lnk := lnkRec
+		lnk.ShortURL = shortURL
+		err = s.storage.Create(ctx, lnk)
+
+		if !errors.Is(err, ErrShortURLTaken) {
+			return shortURL, err
+		}
+
+		if lnkRec.ShortURL != "" {
+			return "", ErrAliasTaken
+		}
+
+		if attempt == maxGenAttempts {
+			return "", ErrCollision
+		}
+
+		s.logger.Infoln("SHORT URL IS TAKEN", "shorturl", shortURL, "attempt", attempt)
+	}
+}
+
+func (s *StorageService) Get(ctx context.Context, shorturl string) (string, error) {
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	lnkRec, err := s.storage.Get(ctx, shorturl)
 
 	if err != nil {
-		return lnkRecs, err
+		return "", err
 	}
 
-	return lnkRecs, nil
+	// tombstones of purged links are deleted too, but answer as expired
+	if lnkRec.IsExpired(time.Now()) {
+		return "", ErrExpired
+	}
+
+	if lnkRec.IsDeleted {
+		return "", ErrDeleted
+	}
+
+	return lnkRec.URL, nil
 }
 
-func (s *StorageService) сalcShortURL(url string) string {
-	return fmt.Sprintf("%08x", crc32.Checksum([]byte(url), crc32.MakeTable(crc32.IEEE)))
+func (s *StorageService) GetByURL(ctx context.Context, url string) (string, error) {
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	return s.storage.GetByURL(ctx, url)
 }
 
-func (s *StorageService) Create(url string) (string, error) {
-	shortURL := s.сalcShortURL(url)
-	lnkRec := LinkRecord{
-		ShortURL: shortURL,
-		URL:      url,
+func (s *StorageService) GetByUser(ctx context.Context, userID int) ([]LinkRecord, error) {
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	return s.storage.GetByUser(ctx, userID)
+}
+
+// DeleteURLs only queues links for deletion, the deleteWorker pool
+// marks them as deleted in the storage later. When the workers fall
+// behind and the queue stays full for delEnqueueWait it gives up with
+// ErrQueueFull, links queued by then are still deleted.
+func (s *StorageService) DeleteURLs(ctx context.Context, userID int, shortURLs []string) error {
+	if len(shortURLs) > MaxDeleteURLs {
+		return ErrTooManyLinks
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		s.logger.Infoln("STORAGE IS CLOSED. DELETE DROPPED", "userid", userID)
+		return nil
 	}
-	return shortURL, s.storage.Create(lnkRec)
+
+	timer := time.NewTimer(delEnqueueWait)
+	defer timer.Stop()
+
+	for _, v := range shortURLs {
+		select {
+		case s.delCh <- LinkRecord{ShortURL: v, UserID: userID}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return ErrQueueFull
+		}
+	}
+
+	return nil
 }
 
-func (s *StorageService) Get(shorturl string) (string, error) {
-	return s.storage.Get(shorturl)
+func (s *StorageService) deleteWorker() {
+	defer s.workers.Done()
+
+	ticker := time.NewTicker(delFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]LinkRecord, 0, delBatchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := s.writeCtx(context.Background())
+		defer cancel()
+
+		if err := s.storage.BatchDelete(ctx, batch); err != nil {
+			s.logger.Errorln("CAN'T DELETE LINKS:" + err.Error())
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case lnkRec, ok := <-s.delCh:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, lnkRec)
+
+			if len(batch) >= delBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
 }
 
-func (s *StorageService) GetByURL(url string) (string, error) {
-	return s.storage.GetByURL(url)
+// RecordClick never blocks the redirect: when the queue is full
+// the click is dropped.
+func (s *StorageService) RecordClick(click Click) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.clickCh <- click:
+	default:
+		s.logger.Infoln("CLICK QUEUE IS FULL. CLICK DROPPED", "shorturl", click.ShortURL)
+	}
 }
 
-func (s *StorageService) Ping() bool {
-	return s.storage.Ping()
+func (s *StorageService) clickWorker() {
+	defer s.workers.Done()
+
+	ticker := time.NewTicker(clickFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Click, 0, clickBatchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := s.writeCtx(context.Background())
+		defer cancel()
+
+		if err := s.storage.SaveClicks(ctx, batch); err != nil {
+			s.logger.Errorln("CAN'T SAVE CLICKS:" + err.Error())
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case click, ok := <-s.clickCh:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, click)
+
+			if len(batch) >= clickBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *StorageService) GetStats(ctx context.Context, shorturl string) (LinkStats, error) {
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	_, err := s.storage.Get(ctx, shorturl)
+
+	if err != nil {
+		return LinkStats{}, err
+	}
+
+	return s.storage.GetStats(ctx, shorturl)
+}
+
+// reaper purges expired links from the storage every interval
+// until stopReaper is called.
+func (s *StorageService) reaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(s.reaperDone)
+
+	for {
+		select {
+		case <-s.reaperStop:
+			return
+		case now := <-ticker.C:
+			purged, err := s.purgeExpired(now)
+
+			if err != nil {
+				s.logger.Errorln("CAN'T PURGE EXPIRED LINKS:" + err.Error())
+				continue
+			}
+
+			if purged > 0 {
+				s.logger.Infoln("PURGE EXPIRED LINKS", "count", purged)
+			}
+		}
+	}
+}
+
+func (s *StorageService) purgeExpired(now time.Time) (int, error) {
+	ctx, cancel := s.writeCtx(context.Background())
+	defer cancel()
+
+	return s.storage.PurgeExpired(ctx, now)
+}
+
+// stopReaper stops the reaper and waits for the running purge to finish.
+func (s *StorageService) stopReaper() {
+	if s.reaperStop == nil {
+		return
+	}
+
+	close(s.reaperStop)
+	<-s.reaperDone
+}
+
+// Close waits until queued deletes and clicks are written,
+// stops background workers and closes the storage.
+func (s *StorageService) Close() error {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.delCh)
+	close(s.clickCh)
+	s.workers.Wait()
+	s.stopReaper()
+
+	return s.storage.Close()
+}
+
+// VisitorSalt may make the salt, so it is a write.
+func (s *StorageService) VisitorSalt(ctx context.Context) ([]byte, error) {
+	ctx, cancel := s.writeCtx(ctx)
+	defer cancel()
+
+	return s.storage.VisitorSalt(ctx)
+}
+
+func (s *StorageService) Ping(ctx context.Context) bool {
+	ctx, cancel := s.readCtx(ctx)
+	defer cancel()
+
+	return s.storage.Ping(ctx)
 }
@@ -0,0 +1,371 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaperPurgesExpired(t *testing.T) {
+	s, err := NewStorageService(StorageConfig{
+		StorageType:    MemType,
+		Logger:         logger.NewLogger(),
+		ReaperInterval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	expired, err := s.Create(context.Background(), LinkRecord{URL: "https://reaper.example.com/expired", ExpiresAt: time.Now().Add(100 * time.Millisecond)})
+	require.NoError(t, err)
+
+	alive, err := s.Create(context.Background(), LinkRecord{URL: "https://reaper.example.com/alive", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		lnkRec, err := s.storage.Get(context.Background(), expired)
+		return err == nil && lnkRec.isTombstone()
+	}, 2*time.Second, 50*time.Millisecond, "expired link must be purged")
+
+	_, err = s.Get(context.Background(), expired)
+	assert.ErrorIs(t, err, ErrExpired, "purged link still answers as expired")
+
+	_, err = s.Create(context.Background(), LinkRecord{URL: "https://reaper.example.com/other", ShortURL: expired})
+	assert.ErrorIs(t, err, ErrAliasTaken, "purged short url stays taken")
+
+	again, err := s.Create(context.Background(), LinkRecord{URL: "https://reaper.example.com/expired"})
+	require.NoError(t, err, "url of a purged link can be shortened again")
+	assert.NotEqual(t, expired, again)
+
+	url, err := s.Get(context.Background(), alive)
+	require.NoError(t, err)
+	assert.Equal(t, "https://reaper.example.com/alive", url)
+
+	require.NoError(t, s.Close())
+}
+
+func TestCreateConflictOnEveryBackend(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: MemType},
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			ctx := context.Background()
+
+			first, err := s.Create(ctx, LinkRecord{URL: "https://conflict.example.com"})
+			require.NoError(t, err)
+
+			_, err = s.Create(ctx, LinkRecord{URL: "https://conflict.example.com", ShortURL: "other-alias"})
+
+			var conflict *ErrConflict
+			require.ErrorAs(t, err, &conflict)
+			assert.Equal(t, first, conflict.ShortURL)
+
+			_, err = s.Get(ctx, "other-alias")
+			assert.ErrorIs(t, err, ErrNotFound, "conflicting link must not be saved")
+		})
+	}
+}
+
+func TestVisitorSaltIsKept(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+			ctx := context.Background()
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+
+			salt, err := s.VisitorSalt(ctx)
+			require.NoError(t, err)
+			assert.Len(t, salt, visitorSaltLength)
+
+			again, err := s.VisitorSalt(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, salt, again)
+			require.NoError(t, s.Close())
+
+			s, err = NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			again, err = s.VisitorSalt(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, salt, again, "salt survives a restart")
+		})
+	}
+}
+
+func TestCounterCodesSurviveRestart(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+			cfg.ShortCodeGenerator = CounterGen
+			ctx := context.Background()
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+
+			first, err := s.Create(ctx, LinkRecord{URL: "https://first.example.com"})
+			require.NoError(t, err)
+			assert.Len(t, first, counterCodeLength)
+			require.NoError(t, s.Close())
+
+			s, err = NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			second, err := s.Create(ctx, LinkRecord{URL: "https://second.example.com"})
+			require.NoError(t, err)
+			assert.Len(t, second, counterCodeLength)
+			assert.NotEqual(t, first, second)
+
+			last, err := s.storage.ReserveCounter(ctx, 1)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(2*counterBlock+1), last, "the counter is kept by the storage")
+		})
+	}
+}
+
+// blindStorage never finds a link by short url, as if every check
+// happened just before another client took the code.
+type blindStorage struct {
+	*InMemoryStorage
+}
+
+func (b blindStorage) Get(_ context.Context, _ string) (LinkRecord, error) {
+	return LinkRecord{}, ErrNotFound
+}
+
+// seqGenerator hands out its codes one by one.
+type seqGenerator struct {
+	codes []string
+}
+
+func (g *seqGenerator) Generate(_ context.Context, _ string, _ int) (string, error) {
+	code := g.codes[0]
+	g.codes = g.codes[1:]
+
+	return code, nil
+}
+
+func TestCreateRetriesCodeTakenMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	lg := logger.NewLogger()
+
+	mem, err := NewInMemoryStorage(lg)
+	require.NoError(t, err)
+	require.NoError(t, mem.Create(ctx, LinkRecord{ShortURL: "aaa", URL: "https://first.example.com"}))
+
+	s, err := NewStorageServiceFor(blindStorage{mem}, StorageConfig{Logger: lg})
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.generator = &seqGenerator{codes: []string{"aaa", "aaa", "bbb", "aaa", "ccc"}}
+
+	shorturl, err := s.Create(ctx, LinkRecord{URL: "https://second.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "bbb", shorturl)
+
+	_, err = s.Create(ctx, LinkRecord{URL: "https://third.example.com", ShortURL: "aaa"})
+	assert.ErrorIs(t, err, ErrAliasTaken)
+
+	results, err := s.BatchCreate(ctx, []LinkRecord{{URL: "https://fourth.example.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, BatchCreated, results[0].Status)
+	assert.Equal(t, "ccc", results[0].ShortURL)
+
+	lnkRec, err := mem.Get(ctx, "aaa")
+	require.NoError(t, err)
+	assert.Equal(t, "https://first.example.com", lnkRec.URL, "taken code keeps its url")
+}
+
+func TestConcurrentAliasHasOneOwner(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: MemType},
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = logger.NewLogger()
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			const clients = 8
+
+			var (
+				wg      sync.WaitGroup
+				created atomic.Int32
+			)
+
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					_, err := s.Create(ctx, LinkRecord{URL: fmt.Sprintf("https://race.example.com/%d", i), ShortURL: "race"})
+
+					if err == nil {
+						created.Add(1)
+						return
+					}
+
+					assert.ErrorIs(t, err, ErrAliasTaken)
+				}(i)
+			}
+
+			wg.Wait()
+
+			assert.Equal(t, int32(1), created.Load())
+		})
+	}
+}
+
+// stuckDeletes holds BatchDelete until release is closed.
+type stuckDeletes struct {
+	*InMemoryStorage
+	release chan struct{}
+}
+
+func (s stuckDeletes) BatchDelete(ctx context.Context, lnkRecs []LinkRecord) error {
+	<-s.release
+	return s.InMemoryStorage.BatchDelete(ctx, lnkRecs)
+}
+
+func TestDeleteURLsQueueIsBounded(t *testing.T) {
+	ctx := context.Background()
+	lg := logger.NewLogger()
+
+	mem, err := NewInMemoryStorage(lg)
+	require.NoError(t, err)
+
+	storage := stuckDeletes{InMemoryStorage: mem, release: make(chan struct{})}
+
+	s, err := NewStorageServiceFor(storage, StorageConfig{Logger: lg})
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, s.DeleteURLs(ctx, 1, make([]string, MaxDeleteURLs+1)), ErrTooManyLinks)
+
+	ids := make([]string, MaxDeleteURLs)
+
+	for k := range ids {
+		ids[k] = fmt.Sprintf("id%d", k)
+	}
+
+	err = nil
+
+	for i := 0; i < 3 && err == nil; i++ {
+		err = s.DeleteURLs(ctx, 1, ids)
+	}
+
+	assert.ErrorIs(t, err, ErrQueueFull, "stuck workers must not make deletes pile up")
+
+	close(storage.release)
+	require.NoError(t, s.Close())
+}
+
+func TestReshortenDeletedURLOnEveryBackend(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+
+	configs := []StorageConfig{
+		{StorageType: MemType, CacheSize: 10, CacheTTL: time.Minute},
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			ctx := context.Background()
+			url := "https://reshorten.example.com"
+
+			first, err := s.Create(ctx, LinkRecord{URL: url, UserID: 1})
+			require.NoError(t, err)
+
+			shorturl, err := s.GetByURL(ctx, url)
+			require.NoError(t, err)
+			require.Equal(t, first, shorturl)
+
+			require.NoError(t, s.storage.BatchDelete(ctx, []LinkRecord{{ShortURL: first, UserID: 1}}))
+
+			_, err = s.GetByURL(ctx, url)
+			assert.ErrorIs(t, err, ErrNotFound, "a deleted link does not own its url")
+
+			second, err := s.Create(ctx, LinkRecord{URL: url, UserID: 1})
+			require.NoError(t, err, "a deleted url can be shortened again")
+			assert.NotEqual(t, first, second)
+
+			_, err = s.Get(ctx, first)
+			assert.ErrorIs(t, err, ErrDeleted, "the deleted link stays gone")
+
+			got, err := s.Get(ctx, second)
+			require.NoError(t, err)
+			assert.Equal(t, url, got)
+
+			_, err = s.Create(ctx, LinkRecord{URL: url, UserID: 1})
+
+			var conflict *ErrConflict
+			require.ErrorAs(t, err, &conflict)
+			assert.Equal(t, second, conflict.ShortURL)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DmitryM7/short-url.git/internal/urlnorm"
+)
+
+// upsertPlan decides what Upsert does with every link of a batch for
+// storages which keep links in memory, and what Planner says Import
+// would do. Links of the batch are seen by the links after them.
+type upsertPlan struct {
+	get   func(ctx context.Context, shorturl string) (LinkRecord, error)
+	owner func(ctx context.Context, url string) (string, error)
+	links map[string]LinkRecord
+	// urls freed by the batch map to ""
+	urls map[string]string
+}
+
+// newUpsertPlan looks up links which are not in the batch with get and
+// owner, they answer ErrNotFound for missing ones.
+func newUpsertPlan(get func(context.Context, string) (LinkRecord, error), owner func(context.Context, string) (string, error)) *upsertPlan {
+	return &upsertPlan{
+		get:   get,
+		owner: owner,
+		links: map[string]LinkRecord{},
+		urls:  map[string]string{},
+	}
+}
+
+func (r *InMemoryStorage) newUpsertPlan() *upsertPlan {
+	return newUpsertPlan(r.Get, r.GetByURL)
+}
+
+func (p *upsertPlan) result(ctx context.Context, lnkRec LinkRecord) (BatchResult, error) {
+	lnkRec.CorrelationID = ""
+	res := BatchResult{LinkRecord: lnkRec, Status: BatchCreated}
+
+	owner, ok, err := p.ownerOf(ctx, lnkRec.URL)
+
+	if err != nil {
+		return res, err
+	}
+
+	if ok && owner != lnkRec.ShortURL {
+		res.ShortURL = owner
+		res.Status = BatchExisting
+		return res, nil
+	}
+
+	old, existed, err := p.linkOf(ctx, lnkRec.ShortURL)
+
+	if err != nil {
+		return res, err
+	}
+
+	if existed {
+		if old.sameAs(lnkRec) {
+			res.Status = BatchUnchanged
+			return res, nil
+		}
+
+		res.Status = BatchUpdated
+
+		if old.URL != lnkRec.URL {
+			p.urls[old.URL] = ""
+		}
+	}
+
+	p.links[lnkRec.ShortURL] = lnkRec
+	p.urls[lnkRec.URL] = lnkRec.ShortURL
+
+	// a deleted link does not own its url
+	if lnkRec.IsDeleted {
+		p.urls[lnkRec.URL] = ""
+	}
+
+	return res, nil
+}
+
+func (p *upsertPlan) ownerOf(ctx context.Context, url string) (string, bool, error) {
+	if shorturl, ok := p.urls[url]; ok {
+		return shorturl, shorturl != "", nil
+	}
+
+	shorturl, err := p.owner(ctx, url)
+
+	if errors.Is(err, ErrNotFound) {
+		return "", false, nil
+	}
+
+	return shorturl, err == nil, err
+}
+
+func (p *upsertPlan) linkOf(ctx context.Context, shorturl string) (LinkRecord, bool, error) {
+	if lnkRec, ok := p.links[shorturl]; ok {
+		return lnkRec, true, nil
+	}
+
+	lnkRec, err := p.get(ctx, shorturl)
+
+	if errors.Is(err, ErrNotFound) {
+		return LinkRecord{}, false, nil
+	}
+
+	return lnkRec, err == nil, err
+}
+
+// isWritten tells results of Upsert which changed the storage.
+func isWritten(res BatchResult) bool {
+	return res.Status == BatchCreated || res.Status == BatchUpdated
+}
+
+// Export calls fn for every stored link. It is not limited by the read
+// timeout, walking a big storage takes long.
+func (s *StorageService) Export(ctx context.Context, fn func(LinkRecord) error) error {
+	return s.storage.Iterate(ctx, fn)
+}
+
+// Import saves links under their short urls, see IStorage.Upsert. A link
+// is checked the way Create checks it: the url is normalized and must
+// pass the domain policy and the short url must do as an alias. A link
+// which fails is only marked invalid and not saved.
+func (s *StorageService) Import(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	results, valid, validAt, err := s.checkImported(lnkRecs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.writeCtx(ctx)
+	defer cancel()
+
+	saved, err := s.storage.Upsert(ctx, valid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range saved {
+		results[validAt[k]] = v
+	}
+
+	return results, nil
+}
+
+// checkImported marks links which Import refuses invalid in results and
+// returns the others, normalized, with their places in lnkRecs.
+func (s *StorageService) checkImported(lnkRecs []LinkRecord) ([]BatchResult, []LinkRecord, []int, error) {
+	results := make([]BatchResult, len(lnkRecs))
+	valid := make([]LinkRecord, 0, len(lnkRecs))
+	validAt := make([]int, 0, len(lnkRecs))
+
+	for k, v := range lnkRecs {
+		if v.ShortURL == "" || v.URL == "" {
+			return nil, nil, nil, ErrIncompleteLink
+		}
+
+		if err := ValidateAlias(v.ShortURL); err != nil {
+			results[k] = BatchResult{LinkRecord: v, Status: BatchInvalid, Err: err}
+			continue
+		}
+
+		url, err := urlnorm.Normalize(v.URL, s.urlOpts)
+
+		if err == nil {
+			err = s.CheckURL(url)
+		}
+
+		if err != nil {
+			results[k] = BatchResult{LinkRecord: v, Status: BatchInvalid, Err: err}
+			continue
+		}
+
+		v.URL = url
+		valid = append(valid, v)
+		validAt = append(validAt, k)
+	}
+
+	return results, valid, validAt, nil
+}
+
+// Planner tells what Import would do with links without saving them.
+// A link sees the links planned before it, in its batch or an earlier
+// one, as it would after Import of those batches.
+type Planner struct {
+	s    *StorageService
+	plan *upsertPlan
+}
+
+// NewPlanner starts a plan, batches of one import go to the same one.
+func (s *StorageService) NewPlanner() *Planner {
+	return &Planner{s: s, plan: newUpsertPlan(s.storage.Get, s.storage.GetByURL)}
+}
+
+func (p *Planner) Plan(ctx context.Context, lnkRecs []LinkRecord) ([]BatchResult, error) {
+	results, valid, validAt, err := p.s.checkImported(lnkRecs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := p.s.readCtx(ctx)
+	defer cancel()
+
+	for k, v := range valid {
+		res, err := p.plan.result(ctx, v)
+
+		if err != nil {
+			return nil, err
+		}
+
+		results[validAt[k]] = res
+	}
+
+	return results, nil
+}
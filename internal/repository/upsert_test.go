@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func statuses(results []BatchResult) []BatchStatus {
+	s := make([]BatchStatus, len(results))
+
+	for k, v := range results {
+		s[k] = v.Status
+	}
+
+	return s
+}
+
+func TestImportExportOnEveryBackend(t *testing.T) {
+	lg := logger.NewLogger()
+	dir := t.TempDir()
+	mr := miniredis.RunT(t)
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Microsecond)
+
+	configs := []StorageConfig{
+		{StorageType: MemType},
+		{StorageType: FileType, FilePath: filepath.Join(dir, "repo.json")},
+		{StorageType: SQLiteType, SQLitePath: filepath.Join(dir, "repo.db")},
+		{StorageType: RedisType, RedisAddr: mr.Addr()},
+	}
+
+	for _, cfg := range configs {
+		t.Run(string(cfg.StorageType), func(t *testing.T) {
+			cfg.Logger = lg
+
+			s, err := NewStorageService(cfg)
+			require.NoError(t, err)
+			defer s.Close()
+
+			ctx := context.Background()
+
+			_, err = s.Create(ctx, LinkRecord{ShortURL: "own", URL: "https://owned.example.com", UserID: 1})
+			require.NoError(t, err)
+
+			lnkRecs := []LinkRecord{
+				{ShortURL: "abc", URL: "https://a.example.com", UserID: 2, ExpiresAt: expires},
+				{ShortURL: "def", URL: "https://d.example.com", UserID: 3, IsDeleted: true},
+				{ShortURL: "xyz", URL: "https://owned.example.com", UserID: 4},
+			}
+
+			planned, err := s.NewPlanner().Plan(ctx, lnkRecs)
+			require.NoError(t, err)
+			assert.Equal(t, []BatchStatus{BatchCreated, BatchCreated, BatchExisting}, statuses(planned))
+
+			results, err := s.Import(ctx, lnkRecs)
+			require.NoError(t, err)
+			assert.Equal(t, []BatchStatus{BatchCreated, BatchCreated, BatchExisting}, statuses(results))
+			assert.Equal(t, "own", results[2].ShortURL)
+
+			results, err = s.Import(ctx, lnkRecs)
+			require.NoError(t, err)
+			assert.Equal(t, []BatchStatus{BatchUnchanged, BatchUnchanged, BatchExisting}, statuses(results),
+				"importing again changes nothing")
+
+			moved := LinkRecord{ShortURL: "abc", URL: "https://moved.example.com", UserID: 2}
+			results, err = s.Import(ctx, []LinkRecord{moved})
+			require.NoError(t, err)
+			assert.Equal(t, []BatchStatus{BatchUpdated}, statuses(results))
+
+			_, err = s.GetByURL(ctx, "https://a.example.com")
+			assert.ErrorIs(t, err, ErrNotFound, "the old url is free")
+
+			shorturl, err := s.GetByURL(ctx, "https://moved.example.com")
+			require.NoError(t, err)
+			assert.Equal(t, "abc", shorturl)
+
+			_, err = s.Import(ctx, []LinkRecord{{ShortURL: "nourl"}})
+			assert.ErrorIs(t, err, ErrIncompleteLink)
+
+			_, err = s.NewPlanner().Plan(ctx, []LinkRecord{{ShortURL: "nourl"}})
+			assert.ErrorIs(t, err, ErrIncompleteLink)
+
+			exported := []LinkRecord{}
+
+			require.NoError(t, s.Export(ctx, func(lnkRec LinkRecord) error {
+				exported = append(exported, lnkRec)
+				return nil
+			}))
+
+			sort.Slice(exported, func(i, j int) bool { return exported[i].ShortURL < exported[j].ShortURL })
+
+			require.Len(t, exported, 3)
+			assert.True(t, moved.sameAs(exported[0]))
+			assert.True(t, lnkRecs[1].sameAs(exported[1]), "deleted links are exported")
+			assert.Equal(t, "own", exported[2].ShortURL)
+
+			batch := []LinkRecord{
+				{ShortURL: "pp1", URL: "https://batch.example.com"},
+				{ShortURL: "pp2", URL: "https://batch.example.com"},
+				{ShortURL: "pp1", URL: "https://batch.example.com/moved"},
+			}
+
+			planned, err = s.NewPlanner().Plan(ctx, batch)
+			require.NoError(t, err)
+			assert.Equal(t, []BatchStatus{BatchCreated, BatchExisting, BatchUpdated}, statuses(planned),
+				"plan sees earlier links of the batch")
+
+			results, err = s.Import(ctx, batch)
+			require.NoError(t, err)
+			assert.Equal(t, statuses(planned), statuses(results))
+
+			batches := [][]LinkRecord{
+				{{ShortURL: "qq1", URL: "https://batches.example.com"}},
+				{{ShortURL: "qq2", URL: "https://batches.example.com"}},
+			}
+			planner := s.NewPlanner()
+			planned, imported := []BatchResult{}, []BatchResult{}
+
+			for _, v := range batches {
+				results, err = planner.Plan(ctx, v)
+				require.NoError(t, err)
+				planned = append(planned, results...)
+			}
+
+			for _, v := range batches {
+				results, err = s.Import(ctx, v)
+				require.NoError(t, err)
+				imported = append(imported, results...)
+			}
+
+			assert.Equal(t, []BatchStatus{BatchCreated, BatchExisting}, statuses(imported))
+			assert.Equal(t, statuses(imported), statuses(planned), "plan sees links of earlier batches")
+
+			bad := []LinkRecord{
+				{ShortURL: "js1", URL: "javascript:alert(1)"},
+				{ShortURL: "sp1", URL: "https://space.example.com/a b"},
+				{ShortURL: "a/b", URL: "https://slash.example.com"},
+				{ShortURL: "api", URL: "https://reserved.example.com"},
+				{ShortURL: "norm", URL: " HTTPS://Norm.Example.com:443/ "},
+			}
+
+			planned, err = s.NewPlanner().Plan(ctx, bad)
+			require.NoError(t, err)
+
+			results, err = s.Import(ctx, bad)
+			require.NoError(t, err)
+			assert.Equal(t, []BatchStatus{BatchInvalid, BatchInvalid, BatchInvalid, BatchInvalid, BatchCreated}, statuses(results))
+			assert.Equal(t, statuses(results), statuses(planned))
+			assert.ErrorIs(t, results[2].Err, ErrInvalidAlias)
+
+			_, err = s.Get(ctx, "js1")
+			assert.ErrorIs(t, err, ErrNotFound, "invalid links are not stored")
+
+			shorturl, err = s.GetByURL(ctx, "https://norm.example.com")
+			require.NoError(t, err)
+			assert.Equal(t, "norm", shorturl, "imported urls are normalized")
+		})
+	}
+}
+
+type denyHost string
+
+func (d denyHost) Check(url string) error {
+	if strings.Contains(url, string(d)) {
+		return errors.New("DENIED")
+	}
+
+	return nil
+}
+
+func TestImportChecksPolicy(t *testing.T) {
+	s, err := NewStorageService(StorageConfig{StorageType: MemType, Logger: logger.NewLogger(), Policy: denyHost("evil.example.com")})
+	require.NoError(t, err)
+	defer s.Close()
+
+	results, err := s.Import(context.Background(), []LinkRecord{
+		{ShortURL: "bad", URL: "https://evil.example.com"},
+		{ShortURL: "good", URL: "https://good.example.com"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []BatchStatus{BatchInvalid, BatchCreated}, statuses(results))
+	assert.ErrorIs(t, results[0].Err, ErrBlocked)
+}
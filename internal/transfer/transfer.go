@@ -0,0 +1,237 @@
+// Package transfer reads and writes links as JSON lines or CSV,
+// so they can be moved from one storage to another.
+//
+// JSON lines are the records InFileStorage writes to its log. CSV has
+// a header line and columns short_url, url, user_id, is_deleted and
+// expires_at, the latter is RFC 3339 or empty.
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/repository"
+)
+
+type Format string
+
+const (
+	FormatJSONL Format = "jsonl"
+	FormatCSV   Format = "csv"
+)
+
+var (
+	ErrBadFormat = errors.New("FORMAT MUST BE jsonl OR csv")
+	ErrBadHeader = errors.New("CSV HEADER MUST BE short_url,url,user_id,is_deleted,expires_at")
+)
+
+var csvHeader = []string{"short_url", "url", "user_id", "is_deleted", "expires_at"}
+
+// FormatFor returns format if it is set, otherwise guesses it by
+// extension of path. Anything but .csv is read as JSON lines.
+func FormatFor(format, path string) (Format, error) {
+	switch Format(strings.ToLower(format)) {
+	case FormatJSONL:
+		return FormatJSONL, nil
+	case FormatCSV:
+		return FormatCSV, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			return FormatCSV, nil
+		}
+
+		return FormatJSONL, nil
+	}
+
+	return "", ErrBadFormat
+}
+
+// Writer writes links one by one, Flush must be called at the end.
+type Writer struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+	csv *csv.Writer
+}
+
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	buf := bufio.NewWriter(w)
+
+	switch format {
+	case FormatJSONL:
+		return &Writer{buf: buf, enc: json.NewEncoder(buf)}, nil
+	case FormatCSV:
+		cw := csv.NewWriter(buf)
+		return &Writer{buf: buf, csv: cw}, cw.Write(csvHeader)
+	}
+
+	return nil, ErrBadFormat
+}
+
+func (w *Writer) Write(lnkRec repository.LinkRecord) error {
+	lnkRec.CorrelationID = ""
+
+	if w.enc != nil {
+		return w.enc.Encode(lnkRec)
+	}
+
+	expiresAt := ""
+
+	if !lnkRec.ExpiresAt.IsZero() {
+		expiresAt = lnkRec.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	return w.csv.Write([]string{
+		lnkRec.ShortURL,
+		lnkRec.URL,
+		strconv.Itoa(lnkRec.UserID),
+		strconv.FormatBool(lnkRec.IsDeleted),
+		expiresAt,
+	})
+}
+
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	return w.buf.Flush()
+}
+
+// Reader returns links one by one and io.EOF after the last one.
+type Reader struct {
+	lines *bufio.Scanner
+	csv   *csv.Reader
+	line  int
+}
+
+const maxLine = 1 << 20
+
+func NewReader(r io.Reader, format Format) (*Reader, error) {
+	switch format {
+	case FormatJSONL:
+		lines := bufio.NewScanner(r)
+		lines.Buffer(make([]byte, 0, 64*1024), maxLine)
+		return &Reader{lines: lines}, nil
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		cr.ReuseRecord = true
+
+		header, err := cr.Read()
+
+		if errors.Is(err, io.EOF) {
+			return &Reader{csv: cr}, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range csvHeader {
+			if strings.TrimSpace(header[k]) != v {
+				return nil, ErrBadHeader
+			}
+		}
+
+		return &Reader{csv: cr, line: 1}, nil
+	}
+
+	return nil, ErrBadFormat
+}
+
+func (r *Reader) Read() (repository.LinkRecord, error) {
+	var (
+		lnkRec repository.LinkRecord
+		err    error
+	)
+
+	if r.lines != nil {
+		lnkRec, err = r.readJSON()
+	} else {
+		lnkRec, err = r.readCSV()
+	}
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		return lnkRec, fmt.Errorf("LINE %d: %w", r.line, err)
+	}
+
+	return lnkRec, err
+}
+
+func (r *Reader) readJSON() (repository.LinkRecord, error) {
+	lnkRec := repository.LinkRecord{}
+
+	for r.lines.Scan() {
+		r.line++
+
+		line := r.lines.Bytes()
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if err := json.Unmarshal(line, &lnkRec); err != nil {
+			return lnkRec, err
+		}
+
+		return lnkRec, complete(lnkRec)
+	}
+
+	if err := r.lines.Err(); err != nil {
+		return lnkRec, err
+	}
+
+	return lnkRec, io.EOF
+}
+
+func (r *Reader) readCSV() (repository.LinkRecord, error) {
+	lnkRec := repository.LinkRecord{}
+
+	r.line++
+
+	record, err := r.csv.Read()
+
+	if err != nil {
+		return lnkRec, err
+	}
+
+	lnkRec.ShortURL = record[0]
+	lnkRec.URL = record[1]
+
+	if lnkRec.UserID, err = strconv.Atoi(record[2]); err != nil {
+		return lnkRec, err
+	}
+
+	if lnkRec.IsDeleted, err = strconv.ParseBool(record[3]); err != nil {
+		return lnkRec, err
+	}
+
+	if record[4] != "" {
+		if lnkRec.ExpiresAt, err = time.Parse(time.RFC3339Nano, record[4]); err != nil {
+			return lnkRec, err
+		}
+	}
+
+	return lnkRec, complete(lnkRec)
+}
+
+func complete(lnkRec repository.LinkRecord) error {
+	if lnkRec.ShortURL == "" || lnkRec.URL == "" {
+		return repository.ErrIncompleteLink
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DmitryM7/short-url.git/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, r *Reader) []repository.LinkRecord {
+	t.Helper()
+
+	lnkRecs := []repository.LinkRecord{}
+
+	for {
+		lnkRec, err := r.Read()
+
+		if errors.Is(err, io.EOF) {
+			return lnkRecs
+		}
+
+		require.NoError(t, err)
+		lnkRecs = append(lnkRecs, lnkRec)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	lnkRecs := []repository.LinkRecord{
+		{ShortURL: "abc", URL: "https://example.com/?a=1,b=\"2\"", UserID: 7},
+		{ShortURL: "def", URL: "https://example.org", UserID: 8, IsDeleted: true,
+			ExpiresAt: time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)},
+	}
+
+	for _, format := range []Format{FormatJSONL, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+
+			w, err := NewWriter(&buf, format)
+			require.NoError(t, err)
+
+			for _, v := range lnkRecs {
+				v.CorrelationID = "not exported"
+				require.NoError(t, w.Write(v))
+			}
+
+			require.NoError(t, w.Flush())
+
+			r, err := NewReader(&buf, format)
+			require.NoError(t, err)
+
+			got := readAll(t, r)
+			require.Len(t, got, len(lnkRecs))
+
+			for k, v := range lnkRecs {
+				assert.Equal(t, v.ShortURL, got[k].ShortURL)
+				assert.Equal(t, v.URL, got[k].URL)
+				assert.Equal(t, v.UserID, got[k].UserID)
+				assert.Equal(t, v.IsDeleted, got[k].IsDeleted)
+				assert.True(t, v.ExpiresAt.Equal(got[k].ExpiresAt))
+				assert.Empty(t, got[k].CorrelationID)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	r, err := NewReader(strings.NewReader("{\"short_url\":\"abc\",\"url\":\"https://example.com\"}\n\n{\"url\":\"https://example.org\"}\n"), FormatJSONL)
+	require.NoError(t, err)
+
+	_, err = r.Read()
+	require.NoError(t, err)
+
+	_, err = r.Read()
+	assert.ErrorIs(t, err, repository.ErrIncompleteLink)
+	assert.Contains(t, err.Error(), "LINE 3")
+
+	_, err = NewReader(strings.NewReader("code,url\n"), FormatCSV)
+	assert.Error(t, err)
+
+	r, err = NewReader(strings.NewReader("short_url,url,user_id,is_deleted,expires_at\nabc,https://example.com,x,false,\n"), FormatCSV)
+	require.NoError(t, err)
+
+	_, err = r.Read()
+	assert.ErrorContains(t, err, "LINE 2")
+}
+
+func TestFormatFor(t *testing.T) {
+	format, err := FormatFor("", "links.CSV")
+	require.NoError(t, err)
+	assert.Equal(t, FormatCSV, format)
+
+	format, err = FormatFor("", "")
+	require.NoError(t, err)
+	assert.Equal(t, FormatJSONL, format)
+
+	format, err = FormatFor("csv", "links.jsonl")
+	require.NoError(t, err)
+	assert.Equal(t, FormatCSV, format)
+
+	_, err = FormatFor("xml", "")
+	assert.ErrorIs(t, err, ErrBadFormat)
+}
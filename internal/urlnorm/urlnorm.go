@@ -0,0 +1,201 @@
+// Package urlnorm validates urls before they are shortened and brings
+// equal urls to one form, so they get the same short code.
+package urlnorm
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	ErrEmpty     = errors.New("URL IS EMPTY")
+	ErrInvalid   = errors.New("URL IS INVALID")
+	ErrScheme    = errors.New("URL SCHEME IS NOT ALLOWED")
+	ErrNoHost    = errors.New("URL HAS NO HOST")
+	ErrBadHost   = errors.New("URL HOST IS INVALID")
+	ErrTooLong   = errors.New("URL IS TOO LONG")
+	defSchemes   = []string{"http", "https"}
+	defaultPorts = map[string]string{"http": "80", "https": "443"}
+)
+
+const maxLength = 2048
+
+// trackingParams are removed with StripTracking in addition to utm_*.
+var trackingParams = map[string]bool{
+	"fbclid":    true,
+	"gclid":     true,
+	"yclid":     true,
+	"msclkid":   true,
+	"_openstat": true,
+}
+
+// hostProfile is idna.Lookup which lets underscores through,
+// they are common in real subdomains.
+var hostProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+type Options struct {
+	// Schemes allowed in urls, http and https if empty.
+	Schemes []string
+	// SortQuery orders query parameters by name.
+	SortQuery bool
+	// StripTracking removes utm_* and click id parameters.
+	StripTracking bool
+}
+
+// Normalize returns the url in canonical form: lower case scheme and host,
+// host in punycode, no default port and no lone "/" path. A url without
+// scheme is taken as http.
+func Normalize(raw string, opts Options) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	if raw == "" {
+		return "", ErrEmpty
+	}
+
+	if len(raw) > maxLength {
+		return "", ErrTooLong
+	}
+
+	if strings.ContainsAny(raw, " \t\r\n") {
+		return "", ErrInvalid
+	}
+
+	if !strings.Contains(raw, "://") {
+		if hasOpaqueScheme(raw) {
+			return "", ErrScheme
+		}
+
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		return "", ErrInvalid
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	if !allowed(u.Scheme, opts.Schemes) {
+		return "", ErrScheme
+	}
+
+	if u.Hostname() == "" {
+		return "", ErrNoHost
+	}
+
+	host, err := normalizeHost(u.Hostname())
+
+	if err != nil {
+		return "", err
+	}
+
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	u.Host = host
+
+	if u.RawQuery != "" && (opts.SortQuery || opts.StripTracking) {
+		u.RawQuery = normalizeQuery(u.RawQuery, opts)
+	}
+
+	// "http://a.com/?" is the same as "http://a.com"
+	u.ForceQuery = false
+
+	if u.Path == "/" && u.RawPath == "" && u.RawQuery == "" && u.Fragment == "" {
+		u.Path = ""
+	}
+
+	return u.String(), nil
+}
+
+// hasOpaqueScheme tells "javascript:alert(1)" from "example.com:8080/path".
+func hasOpaqueScheme(raw string) bool {
+	u, err := url.Parse(raw)
+
+	if err != nil || u.Scheme == "" || strings.Contains(u.Scheme, ".") {
+		return false
+	}
+
+	port, _, _ := strings.Cut(u.Opaque, "/")
+
+	return strings.Trim(port, "0123456789") != "" || port == ""
+}
+
+func allowed(scheme string, schemes []string) bool {
+	if len(schemes) == 0 {
+		schemes = defSchemes
+	}
+
+	for _, v := range schemes {
+		if strings.EqualFold(v, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NormalizeHost brings a host to the form Normalize puts into urls:
+// lower case, without the trailing dot, punycode for names.
+func NormalizeHost(host string) (string, error) {
+	return normalizeHost(host)
+}
+
+func normalizeHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	ascii, err := hostProfile.ToASCII(host)
+
+	if err != nil || ascii == "" {
+		return "", ErrBadHost
+	}
+
+	return ascii, nil
+}
+
+func normalizeQuery(rawQuery string, opts Options) string {
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+
+	for _, v := range params {
+		name, _, _ := strings.Cut(v, "=")
+
+		if key, err := url.QueryUnescape(name); err == nil {
+			name = key
+		}
+
+		if opts.StripTracking && isTracking(name) {
+			continue
+		}
+
+		kept = append(kept, v)
+	}
+
+	if opts.SortQuery {
+		sort.SliceStable(kept, func(i, j int) bool {
+			ni, _, _ := strings.Cut(kept[i], "=")
+			nj, _, _ := strings.Cut(kept[j], "=")
+			return ni < nj
+		})
+	}
+
+	return strings.Join(kept, "&")
+}
+
+func isTracking(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || trackingParams[name]
+}
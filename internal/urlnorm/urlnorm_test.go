@@ -0,0 +1,74 @@
+package urlnorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+		want string
+	}{
+		{name: "UNCHANGED", in: "https://practicum.yandex.ru", want: "https://practicum.yandex.ru"},
+		{name: "CASE_AND_ROOT", in: "HTTP://Example.com/", want: "http://example.com"},
+		{name: "NO_SCHEME", in: "www.ya.ru", want: "http://www.ya.ru"},
+		{name: "NO_SCHEME_WITH_PORT", in: "localhost:8080/path", want: "http://localhost:8080/path"},
+		{name: "SPACES", in: "  https://example.com/a \n", want: "https://example.com/a"},
+		{name: "DEFAULT_PORT", in: "https://example.com:443/a", want: "https://example.com/a"},
+		{name: "OTHER_PORT", in: "https://example.com:8443/a", want: "https://example.com:8443/a"},
+		{name: "IPV6", in: "http://[::1]:80/", want: "http://[::1]"},
+		{name: "IDN", in: "http://Пример.РФ/", want: "http://xn--e1afmkfd.xn--p1ai"},
+		{name: "EMPTY_QUERY", in: "http://example.com/?", want: "http://example.com"},
+		{name: "QUERY_KEPT", in: "http://example.com/?b=2&utm_source=x&a=1", want: "http://example.com/?b=2&utm_source=x&a=1"},
+		{
+			name: "QUERY_SORTED_AND_STRIPPED",
+			in:   "http://example.com/p?utm_source=x&b=2&fbclid=y&a=1#top",
+			opts: Options{SortQuery: true, StripTracking: true},
+			want: "http://example.com/p?a=1&b=2#top",
+		},
+		{
+			name: "ONLY_TRACKING",
+			in:   "http://example.com/?utm_medium=email",
+			opts: Options{StripTracking: true},
+			want: "http://example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.in, tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNormalizeRejects(t *testing.T) {
+	tests := []struct {
+		in  string
+		err error
+	}{
+		{in: "   ", err: ErrEmpty},
+		{in: "javascript:alert(1)", err: ErrScheme},
+		{in: "data:text/html,<b>hi</b>", err: ErrScheme},
+		{in: "ftp://example.com/file", err: ErrScheme},
+		{in: "http:///path", err: ErrNoHost},
+		{in: "http://exa mple.com", err: ErrInvalid},
+		{in: "http://" + string(make([]byte, maxLength)), err: ErrTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := Normalize(tt.in, Options{})
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	_, err := Normalize("ftp://example.com/file", Options{Schemes: []string{"ftp"}})
+	assert.NoError(t, err, "scheme allow-list is configurable")
+}
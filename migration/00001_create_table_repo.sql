@@ -1,6 +1,6 @@
 -- +goose Up
 -- +goose StatementBegin
-CREATE TABLE repo (
+CREATE TABLE IF NOT EXISTS repo (
                    "id" SERIAL PRIMARY KEY,
                    "shorturl" VARCHAR NOT NULL UNIQUE,
                    "url" VARCHAR NOT NULL UNIQUE
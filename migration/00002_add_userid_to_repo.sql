@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE repo ADD COLUMN "userid" INTEGER NOT NULL DEFAULT 0
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX repo_userid_idx ON repo ("userid")
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX repo_userid_idx
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE repo DROP COLUMN "userid"
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE repo ADD COLUMN "is_deleted" BOOLEAN NOT NULL DEFAULT FALSE
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE repo DROP COLUMN "is_deleted"
+-- +goose StatementEnd
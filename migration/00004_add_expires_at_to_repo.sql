@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE repo ADD COLUMN "expires_at" TIMESTAMPTZ NULL
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX repo_expires_at_idx ON repo ("expires_at")
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX repo_expires_at_idx
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE repo DROP COLUMN "expires_at"
+-- +goose StatementEnd
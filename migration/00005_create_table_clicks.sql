@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE clicks (
+                     "shorturl" VARCHAR NOT NULL,
+                     "clicked_at" TIMESTAMPTZ NOT NULL,
+                     "referrer" VARCHAR NOT NULL DEFAULT '',
+                     "user_agent" VARCHAR NOT NULL DEFAULT '',
+                     "ip_hash" VARCHAR NOT NULL DEFAULT ''
+                     )
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX clicks_shorturl_idx ON clicks ("shorturl", "clicked_at")
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE clicks
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE api_keys (
+                     "id" VARCHAR PRIMARY KEY,
+                     "name" VARCHAR NOT NULL DEFAULT '',
+                     "hash" VARCHAR NOT NULL UNIQUE,
+                     "scopes" VARCHAR NOT NULL,
+                     "userid" INTEGER NOT NULL,
+                     "created_at" TIMESTAMPTZ NOT NULL,
+                     "revoked_at" TIMESTAMPTZ NULL
+                     )
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE api_keys
+-- +goose StatementEnd
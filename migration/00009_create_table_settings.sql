@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE settings (
+                     "name" VARCHAR PRIMARY KEY,
+                     "value" VARCHAR NOT NULL
+                     )
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE settings
+-- +goose StatementEnd
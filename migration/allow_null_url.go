@@ -0,0 +1,91 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/pressly/goose/v3"
+)
+
+const allowNullURLVersion = 7
+
+// allowNullURL lets tombstones of purged links have no url. Postgres
+// drops NOT NULL in place, SQLite can't, so there the table is rebuilt.
+// Down fails while there are tombstones, it would have to drop them.
+func allowNullURL(dialect goose.Dialect) *goose.Migration {
+	if dialect == goose.DialectPostgres {
+		return goose.NewGoMigration(allowNullURLVersion,
+			&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, "ALTER TABLE repo ALTER COLUMN url DROP NOT NULL")
+				return err
+			}},
+			&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+				if err := checkNoTombstones(ctx, tx); err != nil {
+					return err
+				}
+
+				_, err := tx.ExecContext(ctx, "ALTER TABLE repo ALTER COLUMN url SET NOT NULL")
+
+				return err
+			}},
+		)
+	}
+
+	return goose.NewGoMigration(allowNullURLVersion,
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			return rebuildSQLiteRepo(ctx, tx, "NULL")
+		}},
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			if err := checkNoTombstones(ctx, tx); err != nil {
+				return err
+			}
+
+			return rebuildSQLiteRepo(ctx, tx, "NOT NULL")
+		}},
+	)
+}
+
+func checkNoTombstones(ctx context.Context, tx *sql.Tx) error {
+	count := 0
+	err := tx.QueryRowContext(ctx, "SELECT count(*) FROM repo WHERE url IS NULL").Scan(&count)
+
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("CANT MAKE URL NOT NULL: REPO HAS %d TOMBSTONES OF PURGED LINKS", count)
+	}
+
+	return nil
+}
+
+// rebuildSQLiteRepo copies repo into a table whose url is nullable
+// as given and puts it in place of repo.
+func rebuildSQLiteRepo(ctx context.Context, tx *sql.Tx, nullable string) error {
+	statements := []string{
+		`CREATE TABLE repo_new (
+		                   "id" SERIAL PRIMARY KEY,
+		                   "shorturl" VARCHAR NOT NULL UNIQUE,
+		                   "url" VARCHAR ` + nullable + ` UNIQUE,
+		                   "userid" INTEGER NOT NULL DEFAULT 0,
+		                   "is_deleted" BOOLEAN NOT NULL DEFAULT FALSE,
+		                   "expires_at" TIMESTAMPTZ NULL
+		                   )`,
+		`INSERT INTO repo_new (id, shorturl, url, userid, is_deleted, expires_at)
+		      SELECT id, shorturl, url, userid, is_deleted, expires_at FROM repo`,
+		`DROP TABLE repo`,
+		`ALTER TABLE repo_new RENAME TO repo`,
+		`CREATE INDEX repo_userid_idx ON repo ("userid")`,
+		`CREATE INDEX repo_expires_at_idx ON repo ("expires_at")`,
+	}
+
+	for _, v := range statements {
+		if _, err := tx.ExecContext(ctx, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+// Package migration holds goose migrations shared by the sql backends,
+// and Go ones for what differs between them.
+package migration
+
+import (
+	"embed"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/pressly/goose/v3"
+)
+
+//go:embed *.sql
+var FS embed.FS
+
+// GoMigrations returns migrations which differ between databases, they
+// go to goose next to the SQL files of FS. lg gets warnings of
+// migrations which go on without what the database lacks.
+func GoMigrations(dialect goose.Dialect, lg logger.MyLogger) []*goose.Migration {
+	return []*goose.Migration{allowNullURL(dialect), urlSearch(dialect, lg)}
+}
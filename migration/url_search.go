@@ -0,0 +1,100 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/DmitryM7/short-url.git/internal/logger"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pressly/goose/v3"
+)
+
+const urlSearchVersion = 8
+
+// urlSearch indexes urls for searches of the link list. On Postgres a
+// text_pattern_ops btree serves prefix searches and, where pg_trgm can
+// be had, a trigram index serves LIKE with any pattern. Both are built
+// concurrently outside a transaction, so a big repo keeps taking writes
+// meanwhile. Without pg_trgm other searches scan repo, the server still
+// starts. SQLite gets nothing: it searches with GLOB, which uses the
+// unique index of url for prefixes.
+func urlSearch(dialect goose.Dialect, lg logger.MyLogger) *goose.Migration {
+	if dialect != goose.DialectPostgres {
+		noop := &goose.GoFunc{RunTx: func(context.Context, *sql.Tx) error { return nil }}
+		return goose.NewGoMigration(urlSearchVersion, noop, noop)
+	}
+
+	return goose.NewGoMigration(urlSearchVersion,
+		&goose.GoFunc{RunDB: func(ctx context.Context, db *sql.DB) error {
+			err := createIndexConcurrently(ctx, db, "repo_url_pattern_idx", "repo (url text_pattern_ops)")
+
+			if err != nil {
+				return err
+			}
+
+			_, err = db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS pg_trgm")
+
+			if extensionUnavailable(err) {
+				lg.Warnln("PG_TRGM IS NOT AVAILABLE. URL SEARCH BY SUBSTRING SCANS REPO", "error", err.Error())
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			return createIndexConcurrently(ctx, db, "repo_url_trgm_idx", "repo USING gin (url gin_trgm_ops)")
+		}},
+		&goose.GoFunc{RunDB: func(ctx context.Context, db *sql.DB) error {
+			for _, v := range []string{"repo_url_trgm_idx", "repo_url_pattern_idx"} {
+				if _, err := db.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+v); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}},
+	)
+}
+
+// createIndexConcurrently builds the index unless a valid one is there.
+// A concurrent build which failed leaves an invalid index behind, it is
+// dropped and built again.
+func createIndexConcurrently(ctx context.Context, db *sql.DB, name, on string) error {
+	invalid := false
+	err := db.QueryRowContext(ctx, "SELECT NOT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1)", name).Scan(&invalid)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if invalid {
+		if _, err := db.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+name); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, "CREATE INDEX CONCURRENTLY IF NOT EXISTS "+name+" ON "+on)
+
+	return err
+}
+
+// extensionUnavailable tells whether the extension is missing from the
+// server or the role may not create it.
+func extensionUnavailable(err error) bool {
+	var pgErr *pgconn.PgError
+
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	switch pgErr.Code {
+	case "42501", // insufficient_privilege
+		"58P01", // undefined_file, the extension is not installed
+		"0A000": // feature_not_supported
+		return true
+	}
+
+	return false
+}